@@ -0,0 +1,87 @@
+package emulator
+
+import (
+	"errors"
+	"sync"
+	"weak"
+)
+
+// active tracks the emulator processes started by the package which haven't
+// been closed yet, by Emulator. The references to the emulators are weak so
+// as not to defeat the leak detection, but the processes are tracked until
+// they exit, so that an Emulator dropped without Close still counts while its
+// process runs.
+var active = struct {
+	sync.Mutex
+	emulators map[weak.Pointer[Emulator]]*process
+}{emulators: map[weak.Pointer[Emulator]]*process{}}
+
+// ActiveCount returns the number of emulator processes started by the package
+// whose Emulator hasn't been closed yet, including the ones still running
+// after their Emulator was garbage collected without Close. Asserting that
+// it's zero at the end of a test binary detects the leaked emulators.
+func ActiveCount() int {
+	active.Lock()
+	defer active.Unlock()
+	pruneActive()
+	return len(active.emulators)
+}
+
+// pruneActive stops tracking the processes which exited after their Emulator
+// was garbage collected. The active lock must be held.
+func pruneActive() {
+	for p, proc := range active.emulators {
+		if p.Value() == nil && hasExited(proc) {
+			delete(active.emulators, p)
+		}
+	}
+}
+
+func hasExited(proc *process) bool {
+	select {
+	case <-proc.exited():
+		return true
+	default:
+		return false
+	}
+}
+
+// trackActive tracks the current process of the Emulator.
+func (e *Emulator) trackActive() {
+	active.Lock()
+	defer active.Unlock()
+	active.emulators[weak.Make(e)] = e.proc
+}
+
+func (e *Emulator) untrackActive() {
+	active.Lock()
+	defer active.Unlock()
+	delete(active.emulators, weak.Make(e))
+}
+
+// CloseAll closes all the emulators counted by ActiveCount, killing the
+// processes of the ones which were garbage collected, and returns their joined
+// errors.
+func CloseAll() error {
+	active.Lock()
+	pruneActive()
+	var emulators []*Emulator
+	var orphans []*process
+	for p, proc := range active.emulators {
+		if e := p.Value(); e != nil {
+			emulators = append(emulators, e)
+		} else {
+			orphans = append(orphans, proc)
+			delete(active.emulators, p)
+		}
+	}
+	active.Unlock()
+	var errs []error
+	for _, e := range emulators {
+		errs = append(errs, e.Close())
+	}
+	for _, proc := range orphans {
+		errs = append(errs, proc.kill())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,53 @@
+package emulator
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestActiveCount(t *testing.T) {
+	// the adoption through DATASTORE_HOST remembers the environment set by the
+	// other emulators, so the initial one is restored at the end of the test
+	for _, k := range defaultManagedEnvVars {
+		t.Setenv(k, os.Getenv(k))
+	}
+	base := ActiveCount()
+	one := newFakeEmulator(t, nil)
+	newFakeEmulator(t, nil)
+	newAdoptingEmulator(t, fakeConfig{})
+	if got := ActiveCount(); got != base+2 {
+		t.Errorf("ActiveCount() = %d, want %d, the adopted emulator not counted", got, base+2)
+	}
+	if err := one.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ActiveCount(); got != base+1 {
+		t.Errorf("ActiveCount() after Close = %d, want %d", got, base+1)
+	}
+
+	// the dropped emulator doesn't restore the environment
+	for _, k := range defaultManagedEnvVars {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	dropped, err := New(fakeGcloud()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc := dropped.proc
+	dropped = nil
+	runtime.GC()
+	if got := ActiveCount(); got != base+2 {
+		t.Errorf("ActiveCount() with a garbage collected emulator = %d, want %d", got, base+2)
+	}
+	if err := CloseAll(); err != nil {
+		t.Errorf("CloseAll() error = %v", err)
+	}
+	if !hasExited(proc) {
+		t.Error("CloseAll() didn't kill the process of the garbage collected emulator")
+	}
+	if got := ActiveCount(); got != 0 {
+		t.Errorf("ActiveCount() after CloseAll = %d, want 0", got)
+	}
+}
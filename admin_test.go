@@ -0,0 +1,236 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestExportMetadataFile(t *testing.T) {
+	dir := t.TempDir()
+	one := filepath.Join(dir, "one")
+	two := filepath.Join(dir, "two")
+	for _, file := range []string{
+		filepath.Join(one, "one"+metadataSuffix),
+		filepath.Join(two, "a"+metadataSuffix),
+		filepath.Join(two, "b"+metadataSuffix),
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		dir     string
+		want    string
+		wantErr bool
+	}{
+		{dir: one, want: filepath.Join(one, "one"+metadataSuffix)},
+		{dir: filepath.Join(one, "one"+metadataSuffix), want: filepath.Join(one, "one"+metadataSuffix)},
+		{dir: "gs://bucket/2024-01-01", want: "gs://bucket/2024-01-01/2024-01-01" + metadataSuffix},
+		{dir: "gs://bucket/2024-01-01/", want: "gs://bucket/2024-01-01/2024-01-01" + metadataSuffix},
+		{dir: "gs://bucket/x/x" + metadataSuffix, want: "gs://bucket/x/x" + metadataSuffix},
+		{dir: two, wantErr: true},
+		{dir: dir, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := exportMetadataFile(tt.dir)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("exportMetadataFile(%q) = %q, %v, want %q, error %v", tt.dir, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{opPolls: 2})
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := datastore.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &entity{N: 1}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := e.Export(ctx, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if !strings.HasSuffix(file, metadataSuffix) {
+		t.Errorf("Export() = %q, want a metadata file", file)
+	}
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Import(ctx, filepath.Dir(file)); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	var got entity
+	if err := c.Get(ctx, key, &got); err != nil || got.N != 1 {
+		t.Errorf("Get() after Import = %+v, %v", got, err)
+	}
+}
+
+func TestImportRequest(t *testing.T) {
+	var inputURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+		case "/v1/projects/test:import":
+			var req struct {
+				InputURL string `json:"inputUrl"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			inputURL = req.InputURL
+			_, _ = w.Write([]byte(`{"name":"projects/test/operations/1"}`))
+		case "/v1/projects/test/operations/1":
+			_, _ = w.Write([]byte(`{"name":"projects/test/operations/1","done":true,"error":{"code":3,"message":"bad input"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	advertise(t, srv.URL, "test")
+	e := newTestEmulator(t, WithRandomPort())
+
+	err := e.Import(context.Background(), "gs://bucket/2024-01-01")
+	if err == nil || !strings.Contains(err.Error(), "bad input") {
+		t.Errorf("Import() error = %v, want the operation error", err)
+	}
+	if want := "gs://bucket/2024-01-01/2024-01-01" + metadataSuffix; inputURL != want {
+		t.Errorf("inputUrl = %q, want %q", inputURL, want)
+	}
+}
+
+func TestAdminRequest(t *testing.T) {
+	ctx := context.Background()
+	if _, err := (&Emulator{}).AdminRequest(ctx, http.MethodGet, "/", nil); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("AdminRequest() before Start error = %v, want ErrNotStarted", err)
+	}
+
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	body := strings.NewReader(`{"outputUrlPrefix":"` + t.TempDir() + `","entityFilter":{"kinds":["Kind"]}}`)
+	resp, err := e.AdminRequest(ctx, http.MethodPost, "/v1/projects/"+e.ProjectID+":export", body)
+	if err != nil {
+		t.Fatalf("AdminRequest() error = %v", err)
+	}
+	defer resp.Body.Close()
+	var op operation
+	if err := json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(op.Name, "projects/test/operations/") {
+		t.Errorf("AdminRequest() = %d, %+v, want the export operation", resp.StatusCode, op)
+	}
+}
+
+func TestExportFiltered(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := func(kind, ns string) *datastore.Key {
+		k := datastore.NameKey(kind, "a", nil)
+		k.Namespace = ns
+		return k
+	}
+	keys := []*datastore.Key{key("A", "one"), key("A", "two"), key("B", "one")}
+	if _, err := c.PutMulti(ctx, keys, make([]entity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+	file, err := e.Export(ctx, t.TempDir(), &ExportOptions{Kinds: []string{"A"}, Namespaces: []string{"one"}})
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Import(ctx, file); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	for i, want := range []bool{true, false, false} {
+		err := c.Get(ctx, keys[i], &entity{})
+		if got := err == nil; got != want {
+			t.Errorf("Get(%v) after the filtered export and import error = %v, want found %v", keys[i], err, want)
+		}
+	}
+}
+
+func TestAdminTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("timeout", func(t *testing.T) {
+		e, _ := newAdoptingEmulator(t, fakeConfig{opPolls: -1}, WithAdminTimeout(150*time.Millisecond), WithAdminPollInterval(10*time.Millisecond))
+		_, err := e.Export(ctx, t.TempDir(), nil)
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "projects/test/operations/") {
+			t.Errorf("Export() error = %v, want a deadline error naming the operation", err)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		e, _ := newAdoptingEmulator(t, fakeConfig{opPolls: -1}, WithAdminTimeout(time.Hour))
+		short, cancel := context.WithTimeout(ctx, 150*time.Millisecond)
+		defer cancel()
+		if _, err := e.Export(short, t.TempDir(), nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Export() error = %v, want the context deadline to take precedence", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		e, _ := newAdoptingEmulator(t, fakeConfig{opPolls: -1}, WithAdminTimeout(time.Hour))
+		file := filepath.Join(t.TempDir(), "empty"+metadataSuffix)
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for name, call := range map[string]func(context.Context) error{
+			"Export": func(ctx context.Context) error { _, err := e.Export(ctx, t.TempDir(), nil); return err },
+			"Import": func(ctx context.Context) error { return e.Import(ctx, file) },
+		} {
+			canceled, cancel := context.WithCancel(ctx)
+			time.AfterFunc(100*time.Millisecond, cancel)
+			began := time.Now()
+			err := call(canceled)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s() error = %v, want the cancellation", name, err)
+			}
+			if d := time.Since(began); d > 100*time.Millisecond+2*pollingRate {
+				t.Errorf("%s() returned %v after the start, want it to return on the cancellation", name, d)
+			}
+		}
+	})
+
+	t.Run("poll interval", func(t *testing.T) {
+		const polls = 5
+		e, _ := newAdoptingEmulator(t, fakeConfig{opPolls: polls}, WithAdminPollInterval(time.Millisecond))
+		began := time.Now()
+		if _, err := e.Export(ctx, t.TempDir(), nil); err != nil {
+			t.Fatalf("Export() error = %v", err)
+		}
+		if d := time.Since(began); d >= polls*pollingRate {
+			t.Errorf("Export() took %v, want the operation polled at the admin interval", d)
+		}
+	})
+
+	for _, opt := range []Option{WithAdminTimeout(0), WithAdminPollInterval(-time.Second)} {
+		if err := opt(&Emulator{}); err == nil {
+			t.Error("a non-positive admin duration error = nil")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// ClientOptions returns the options for building a datastore client talking
+// to the emulator. Authentication is disabled, as the emulator never needs
+// it, which also silences the Application Default Credentials warnings. The
+// options only make sense for clients talking to the emulator.
+func (e *Emulator) ClientOptions() []option.ClientOption {
+	return e.clientOptions(e.Config().ClientOptions(), e.grpcDialer)
+}
+
+// helperClientOptions returns the options of the client used by the package
+// itself. It dials the emulator on its bind address, like grpcProbe, so it
+// works during the startup, before the unix socket is forwarded, and its
+// requests bypass the request log proxy.
+func (e *Emulator) helperClientOptions() []option.ClientOption {
+	cfg := e.Config()
+	if e.addr != "" {
+		cfg.Endpoint = e.addr
+	}
+	dialer := e.grpcDialer
+	if e.unixSocket != "" {
+		dialer = nil
+	}
+	return e.clientOptions(cfg.ClientOptions(), dialer)
+}
+
+// clientOptions appends the dialer, the connection pool and the message size
+// options to opts.
+func (e *Emulator) clientOptions(opts []option.ClientOption, dialer func(context.Context, string) (net.Conn, error)) []option.ClientOption {
+	if dialer != nil {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(dialer)))
+	}
+	if e.grpcConnPool > 0 {
+		opts = append(opts, option.WithGRPCConnectionPool(e.grpcConnPool))
+	}
+	var callOpts []grpc.CallOption
+	if e.maxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(e.maxRecvMsgSize))
+	}
+	if e.maxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(e.maxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithDefaultCallOptions(callOpts...)))
+	}
+	return opts
+}
+
+// Client returns a new datastore client talking to the emulator. The given
+// options are applied after the ones returned by ClientOptions. The caller is
+// responsible for closing the client.
+func (e *Emulator) Client(ctx context.Context, opts ...option.ClientOption) (*datastore.Client, error) {
+	if !e.started() {
+		return nil, ErrNotStarted
+	}
+	return datastore.NewClient(ctx, e.ProjectID, append(e.ClientOptions(), opts...)...)
+}
+
+// ClientWithCleanup is like Client, but it also returns a function closing the
+// client, which can be called any number of times, e.g. deferred or passed to
+// t.Cleanup.
+func (e *Emulator) ClientWithCleanup(ctx context.Context, opts ...option.ClientOption) (*datastore.Client, func(), error) {
+	c, err := e.Client(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	return c, func() { once.Do(func() { _ = c.Close() }) }, nil
+}
+
+// sharedClient returns the datastore client used by the helper methods,
+// built on first use with the options set with WithClientOptions, which
+// avoids the connection churn of a client per call. It talks to the emulator
+// on its bind address (see helperClientOptions). It's closed by Close.
+func (e *Emulator) sharedClient(ctx context.Context) (*datastore.Client, error) {
+	if !e.started() {
+		return nil, ErrNotStarted
+	}
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	if e.client == nil {
+		opts := append(e.helperClientOptions(), e.clientOpts...)
+		c, err := datastore.NewClient(ctx, e.ProjectID, opts...)
+		if err != nil {
+			return nil, err
+		}
+		e.client = c
+	}
+	return e.client, nil
+}
+
+// closeSharedClient closes the client returned by sharedClient, if any, so
+// that the next helper call builds a new one.
+func (e *Emulator) closeSharedClient() error {
+	e.clientMu.Lock()
+	defer e.clientMu.Unlock()
+	if e.client == nil {
+		return nil
+	}
+	err := e.client.Close()
+	e.client = nil
+	return err
+}
@@ -0,0 +1,229 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func containsOption(opts []option.ClientOption, want option.ClientOption) bool {
+	for _, opt := range opts {
+		if reflect.DeepEqual(opt, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClientOptions(t *testing.T) {
+	e := &Emulator{Host: "http://localhost:8081", ProjectID: "test"}
+	e.init()
+	opts := e.ClientOptions()
+	for _, want := range []option.ClientOption{option.WithoutAuthentication(), option.WithEndpoint("localhost:8081")} {
+		if !containsOption(opts, want) {
+			t.Errorf("ClientOptions() = %v, want %T included", opts, want)
+		}
+	}
+
+	if err := WithGRPCConnPool(4)(e); err != nil {
+		t.Fatal(err)
+	}
+	if opts := e.ClientOptions(); !containsOption(opts, option.WithGRPCConnectionPool(4)) {
+		t.Errorf("ClientOptions() = %v, want the connection pool included", opts)
+	}
+	if err := WithGRPCConnPool(0)(e); err == nil {
+		t.Error("WithGRPCConnPool(0) error = nil")
+	}
+}
+
+func TestClientWithoutCredentials(t *testing.T) {
+	// the client would fail to read the credentials if it looked them up
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	if _, err := c.Put(ctx, datastore.NameKey("Kind", "a", nil), &entity{N: 1}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if n := f.rpcCount("Commit"); n != 1 {
+		t.Errorf("the emulator received %d Commit calls, want 1", n)
+	}
+}
+
+func TestGRPCDialer(t *testing.T) {
+	var dialed atomic.Int32
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	e, _ := newAdoptingEmulator(t, fakeConfig{}, WithGRPCDialer(dialer))
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	if _, err := c.Put(ctx, e.NameKey("Kind", "a", nil), &entity{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if dialed.Load() == 0 {
+		t.Error("the client didn't use the custom dialer")
+	}
+
+	dialed.Store(0)
+	if _, err := e.Count(ctx, "Kind", ""); err != nil {
+		t.Fatal(err)
+	}
+	if dialed.Load() == 0 {
+		t.Error("the helper client didn't use the custom dialer")
+	}
+}
+
+func BenchmarkGRPCConnPool(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			e, _ := newAdoptingEmulator(b, fakeConfig{}, WithGRPCConnPool(n))
+			ctx := context.Background()
+			c, err := e.Client(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			type entity struct{ N int }
+			var seq atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				keys := make([]*datastore.Key, 50)
+				entities := make([]entity, len(keys))
+				for pb.Next() {
+					for i := range keys {
+						keys[i] = e.IDKey("Kind", seq.Add(1), nil)
+					}
+					if _, err := c.PutMulti(ctx, keys, entities); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSharedClient(t *testing.T) {
+	var dialed atomic.Int32
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	e, _ := newAdoptingEmulator(t, fakeConfig{}, WithClientOptions(option.WithGRPCDialOption(grpc.WithContextDialer(dialer))))
+	ctx := context.Background()
+	if _, err := e.Count(ctx, "Kind", ""); err != nil {
+		t.Fatal(err)
+	}
+	c := e.client
+	if c == nil {
+		t.Fatal("Count() didn't build the shared client")
+	}
+	if err := e.DeleteAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.CountAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.sharedClient(ctx); err != nil || got != c || e.client != c {
+		t.Errorf("sharedClient() = %p, %v after the helper calls, want the client %p", got, err, c)
+	}
+	if dialed.Load() == 0 {
+		t.Error("the shared client didn't use the options set with WithClientOptions")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e.client != nil {
+		t.Error("Close() didn't close the shared client")
+	}
+}
+
+func TestClientWithCleanup(t *testing.T) {
+	if _, _, err := (&Emulator{}).ClientWithCleanup(context.Background()); err == nil {
+		t.Error("ClientWithCleanup() before Start error = nil")
+	}
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	c, cleanup, err := e.ClientWithCleanup(ctx)
+	if err != nil {
+		t.Fatalf("ClientWithCleanup() error = %v", err)
+	}
+	type entity struct{ N int }
+	key := e.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &entity{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	cleanup()
+	cleanup() // idempotent
+	if _, err := c.Put(ctx, key, &entity{}); err == nil {
+		t.Error("Put() after the cleanup error = nil, want the client closed")
+	}
+}
+
+func TestMaxMsgSize(t *testing.T) {
+	const size = 6 << 20 // over the gRPC default of 4 MiB
+	type blob struct {
+		Data []byte `datastore:",noindex"`
+	}
+	large := &blob{Data: make([]byte, size)}
+	roundTrip := func(t *testing.T, opts ...Option) error {
+		t.Helper()
+		e, _ := newAdoptingEmulator(t, fakeConfig{}, opts...)
+		ctx := context.Background()
+		c, err := e.Client(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		key := e.NameKey("Blob", "large", nil)
+		if _, err := c.Put(ctx, key, large); err != nil {
+			return err
+		}
+		var got blob
+		if err := c.Get(ctx, key, &got); err != nil {
+			return err
+		}
+		if len(got.Data) != size {
+			t.Errorf("Get() returned %d bytes, want %d", len(got.Data), size)
+		}
+		return nil
+	}
+
+	if err := roundTrip(t, WithMaxRecvMsgSize(16<<20)); err != nil {
+		t.Errorf("put and get of a %d bytes entity error = %v", size, err)
+	}
+	if err := roundTrip(t); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("get of a %d bytes entity without the option error = %v, want ResourceExhausted", size, err)
+	}
+	if err := roundTrip(t, WithMaxSendMsgSize(1<<20)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("put of a %d bytes entity over the send limit error = %v, want ResourceExhausted", size, err)
+	}
+	for _, opt := range []Option{WithMaxRecvMsgSize(0), WithMaxSendMsgSize(-1)} {
+		if err := opt(&Emulator{}); err == nil {
+			t.Error("a non-positive message size was accepted")
+		}
+	}
+}
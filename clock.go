@@ -0,0 +1,41 @@
+package emulator
+
+import "time"
+
+// clock abstracts the passage of time in the health polling of the startup
+// and of WaitHealthy, so that their timeout and polling logic can be driven
+// without real sleeps.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker is the subset of time.Ticker used by the package.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock used by default, backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t realTicker) Stop() { t.t.Stop() }
+
+// withClock replaces the clock of the emulator; it's a test hook.
+func withClock(c clock) Option {
+	return func(e *Emulator) error {
+		e.clock = c
+		return nil
+	}
+}
@@ -0,0 +1,316 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when it's advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	afters  []fakeAfter
+	ready   chan struct{} // receives a value whenever a ticker is created
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	stopped bool
+}
+
+type fakeAfter struct {
+	c    chan time.Time
+	when time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		ready: make(chan struct{}, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), d: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.afters = append(c.afters, fakeAfter{c: ch, when: c.now.Add(d)})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the tickers and the timers
+// which are due. Like the time package, a ticker drops the ticks its reader
+// is too slow for.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.d)
+		}
+	}
+	pending := c.afters[:0]
+	for _, a := range c.afters {
+		if a.when.After(c.now) {
+			pending = append(pending, a)
+			continue
+		}
+		a.c <- a.when
+	}
+	c.afters = pending
+}
+
+// waitTicker waits for a ticker to be created, i.e. for the code under test
+// to start polling.
+func (c *fakeClock) waitTicker(tb testing.TB) {
+	tb.Helper()
+	select {
+	case <-c.ready:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("no ticker was created")
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// startupConfirmation runs confirmStartup against a health check served by
+// the handler, with a fake clock.
+type startupConfirmation struct {
+	e        *Emulator
+	clock    *fakeClock
+	probes   chan error // the result of every health check
+	done     chan *StartupError
+	canceled func()
+}
+
+func confirmWithFakeClock(tb testing.TB, handler http.Handler, opts ...Option) *startupConfirmation {
+	tb.Helper()
+	srv := httptest.NewServer(handler)
+	tb.Cleanup(srv.Close)
+	sc := &startupConfirmation{
+		clock:  newFakeClock(),
+		probes: make(chan error, 100),
+		done:   make(chan *StartupError, 1),
+	}
+	opts = append(opts, withClock(sc.clock), WithStartupProgress(func(_ int, err error) {
+		sc.probes <- err
+	}))
+	sc.e = applyOptions(tb, opts...)
+	sc.e.Host = srv.URL
+	sc.e.addr = strings.TrimPrefix(srv.URL, "http://")
+	sc.e.proc = &process{done: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.canceled = cancel
+	tb.Cleanup(cancel)
+	go func() { sc.done <- sc.e.confirmStartup(ctx) }()
+	sc.clock.waitTicker(tb)
+	return sc
+}
+
+// tick advances the clock to the next health check and returns its result.
+func (sc *startupConfirmation) tick(tb testing.TB) error {
+	tb.Helper()
+	sc.clock.Advance(pollingRate)
+	select {
+	case err := <-sc.probes:
+		return err
+	case <-time.After(5 * time.Second):
+		tb.Fatal("no health check was performed")
+		return nil
+	}
+}
+
+// result returns the result of confirmStartup, failing if it doesn't return.
+func (sc *startupConfirmation) result(tb testing.TB) *StartupError {
+	tb.Helper()
+	select {
+	case err := <-sc.done:
+		return err
+	case <-time.After(5 * time.Second):
+		tb.Fatal("confirmStartup didn't return")
+		return nil
+	}
+}
+
+// pending reports whether confirmStartup is still running.
+func (sc *startupConfirmation) pending() bool {
+	select {
+	case err := <-sc.done:
+		sc.done <- err
+		return false
+	default:
+		return true
+	}
+}
+
+func statusHandler(codes ...int) http.Handler {
+	var mu sync.Mutex
+	n := 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		w.WriteHeader(nth(codes, n))
+	})
+}
+
+func TestConfirmStartupClock(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusServiceUnavailable), WithTimeout(time.Hour))
+		for range 3 {
+			var se *StatusError
+			if err := sc.tick(t); !errors.As(err, &se) || se.Code != http.StatusServiceUnavailable {
+				t.Fatalf("health check error = %v, want a 503 StatusError", err)
+			}
+		}
+		if !sc.pending() {
+			t.Fatal("confirmStartup returned before the timeout")
+		}
+		sc.clock.Advance(time.Hour)
+		err := sc.result(t)
+		if err == nil || !errors.Is(err.Err, context.DeadlineExceeded) {
+			t.Fatalf("confirmStartup() = %v, want a deadline error", err)
+		}
+		var se *StatusError
+		if !errors.As(err.LastProbe, &se) || se.Code != http.StatusServiceUnavailable {
+			t.Errorf("LastProbe = %v, want the last health check error", err.LastProbe)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusServiceUnavailable, http.StatusOK), WithTimeout(time.Hour))
+		if err := sc.tick(t); err == nil {
+			t.Fatal("the first health check succeeded")
+		}
+		if err := sc.tick(t); err != nil {
+			t.Fatalf("health check error = %v", err)
+		}
+		if err := sc.result(t); err != nil {
+			t.Errorf("confirmStartup() = %v, want nil", err)
+		}
+	})
+	t.Run("404 then 200", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusNotFound, http.StatusNotFound, http.StatusOK), WithTimeout(time.Hour))
+		for range 2 {
+			var se *StatusError
+			if err := sc.tick(t); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+				t.Fatalf("health check error = %v, want a 404 StatusError", err)
+			}
+		}
+		if !sc.pending() {
+			t.Fatal("confirmStartup gave up on a 404")
+		}
+		if err := sc.tick(t); err != nil {
+			t.Fatalf("health check error = %v", err)
+		}
+		if err := sc.result(t); err != nil {
+			t.Errorf("confirmStartup() = %v, want nil", err)
+		}
+	})
+
+	t.Run("persistent 404", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusNotFound), WithTimeout(time.Hour))
+		sc.tick(t)
+		sc.clock.Advance(time.Hour)
+		err := sc.result(t)
+		if err == nil || !errors.Is(err.Err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "health check path may be misconfigured") {
+			t.Errorf("confirmStartup() = %v, want a deadline error hinting at the health check path", err)
+		}
+	})
+
+	t.Run("persistent 503", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusServiceUnavailable), WithTimeout(time.Hour))
+		sc.tick(t)
+		sc.clock.Advance(time.Hour)
+		if err := sc.result(t); err == nil || strings.Contains(err.Error(), "misconfigured") {
+			t.Errorf("confirmStartup() = %v, want a deadline error without the health check path hint", err)
+		}
+	})
+
+	t.Run("stabilization window", func(t *testing.T) {
+		ok, flicker := http.StatusOK, http.StatusServiceUnavailable
+		sc := confirmWithFakeClock(t, statusHandler(ok, flicker, ok, ok, ok), WithTimeout(time.Hour), WithStabilizationWindow(2*pollingRate))
+		for i, wantErr := range []bool{false, true, false, false} {
+			if err := sc.tick(t); (err != nil) != wantErr {
+				t.Fatalf("health check %d error = %v, want error %v", i+1, err, wantErr)
+			}
+			if !sc.pending() {
+				t.Fatalf("confirmStartup returned after health check %d, before a stable window", i+1)
+			}
+		}
+		if err := sc.tick(t); err != nil {
+			t.Fatalf("health check error = %v", err)
+		}
+		if err := sc.result(t); err != nil {
+			t.Errorf("confirmStartup() = %v, want nil once the health checks stabilized", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		sc := confirmWithFakeClock(t, statusHandler(http.StatusServiceUnavailable))
+		sc.canceled()
+		if err := sc.result(t); err == nil || !errors.Is(err.Err, context.Canceled) {
+			t.Errorf("confirmStartup() = %v, want context.Canceled", err)
+		}
+	})
+}
+
+// instantClock is a real clock whose timers fire immediately, recording the
+// requested durations.
+type instantClock struct {
+	realClock
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (c *instantClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delays = append(c.delays, d)
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
@@ -0,0 +1,138 @@
+package emulator
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Config holds the connection details of a running emulator. It allows
+// building datastore clients without relying on the environment variables.
+type Config struct {
+	ProjectID string
+	// Host is the base URL of the emulator, like Emulator.Host.
+	Host string
+	// Endpoint is the host:port of the emulator.
+	Endpoint string
+	// Persistent reports whether the emulator stores its data on disk.
+	Persistent bool
+	// NoAuth disables the authentication of the clients.
+	NoAuth bool
+	// TLS is the TLS config of the connections to an emulator fronted by
+	// HTTPS, which are insecure if nil.
+	TLS *tls.Config
+}
+
+// Config returns the connection details of the emulator.
+func (e *Emulator) Config() Config {
+	c := Config{
+		ProjectID:  e.ProjectID,
+		Host:       e.Host,
+		Endpoint:   e.GRPCEndpoint(),
+		Persistent: e.dataDir != "",
+		NoAuth:     true,
+	}
+	if e.scheme == "https" {
+		c.TLS = e.tlsClientConfig()
+	}
+	return c
+}
+
+// configVersion is the version of the format written by MarshalConfig.
+const configVersion = 1
+
+// configJSON is the serialized form of a Config.
+type configJSON struct {
+	Version    int    `json:"version"`
+	ProjectID  string `json:"projectId"`
+	Host       string `json:"host"`
+	Endpoint   string `json:"endpoint"`
+	Persistent bool   `json:"persistent"`
+}
+
+// MarshalConfig serializes the connection details of the emulator as JSON,
+// e.g. to share them with another process through a file. The format is
+// versioned, see UnmarshalConfig.
+func (e *Emulator) MarshalConfig() ([]byte, error) {
+	c := e.Config()
+	return json.Marshal(configJSON{
+		Version:    configVersion,
+		ProjectID:  c.ProjectID,
+		Host:       c.Host,
+		Endpoint:   c.Endpoint,
+		Persistent: c.Persistent,
+	})
+}
+
+// UnmarshalConfig parses the connection details serialized by MarshalConfig.
+// The fields unknown to this version of the package are ignored, but a newer
+// major version of the format is rejected. The clients built from the config
+// use TLS (with the default TLS config) if the host is an https URL.
+func UnmarshalConfig(data []byte) (*Config, error) {
+	var cj configJSON
+	if err := json.Unmarshal(data, &cj); err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+	if cj.Version < 1 || cj.Version > configVersion {
+		return nil, fmt.Errorf("unmarshal config: unsupported version %d", cj.Version)
+	}
+	c := &Config{
+		ProjectID:  cj.ProjectID,
+		Host:       cj.Host,
+		Endpoint:   cj.Endpoint,
+		Persistent: cj.Persistent,
+		NoAuth:     true,
+	}
+	if strings.HasPrefix(cj.Host, "https://") {
+		c.TLS = &tls.Config{}
+	}
+	return c, nil
+}
+
+// Started returns the resolved connection details of the emulator once it has
+// been started, whether it was launched by Start or reused from the
+// environment. It returns ErrNotStarted otherwise.
+func (e *Emulator) Started() (Config, error) {
+	if !e.started() {
+		return Config{}, ErrNotStarted
+	}
+	return e.Config(), nil
+}
+
+// Env returns the environment variables pointing clients at the emulator, in
+// the "key=value" form used by exec.Cmd, sorted by name. They are the ones
+// managed by the Emulator (see WithManagedEnvVars and WithDatasetID), with the
+// values Start sets.
+func (e *Emulator) Env() []string {
+	vars := e.managedEnv(e.GRPCEndpoint())
+	env := make([]string, 0, len(vars))
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		env = append(env, k+"="+vars[k])
+	}
+	return env
+}
+
+// ClientOptions returns the options for building a datastore client talking
+// to the emulator described by the config.
+func (c Config) ClientOptions() []option.ClientOption {
+	opts := []option.ClientOption{option.WithEndpoint(c.Endpoint)}
+	if c.NoAuth {
+		creds := insecure.NewCredentials()
+		if c.TLS != nil {
+			creds = credentials.NewTLS(c.TLS)
+		}
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(creds)),
+		)
+	}
+	return opts
+}
@@ -0,0 +1,102 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestConfigClient(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	cfg := e.Config()
+	if cfg.ProjectID != e.ProjectID || cfg.Endpoint != f.addr || !cfg.NoAuth {
+		t.Errorf("Config() = %+v", cfg)
+	}
+	ctx := context.Background()
+	c, err := datastore.NewClient(ctx, cfg.ProjectID, cfg.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := datastore.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &entity{N: 1}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if n, err := e.Count(ctx, "Kind", ""); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v, want the entity put through the config client", n, err)
+	}
+}
+
+func TestStarted(t *testing.T) {
+	if _, err := (&Emulator{}).Started(); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("Started() before Start error = %v, want ErrNotStarted", err)
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		e := newFakeEmulator(t, nil, WithProject("fresh"))
+		cfg, err := e.Started()
+		if err != nil {
+			t.Fatalf("Started() error = %v", err)
+		}
+		if cfg.ProjectID != "fresh" || cfg.Endpoint != e.GRPCEndpoint() {
+			t.Errorf("Started() = %+v, want the launched emulator", cfg)
+		}
+	})
+
+	t.Run("reused", func(t *testing.T) {
+		e, f := newAdoptingEmulator(t, fakeConfig{})
+		cfg, err := e.Started()
+		if err != nil {
+			t.Fatalf("Started() error = %v", err)
+		}
+		if cfg.ProjectID != e.ProjectID || cfg.Endpoint != f.addr {
+			t.Errorf("Started() = %+v, want the reused emulator at %s", cfg, f.url())
+		}
+	})
+}
+
+func TestMarshalConfig(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{}, WithDataDir(t.TempDir()))
+	data, err := e.MarshalConfig()
+	if err != nil {
+		t.Fatalf("MarshalConfig() error = %v", err)
+	}
+	got, err := UnmarshalConfig(data)
+	if err != nil {
+		t.Fatalf("UnmarshalConfig() error = %v", err)
+	}
+	if want := e.Config(); *got != want {
+		t.Errorf("UnmarshalConfig(MarshalConfig()) = %+v, want %+v", *got, want)
+	}
+	if !got.Persistent {
+		t.Error("the persistence mode was lost")
+	}
+
+	// the fields unknown to this version are ignored
+	if c, err := UnmarshalConfig([]byte(`{"version":1,"host":"https://emulator","future":true}`)); err != nil || c.Host != "https://emulator" || c.TLS == nil {
+		t.Errorf("UnmarshalConfig() = %+v, %v, want the https host with TLS", c, err)
+	}
+	for _, data := range []string{`{"version":2}`, `{}`, `{`} {
+		if _, err := UnmarshalConfig([]byte(data)); err == nil {
+			t.Errorf("UnmarshalConfig(%s) error = nil", data)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	e := applyOptions(t, WithManagedEnvVars("DATASTORE_EMULATOR_HOST", "DATASTORE_HOST", "GOOGLE_CLOUD_PROJECT"), WithDatasetID("legacy"))
+	e.Host, e.ProjectID = "http://localhost:1234", "proj"
+	want := []string{
+		"DATASTORE_DATASET=legacy",
+		"DATASTORE_EMULATOR_HOST=localhost:1234",
+		"DATASTORE_HOST=http://localhost:1234",
+		"GOOGLE_CLOUD_PROJECT=proj",
+	}
+	if got := e.Env(); !slices.Equal(got, want) {
+		t.Errorf("Env() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+)
+
+type configKey struct{}
+
+// ContextWithEmulator returns a copy of ctx carrying the connection details of
+// the emulator (see Config), a context-scoped alternative to the environment
+// variables for the code building its clients with ClientFromContext.
+func (e *Emulator) ContextWithEmulator(ctx context.Context) context.Context {
+	return context.WithValue(ctx, configKey{}, e.Config())
+}
+
+// FromContext returns the connection details stored in ctx by
+// ContextWithEmulator, if any.
+func FromContext(ctx context.Context) (Config, bool) {
+	c, ok := ctx.Value(configKey{}).(Config)
+	return c, ok
+}
+
+// ClientFromContext returns a new datastore client talking to the emulator
+// whose connection details are stored in ctx. They take precedence over the
+// DATASTORE_EMULATOR_HOST environment variable; the given options are applied
+// last. The caller is responsible for closing the client.
+func ClientFromContext(ctx context.Context, opts ...option.ClientOption) (*datastore.Client, error) {
+	c, ok := FromContext(ctx)
+	if !ok {
+		return nil, errors.New("no emulator in context")
+	}
+	return datastore.NewClient(ctx, c.ProjectID, append(c.ClientOptions(), opts...)...)
+}
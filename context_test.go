@@ -0,0 +1,36 @@
+package emulator
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClientFromContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := FromContext(ctx); ok {
+		t.Error("FromContext() of an empty context = true")
+	}
+	if _, err := ClientFromContext(ctx); err == nil {
+		t.Error("ClientFromContext() of an empty context error = nil")
+	}
+
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	// the context takes precedence over the environment
+	t.Setenv("DATASTORE_EMULATOR_HOST", "localhost:1")
+	ctx = e.ContextWithEmulator(ctx)
+	if c, ok := FromContext(ctx); !ok || c.Endpoint != f.addr || c.ProjectID != e.ProjectID {
+		t.Errorf("FromContext() = %+v, %v, want the config of the emulator", c, ok)
+	}
+	c, err := ClientFromContext(ctx)
+	if err != nil {
+		t.Fatalf("ClientFromContext() error = %v", err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	if _, err := c.Put(ctx, e.NameKey("Kind", "a", nil), &entity{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if n := f.rpcCount("Commit"); n != 1 {
+		t.Errorf("the emulator received %d Commit calls, want 1", n)
+	}
+}
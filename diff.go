@@ -0,0 +1,174 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ChangeOp is the kind of change of an entity between two snapshots.
+type ChangeOp string
+
+// The kinds of changes of an entity.
+const (
+	ChangeAdded    ChangeOp = "added"
+	ChangeRemoved  ChangeOp = "removed"
+	ChangeModified ChangeOp = "modified"
+)
+
+// Change is a change of an entity between two snapshots, see DiffSnapshots.
+type Change struct {
+	Op  ChangeOp
+	Key *datastore.Key
+	// Properties are the changed properties of a modified entity, sorted by
+	// name.
+	Properties []PropertyChange
+}
+
+// PropertyChange is a change of a property of a modified entity. The values
+// are formatted as their type followed by their JSON value, e.g. `int:"42"`,
+// and empty if the property is absent.
+type PropertyChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	switch c.Op {
+	case ChangeAdded:
+		return "+ " + formatKey(c.Key)
+	case ChangeRemoved:
+		return "- " + formatKey(c.Key)
+	}
+	var b strings.Builder
+	b.WriteString("~ " + formatKey(c.Key))
+	for _, p := range c.Properties {
+		fmt.Fprintf(&b, "\n\t%s: %s -> %s", p.Name, orNone(p.Old), orNone(p.New))
+	}
+	return b.String()
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+// formatKey returns the key path prefixed by its namespace, if any.
+func formatKey(k *datastore.Key) string {
+	if k.Namespace == "" {
+		return k.String()
+	}
+	return k.Namespace + ":" + k.String()
+}
+
+// snapshotEntity is an entity of a snapshot, with its properties formatted
+// like in PropertyChange.
+type snapshotEntity struct {
+	key   *datastore.Key
+	props map[string]string
+}
+
+// DiffSnapshots compares two JSON dumps written by ExportJSON and returns the
+// entities added, removed and modified from a to b, sorted by key, e.g. to
+// find out what a code path changed in the store:
+//
+//	var before, after bytes.Buffer
+//	_ = e.ExportJSON(ctx, &before)
+//	// ...
+//	_ = e.ExportJSON(ctx, &after)
+//	changes, err := emulator.DiffSnapshots(&before, &after)
+func DiffSnapshots(a, b io.Reader) ([]Change, error) {
+	before, err := readSnapshot(a)
+	if err != nil {
+		return nil, fmt.Errorf("diff snapshots: a: %w", err)
+	}
+	after, err := readSnapshot(b)
+	if err != nil {
+		return nil, fmt.Errorf("diff snapshots: b: %w", err)
+	}
+	var changes []Change
+	for k, old := range before {
+		cur, ok := after[k]
+		if !ok {
+			changes = append(changes, Change{Op: ChangeRemoved, Key: old.key})
+			continue
+		}
+		if props := diffProperties(old.props, cur.props); len(props) > 0 {
+			changes = append(changes, Change{Op: ChangeModified, Key: old.key, Properties: props})
+		}
+	}
+	for k, cur := range after {
+		if _, ok := before[k]; !ok {
+			changes = append(changes, Change{Op: ChangeAdded, Key: cur.key})
+		}
+	}
+	slices.SortFunc(changes, func(x, y Change) int {
+		return strings.Compare(formatKey(x.Key), formatKey(y.Key))
+	})
+	return changes, nil
+}
+
+func diffProperties(old, cur map[string]string) []PropertyChange {
+	all := maps.Clone(old)
+	maps.Copy(all, cur)
+	var changes []PropertyChange
+	for _, name := range slices.Sorted(maps.Keys(all)) {
+		if old[name] != cur[name] {
+			changes = append(changes, PropertyChange{Name: name, Old: old[name], New: cur[name]})
+		}
+	}
+	return changes
+}
+
+// readSnapshot reads the entities of a JSON dump by formatted key.
+func readSnapshot(r io.Reader) (map[string]snapshotEntity, error) {
+	entities := map[string]snapshotEntity{}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var re rawEntity
+		if err := dec.Decode(&re); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("entity %d: %w", line, err)
+		}
+		if re.Key == nil {
+			return nil, fmt.Errorf("entity %d: missing key", line)
+		}
+		props := make(map[string]string, len(re.Properties))
+		for _, p := range re.Properties {
+			v, err := formatValue(p)
+			if err != nil {
+				return nil, fmt.Errorf("entity %d: property %q: %w", line, p.Name, err)
+			}
+			if prev, ok := props[p.Name]; ok {
+				v = prev + ", " + v
+			}
+			props[p.Name] = v
+		}
+		key := decodeKey(re.Key)
+		entities[formatKey(key)] = snapshotEntity{key: key, props: props}
+	}
+	return entities, nil
+}
+
+// formatValue formats the property value like in PropertyChange.
+func formatValue(p rawProperty) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, p.Value); err != nil {
+		return "", err
+	}
+	v := p.Type + ":" + buf.String()
+	if p.NoIndex {
+		v += " (noIndex)"
+	}
+	return v, nil
+}
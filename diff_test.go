@@ -0,0 +1,48 @@
+package emulator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	before := `{"key":{"kind":"K","name":"a"},"properties":[{"name":"N","type":"int","value":"1"}]}
+{"key":{"kind":"K","name":"b"},"properties":[]}
+{"key":{"kind":"K","name":"c","namespace":"ns"},"properties":[{"name":"S","type":"string","value":"same"}]}
+`
+	after := `{"key":{"kind":"K","name":"c","namespace":"ns"},"properties":[{"name":"S","type":"string","value":"same"}]}
+{"key":{"kind":"K","name":"a"},"properties":[{"name":"N","type":"int","value":"2"},{"name":"M","noIndex":true,"type":"string","value":"x"}]}
+{"key":{"kind":"K","name":"d"},"properties":[]}
+`
+	changes, err := DiffSnapshots(strings.NewReader(before), strings.NewReader(after))
+	if err != nil {
+		t.Fatalf("DiffSnapshots() error = %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"~ /K,a\n\tM: (none) -> string:\"x\" (noIndex)\n\tN: int:\"1\" -> int:\"2\"",
+		"- /K,b",
+		"+ /K,d",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("DiffSnapshots() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(changes) == 3 && (changes[0].Op != ChangeModified || changes[1].Op != ChangeRemoved || changes[2].Op != ChangeAdded || changes[2].Key.Name != "d") {
+		t.Errorf("DiffSnapshots() = %+v, want the modified, removed and added entities", changes)
+	}
+
+	if changes, err := DiffSnapshots(strings.NewReader(before), strings.NewReader(before)); err != nil || len(changes) != 0 {
+		t.Errorf("DiffSnapshots() of the same snapshot = %v, %v, want no changes", changes, err)
+	}
+	for _, tt := range []struct{ a, b, want string }{
+		{a: "{", b: "", want: "a: entity 1"},
+		{a: "", b: `{"properties":[]}`, want: "b: entity 1: missing key"},
+	} {
+		if _, err := DiffSnapshots(strings.NewReader(tt.a), strings.NewReader(tt.b)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("DiffSnapshots(%q, %q) error = %v, want %q", tt.a, tt.b, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package emulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gcloudEnvFile returns the path of the file where gcloud writes the
+// environment of the datastore emulator it started, in the gcloud config
+// directory (which can be overridden with CLOUDSDK_CONFIG).
+func gcloudEnvFile() (string, error) {
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config", "gcloud")
+	}
+	return filepath.Join(dir, "emulators", "datastore", "env.yaml"), nil
+}
+
+// DiscoverFromGcloudConfig returns the connection details of the emulator
+// last started by gcloud, read from the env.yaml file gcloud writes to its
+// config directory. It doesn't check that the emulator is still running. If
+// there is no such file, the returned error wraps os.ErrNotExist.
+func DiscoverFromGcloudConfig() (*Config, error) {
+	path, err := gcloudEnvFile()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// the file is a flat YAML mapping of the environment variables
+	vars := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		vars[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	c := &Config{
+		ProjectID: vars["DATASTORE_PROJECT_ID"],
+		Endpoint:  vars["DATASTORE_EMULATOR_HOST"],
+		NoAuth:    true,
+	}
+	if c.ProjectID == "" {
+		c.ProjectID = vars["DATASTORE_DATASET"]
+	}
+	if c.Endpoint == "" || c.ProjectID == "" {
+		return nil, errors.New(path + ": missing emulator host or project")
+	}
+	return c, nil
+}
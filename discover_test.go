@@ -0,0 +1,59 @@
+package emulator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGcloudEnv writes the env.yaml file of gcloud to a new config dir set
+// with CLOUDSDK_CONFIG.
+func writeGcloudEnv(tb testing.TB, content string) {
+	tb.Helper()
+	dir := tb.TempDir()
+	tb.Setenv("CLOUDSDK_CONFIG", dir)
+	file := filepath.Join(dir, "emulators", "datastore", "env.yaml")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestDiscoverFromGcloudConfig(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+		if _, err := DiscoverFromGcloudConfig(); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("DiscoverFromGcloudConfig() error = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		writeGcloudEnv(t, "DATASTORE_PROJECT_ID: proj\n")
+		if _, err := DiscoverFromGcloudConfig(); err == nil {
+			t.Error("DiscoverFromGcloudConfig() error = nil, want the missing host reported")
+		}
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		f := startFakeServer(t, fakeConfig{})
+		writeGcloudEnv(t, "DATASTORE_DATASET: proj\n"+
+			"DATASTORE_EMULATOR_HOST: "+f.addr+"\n"+
+			"DATASTORE_EMULATOR_HOST_PATH: "+f.addr+"/datastore\n"+
+			"DATASTORE_HOST: "+f.url()+"\n"+
+			"DATASTORE_PROJECT_ID: 'proj'\n")
+		c, err := DiscoverFromGcloudConfig()
+		if err != nil {
+			t.Fatalf("DiscoverFromGcloudConfig() error = %v", err)
+		}
+		if c.ProjectID != "proj" || c.Endpoint != f.addr {
+			t.Errorf("DiscoverFromGcloudConfig() = %+v, want the project and endpoint of the file", c)
+		}
+		e := newTestEmulator(t, append(fakeGcloud(), WithGcloudConfig())...)
+		if !e.Reused() || e.Host != f.url() || e.ProjectID != "proj" {
+			t.Errorf("Reused(), Host, ProjectID = %v, %q, %q, want the emulator of the file adopted", e.Reused(), e.Host, e.ProjectID)
+		}
+	})
+}
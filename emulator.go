@@ -1,12 +1,36 @@
 package emulator
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+)
+
+const (
+	// DefaultProject is the project ID used unless set with WithProject.
+	DefaultProject = "test"
+	// DefaultHost is the host-port the emulator listens on unless set with
+	// WithHostPort or WithRandomPort.
+	DefaultHost = "localhost:8088"
 )
 
 var (
@@ -15,141 +39,1280 @@ var (
 	resetEndpoint       = "/reset"
 	shutdownEndpoint    = "/shutdown"
 	healthcheckEndpoint = ""
-	defaultProject      = "test"
-	defaultHost         = "localhost:8088"
+	startRetryDelay     = 500 * time.Millisecond
+	shutdownTimeout     = 5 * time.Second
+	defaultConsistency  = 1.0 // prevents random test failures
+	defaultMaxLogBuffer = 4 << 10
+	defaultInitialDelay = 5 * time.Second
+	// the stderr lines of the emulator sent to the Errors channel by default
+	defaultErrorPattern = regexp.MustCompile(`\b(SEVERE|ERROR|WARNING|Exception)\b`)
+	errorsBuffer        = 100
+	defaultMaxIdleConns = 8
+	// the emulator command groups of the recent and of the older gcloud SDKs
+	gaCommandPrefix   = []string{"emulators", "datastore"}
+	betaCommandPrefix = []string{"beta", "emulators", "datastore"}
 )
 
 // Emulator manages the GCP Datastore Emulator process.
 type Emulator struct {
-	Host        string
-	ProjectID   string
-	stopOnClose bool
+	Host      string
+	ProjectID string
+
+	// configuration set with options
+	initialized       bool
+	project           string
+	datasetID         string
+	hostPort          string
+	randomPort        bool
+	consistency       float64
+	dataDir           string
+	timeout           time.Duration
+	startRetries      int
+	stableWindow      time.Duration
+	shutdownRetries   int
+	keepAlive         bool
+	dryRun            bool
+	cleanEnv          bool
+	gcloudEnv         []string
+	output            io.Writer
+	outputPrefix      string
+	outputPrefixSet   bool
+	deleteBatchSize   int
+	startupProgress   func(attempt int, err error)
+	healthCheck       HealthCheck
+	namespace         string
+	resetAllProjects  bool
+	metrics           Metrics
+	reclaimPort       bool
+	maxLogBuffer      int
+	grpcDialer        func(context.Context, string) (net.Conn, error)
+	grpcConnPool      int
+	maxRecvMsgSize    int
+	maxSendMsgSize    int
+	httpc             *http.Client
+	commandFunc       func(args []string) *exec.Cmd
+	indexFile         string
+	logger            Logger
+	grpcHealthCheck   bool
+	verbosity         string
+	debugOutput       io.Writer
+	leakDetection     bool
+	closeGrace        time.Duration
+	initialDelay      time.Duration
+	backend           Backend
+	clock             clock
+	cmdPrefix         []string
+	name              string
+	scheme            string
+	advertiseHostPort string
+	adminTimeout      time.Duration
+	adminPollInterval time.Duration
+	gcloudConfig      bool
+	preflight         func(context.Context) error
+	backoffBase       time.Duration
+	backoffMax        time.Duration
+	persistEnv        bool
+	onReset           func(context.Context) error
+	unixSocket        string
+	requestLog        bool
+	prewarm           bool
+	failureOutput     io.Writer
+	onStateChange     func(old, new State)
+	clientOpts        []option.ClientOption
+	noReuse           bool
+	enforceProject    bool
+	reaper            bool
+	readyProbe        ReadyProbe
+	selfTestKind      string
+	selfTestNamespace string
+	account           string
+	impersonate       string
+	entityLimit       int
+	onEntityLimit     func(count int)
+	basePath          string
+	candidates        []string
+	managedEnvVars    []string
+	tlsConfig         *tls.Config
+
+	// state of the running instance
+	stopOnClose      bool
+	prevEnv          map[string]prevEnvVar
+	resetUnsupported bool
+	reused           bool
+	proc             *process
+	addr             string
+	invocation       Invocation
+	tmpDataDir       string
+	fake             *httptest.Server
+	resetMu          sync.Mutex
+	healthLatency    atomic.Int64
+	ready            atomic.Bool
+	errw             *errorWriter
+	stateMu          sync.Mutex
+	clientMu         sync.Mutex
+	client           *datastore.Client
+	state            atomic.Int32
+	unixProxy        *unixProxy
+	recorder         *requestRecorder
+	usedStartArgs    []string
+	stopLimitWatch   func()
+	prewarmDuration  time.Duration
 }
 
-// New returns a new instance of Emulator.
-func New() (*Emulator, error) {
+// New returns a new instance of Emulator configured with the given options.
+func New(opts ...Option) (*Emulator, error) {
+	return NewContext(context.Background(), opts...)
+}
+
+// NewContext is like New, but the startup is aborted when the context is
+// done.
+func NewContext(ctx context.Context, opts ...Option) (*Emulator, error) {
 	e := &Emulator{}
-	if err := e.Start(); err != nil {
+	e.init()
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.StartContext(ctx); err != nil {
+		_ = e.Close()
 		return nil, err
 	}
 	return e, nil
 }
 
+// NewWithRetry is like New, but it retries up to attempts times in total,
+// waiting for backoff between the attempts, when the startup fails for a
+// transient reason, i.e. a timeout or a port bind race. Other errors, like
+// invalid options, ErrGcloudNotFound or an emulator exiting on startup, are
+// not retried. It fails if attempts is not positive.
+func NewWithRetry(attempts int, backoff time.Duration, opts ...Option) (*Emulator, error) {
+	if attempts <= 0 {
+		return nil, fmt.Errorf("invalid number of attempts: %d", attempts)
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var e *Emulator
+		if e, err = New(opts...); err == nil || !isTransient(err) {
+			return e, err
+		}
+		if attempt < attempts {
+			time.Sleep(backoff)
+		}
+	}
+	return nil, fmt.Errorf("emulator failed to start after %d attempts: %w", attempts, err)
+}
+
+// init sets the default configuration, unless it has already been set, so
+// that a zero value Emulator can be started as well.
+func (e *Emulator) init() {
+	if e.initialized {
+		return
+	}
+	e.initialized = true
+	e.project = DefaultProject
+	e.hostPort = DefaultHost
+	e.consistency = defaultConsistency
+	e.timeout = timeout
+	e.metrics = nopMetrics{}
+	e.maxLogBuffer = defaultMaxLogBuffer
+	e.closeGrace = shutdownTimeout
+	e.initialDelay = defaultInitialDelay
+	e.clock = realClock{}
+	e.name = newName()
+	e.scheme = "http"
+	e.failureOutput = os.Stderr
+	e.selfTestKind = defaultSelfTestKind
+	e.selfTestNamespace = defaultSelfTestNamespace
+	e.errw = newErrorWriter(defaultErrorPattern, errorsBuffer)
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// the polls and resets all go to the same host
+	t.MaxIdleConnsPerHost = defaultMaxIdleConns
+	e.httpc = &http.Client{Transport: t}
+}
+
 // Start starts the emulator which involves initializing the environment,
 // starting the emulator and blocking until correct startup is confirmed.
 // If an instance of the emaulator is already running it will be used instead
 // of starting a new instance.
 func (e *Emulator) Start() error {
-	if e.instanceIsPresent() {
-		return nil
+	return e.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the startup is aborted when the context is
+// done, in addition to the startup timeout.
+func (e *Emulator) StartContext(ctx context.Context) error {
+	e.init()
+	if e.dryRun {
+		return e.dryStart()
 	}
-	e.stopOnClose = true
-	if err := e.command(
-		"start",
-		"--consistency=1.0",         // prevents random test failures
-		"--no-store-on-disk",        // test in memory
-		"--host-port="+defaultHost,  // use a specific port
-		"--project="+defaultProject, // use a specific project name for tests
-	).Start(); err != nil {
+	e.setState(StateStarting)
+	err := e.startInstance(ctx)
+	if err == nil && e.requestLog {
+		err = e.startRequestLog()
+	}
+	e.setStateAfter(err, StateReady)
+	return err
+}
+
+// startInstance starts the emulator (or adopts a running one) according to
+// the configuration.
+func (e *Emulator) startInstance(ctx context.Context) error {
+	if e.backend == BackendFake {
+		return e.startFake()
+	}
+	if e.noReuse {
+		if err := e.checkNoInstance(); err != nil {
+			return err
+		}
+	} else if e.instanceIsPresent() {
+		return e.checkProject()
+	}
+	if e.preflight != nil {
+		if err := e.preflight(ctx); err != nil {
+			return fmt.Errorf("preflight: %w", err)
+		}
+	}
+	began := time.Now()
+	err := e.launch(ctx, "")
+	e.metricsOf().ObserveStartup(time.Since(began), err)
+	if err != nil {
 		return err
 	}
-	e.Host = "http://" + defaultHost
-	e.ProjectID = defaultProject
-	if err := e.confirmStartup(); err != nil {
-		_ = e.Close()
+	e.trackActive()
+	if e.prewarm {
+		if err := e.runPrewarm(ctx); err != nil {
+			return err
+		}
+	}
+	if e.unixSocket != "" {
+		if e.unixProxy, err = startUnixProxy(e.unixSocket, e.addr); err != nil {
+			return fmt.Errorf("unix socket: %w", err)
+		}
+	}
+	if e.onEntityLimit != nil {
+		e.watchEntityLimit()
+	}
+	if e.leakDetection {
+		e.watchLeak()
+	}
+	return nil
+}
+
+// dryStart resolves the configuration and builds the command without starting
+// the emulator or setting the environment variables.
+func (e *Emulator) dryStart() error {
+	hostPort, err := e.pickHostPort("")
+	if err != nil {
+		return err
+	}
+	if err := e.prepareIndexes(); err != nil {
+		return err
+	}
+	e.usedStartArgs = e.startArgs(hostPort)
+	e.invocation = newInvocation(e.command(context.Background(), e.usedStartArgs...))
+	e.addr = hostPort
+	e.Host = e.scheme + "://" + e.advertised(hostPort)
+	e.ProjectID = e.project
+	return nil
+}
+
+// CommandArgs returns the full command line (including the gcloud executable)
+// used to start the emulator, or nil if no command was built yet.
+func (e *Emulator) CommandArgs() []string {
+	return append([]string(nil), e.invocation.Args...)
+}
+
+// StartArgs returns the arguments of the gcloud emulator start command, e.g.
+// to reproduce the emulator configuration outside of the package. Once the
+// emulator was started (or dry-run), they're the ones which were used.
+// Before, they're the ones Start would use, except that the random port and
+// the temporary data dir holding the index file are not known yet.
+func (e *Emulator) StartArgs() []string {
+	if e.usedStartArgs != nil {
+		return append([]string(nil), e.usedStartArgs...)
+	}
+	e.init()
+	return e.startArgs(e.hostPort)
+}
+
+// launch starts the emulator process on hostPort or, if it's empty, on the
+// first of the host-port candidates which is free, if any.
+func (e *Emulator) launch(ctx context.Context, hostPort string) error {
+	if hostPort != "" || len(e.candidates) == 0 {
+		return e.launchAt(ctx, hostPort)
+	}
+	var err error
+	for _, c := range e.candidates {
+		if err = e.launchAt(ctx, c); !errors.Is(err, ErrPortInUse) {
+			return err
+		}
+		e.logf("host-port %s is in use, trying the next candidate", c)
+	}
+	return err
+}
+
+// launchAt starts the emulator process, retrying on bind failures. If hostPort
+// is empty the host-port is resolved from the configuration on each attempt.
+func (e *Emulator) launchAt(ctx context.Context, hostPort string) error {
+	reclaimed := false
+	for attempt := 0; ; attempt++ {
+		err := e.start(ctx, hostPort)
+		if errors.Is(err, ErrPortInUse) && e.reclaimPort && !reclaimed {
+			reclaimed = true
+			if e.reclaim(hostPort) {
+				attempt--
+				continue
+			}
+		}
+		if err == nil || attempt >= e.startRetries || !errors.Is(err, ErrPortInUse) {
+			return err
+		}
+		select {
+		case <-time.After(startRetryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (e *Emulator) start(ctx context.Context, hostPort string) error {
+	hostPort, err := e.resolveHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	e.stopOnClose = !e.keepAlive
+	if err := e.prepareIndexes(); err != nil {
+		return err
+	}
+	out := newRingBuffer(e.maxLogBuffer)
+	e.usedStartArgs = e.startArgs(hostPort)
+	cmd := e.command(ctx, e.usedStartArgs...)
+	e.invocation = newInvocation(cmd)
+	e.logf("starting the emulator: %+v", e.Invocation())
+	var w io.Writer = out
+	var onExit func()
+	if e.output != nil {
+		output := e.output
+		if prefix := e.effectiveOutputPrefix(); prefix != "" {
+			pw := newPrefixWriter(output, prefix)
+			output, onExit = pw, pw.Flush
+		}
+		w = io.MultiWriter(out, output)
+	}
+	stderr := w
+	if e.verbosity == "debug" && e.debugOutput != nil {
+		// gcloud writes its logs to stderr
+		stderr = io.MultiWriter(out, e.debugOutput)
+	}
+	if e.reaper {
+		setReaper(cmd)
+	}
+	cmd.Stdout = teeWriter(w, cmd.Stdout)
+	cmd.Stderr = teeWriter(io.MultiWriter(stderr, e.errw), cmd.Stderr)
+	proc, err := startProcess(cmd, onExit)
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("%w: %w", ErrGcloudNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	e.proc = proc
+	e.addr = hostPort
+	e.Host = e.scheme + "://" + e.advertised(hostPort)
+	e.ProjectID = e.project
+	if err := e.confirmStartup(ctx); err != nil {
+		_ = proc.kill()
+		if isBindFailure(out.String()) {
+			return fmt.Errorf("%w: %s", ErrPortInUse, hostPort)
+		}
+		err.Output = out.String()
+		if isNetworkFailure(err.Output) {
+			err.Err = fmt.Errorf("%w: %w", ErrNetwork, err.Err)
+		}
+		if e.output == nil && err.Output != "" {
+			// the output wasn't shown, as the startup was expected to succeed
+			fmt.Fprintf(e.failureOutput, "datastore emulator failed to start (%v), its output:\n%s", err.Err, err.Output)
+		}
 		return err
 	}
-	os.Setenv("DATASTORE_EMULATOR_HOST", defaultHost)
-	os.Setenv("DATASTORE_PROJECT_ID", defaultProject)
+	e.setEnv(e.managedEnv(e.advertised(hostPort)))
 	return nil
 }
 
-// Reset resets the Datastore Emulator (but only works in testing/i.e. when
-// using in-memory storage).
+// effectiveOutputPrefix returns the prefix of the output lines: the one set
+// with WithOutputPrefix or, by default, the name of the emulator.
+func (e *Emulator) effectiveOutputPrefix() string {
+	if e.outputPrefixSet {
+		return e.outputPrefix
+	}
+	return "[" + e.name + "] "
+}
+
+// advertised returns the host-port advertised to the clients of the emulator
+// bound to hostPort: the request log proxy with WithRequestLog, otherwise the
+// one set with WithAdvertiseHostPort if any.
+func (e *Emulator) advertised(hostPort string) string {
+	if e.recorder != nil {
+		return e.recorder.addr
+	}
+	if e.advertiseHostPort != "" {
+		return e.advertiseHostPort
+	}
+	return hostPort
+}
+
+// localURL returns the base URL the package itself uses to talk to the
+// emulator: the address it binds if it was started by this Emulator (or the
+// address of the reused emulator behind the request log proxy), which may
+// differ from the advertised one, or Host otherwise.
+func (e *Emulator) localURL() string {
+	if e.addr == "" {
+		return e.Host
+	}
+	return e.scheme + "://" + e.addr
+}
+
+// endpointURL returns the URL of the emulator endpoint at path, under the
+// base path set with WithBasePath if any.
+func (e *Emulator) endpointURL(path string) string {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return e.localURL() + e.basePath + path
+}
+
+// startArgs returns the arguments of the gcloud command starting the
+// emulator on hostPort.
+func (e *Emulator) startArgs(hostPort string) []string {
+	args := []string{
+		"start",
+		"--consistency=" + strconv.FormatFloat(e.consistency, 'f', -1, 64),
+		"--host-port=" + hostPort,
+		"--project=" + e.project,
+	}
+	if e.dataDir == "" {
+		args = append(args, "--no-store-on-disk") // test in memory
+	}
+	if dir := e.effectiveDataDir(); dir != "" {
+		args = append(args, "--data-dir="+dir)
+	}
+	if e.indexFile != "" {
+		args = append(args, "--require-indexes")
+	}
+	if e.verbosity != "" {
+		args = append(args, "--verbosity="+e.verbosity)
+	}
+	if e.account != "" {
+		args = append(args, "--account="+e.account)
+	}
+	if e.impersonate != "" {
+		args = append(args, "--impersonate-service-account="+e.impersonate)
+	}
+	return args
+}
+
+// effectiveDataDir returns the data dir passed to the emulator: the one set
+// with WithDataDir or, if the emulator needs one for its index configuration
+// only, a temporary one.
+func (e *Emulator) effectiveDataDir() string {
+	if e.dataDir != "" {
+		return e.dataDir
+	}
+	return e.tmpDataDir
+}
+
+// prepareIndexes puts the index file set with WithRequireIndexes where the
+// emulator looks for it, i.e. in the WEB-INF directory of the data dir.
+func (e *Emulator) prepareIndexes() error {
+	if e.indexFile == "" {
+		return nil
+	}
+	if e.effectiveDataDir() == "" {
+		dir, err := os.MkdirTemp("", "datastore-emulator")
+		if err != nil {
+			return err
+		}
+		e.tmpDataDir = dir
+	}
+	data, err := os.ReadFile(e.indexFile)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(e.effectiveDataDir(), "WEB-INF")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "index.yaml"), data, 0o644)
+}
+
+// RequireIndexes reports whether the emulator requires composite indexes to
+// be declared, in which case the queries needing an undeclared index fail.
+func (e *Emulator) RequireIndexes() bool {
+	return e.indexFile != ""
+}
+
+// resolveHostPort returns the host-port the emulator should bind to and makes
+// sure it is not occupied by another process.
+func (e *Emulator) resolveHostPort(hostPort string) (string, error) {
+	hostPort, err := e.pickHostPort(hostPort)
+	if err != nil {
+		return "", err
+	}
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrPortInUse, hostPort)
+	}
+	return hostPort, l.Close()
+}
+
+// pickHostPort returns hostPort if it's not empty, otherwise it returns a free
+// host-port if the random port option is set or the configured one if not.
+func (e *Emulator) pickHostPort(hostPort string) (string, error) {
+	if hostPort != "" {
+		return hostPort, nil
+	}
+	if e.randomPort {
+		port, err := AllocateFreePort()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("localhost:%d", port), nil
+	}
+	return e.hostPort, nil
+}
+
+// reclaim shuts down the Datastore emulator occupying hostPort (or the
+// configured host-port if empty), e.g. one left over by a crashed test run. It
+// reports whether the port was freed; nothing is done if the occupant is not a
+// healthy emulator.
+func (e *Emulator) reclaim(hostPort string) bool {
+	if hostPort == "" {
+		hostPort = e.hostPort
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	base := e.scheme + "://" + hostPort
+	if err := e.doRequest(ctx, base+healthcheckEndpoint, http.MethodGet, http.StatusOK); err != nil {
+		return false
+	}
+	if err := e.doRequest(ctx, base+shutdownEndpoint, http.MethodPost); err != nil {
+		return false
+	}
+	t := time.NewTicker(pollingRate)
+	defer t.Stop()
+	for {
+		if l, err := net.Listen("tcp", hostPort); err == nil {
+			return l.Close() == nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Restart relaunches the emulator process on the same host-port with the
+// given options applied on top of the current configuration. Unless the
+// emulator stores its data on disk (see WithDataDir) all the data is lost,
+// use SetConsistency to change the consistency while preserving the data.
+func (e *Emulator) Restart(opts ...Option) error {
+	return e.restart(context.Background(), opts...)
+}
+
+// restart is like Restart, but the startup of the relaunched emulator is
+// aborted when the context is done.
+func (e *Emulator) restart(ctx context.Context, opts ...Option) error {
+	if !e.OwnsProcess() {
+		return ErrNotOwner
+	}
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return err
+		}
+	}
+	if err := e.stop(); err != nil {
+		return err
+	}
+	if err := e.closeSharedClient(); err != nil {
+		return err
+	}
+	e.setState(StateStarting)
+	err := e.launch(ctx, e.addr)
+	if err == nil {
+		e.trackActive()
+	}
+	e.setStateAfter(err, StateReady)
+	return err
+}
+
+// Reconfigure applies the options (e.g. WithProject or WithConsistency) by
+// restarting the emulator process in place, on the same host-port, which is
+// faster than closing the Emulator and starting a new one. The environment
+// variables are updated to match the new configuration. Like with Restart,
+// the data is lost unless the emulator stores it on disk. The startup of the
+// relaunched emulator is aborted when the context is done.
+func (e *Emulator) Reconfigure(ctx context.Context, opts ...Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return e.restart(ctx, opts...)
+}
+
+// SetConsistency restarts the emulator with the given consistency. When the
+// emulator stores its data on disk the data survives the restart as is,
+// otherwise it is exported to a temporary directory before the restart and
+// imported back afterwards.
+func (e *Emulator) SetConsistency(ctx context.Context, consistency float64) error {
+	if e.dataDir != "" {
+		return e.restart(ctx, WithConsistency(consistency))
+	}
+	dir, err := os.MkdirTemp("", "datastore-emulator-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	snapshot, err := e.Export(ctx, dir, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.restart(ctx, WithConsistency(consistency)); err != nil {
+		return err
+	}
+	return e.Import(ctx, snapshot)
+}
+
+// Reset resets the Datastore Emulator by deleting all the entities of its
+// project, leaving the data of other projects on a shared emulator intact.
+// With the ResetAllProjects option it uses the reset endpoint of the emulator
+// instead, which is faster, but wipes all the projects (and only works in
+// testing/i.e. when using in-memory storage). If the reset endpoint turns out
+// to be unavailable, e.g. because a reused emulator stores its data on disk,
+// Reset falls back to deleting the entities of the project. Like the other
+// destructive operations, it returns ErrNotEmulator unless IsEmulator confirms
+// that the endpoint is an emulator.
 func (e *Emulator) Reset() error {
-	return e.request(resetEndpoint, http.MethodPost)
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	return e.ResetContext(ctx)
+}
+
+// ResetContext is like Reset, but the reset is canceled when the context is
+// done.
+func (e *Emulator) ResetContext(ctx context.Context) error {
+	if !e.started() {
+		return ErrNotStarted
+	}
+	if err := e.checkEmulator(ctx); err != nil {
+		return err
+	}
+	e.resetMu.Lock()
+	defer e.resetMu.Unlock()
+	began := time.Now()
+	err := e.reset(ctx)
+	e.metricsOf().ObserveReset(time.Since(began), err)
+	return e.afterReset(ctx, err)
+}
+
+// ResetWithIndexes is like ResetContext, but it also re-applies the index
+// file set with WithRequireIndexes after clearing the data, picking up the
+// changes made to it since the start, so that the queries depending on the
+// composite indexes keep working across resets. The indexes are left alone if
+// no index file was set or if the emulator wasn't started by this Emulator.
+func (e *Emulator) ResetWithIndexes(ctx context.Context) error {
+	if err := e.ResetContext(ctx); err != nil {
+		return err
+	}
+	if !e.OwnsProcess() {
+		return nil
+	}
+	if err := e.prepareIndexes(); err != nil {
+		return fmt.Errorf("re-apply indexes: %w", err)
+	}
+	return nil
+}
+
+// Reinitialize flushes the data of the emulator mid-test without restarting
+// it. The emulator has no admin endpoint reinitializing its datastore service,
+// so it's the same as ResetWithIndexes: the process, its host-port, the
+// environment variables and the indexes survive, the data (of the project, or
+// of all the projects with ResetAllProjects) doesn't.
+func (e *Emulator) Reinitialize(ctx context.Context) error {
+	return e.ResetWithIndexes(ctx)
 }
 
+// ResetAsync is like Reset, but the reset runs in a goroutine and its result
+// is sent on the returned channel, which allows overlapping the cleanup after
+// a test with the setup of the next one. It's only safe if the tests don't
+// share data: the entities written by the next test before the reset is done
+// may be deleted too. Concurrent resets are serialized.
+func (e *Emulator) ResetAsync() <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- e.Reset()
+	}()
+	return errc
+}
+
+// reset resets the emulator. If the reset endpoint is not available, which is
+// the case when a reused emulator stores its data on disk, it falls back to
+// deleting the entities of the project through the client and remembers to do
+// so for the subsequent resets.
+func (e *Emulator) reset(ctx context.Context) error {
+	useEndpoint := e.resetAllProjects || e.backend == BackendFake
+	if !useEndpoint || e.resetUnsupported || e.grpcHealthCheck {
+		return e.DeleteAll(ctx)
+	}
+	err := e.requestContext(ctx, resetEndpoint, http.MethodPost)
+	var se *StatusError
+	if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+		e.resetUnsupported = true
+		return e.DeleteAll(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+// instanceIsPresent reports whether a healthy emulator is advertised by the
+// environment variables or, with the WithGcloudConfig option, by the env.yaml
+// file of gcloud, and adopts it if so. Otherwise it looks for an emulator on
+// the configured host-port, e.g. one left running by WithKeepAlive, unless the
+// port is random or meant to be reclaimed. Without WithKeepAlive, a server
+// found there is only adopted if it answers datastore queries, as any server
+// answering the health check could be listening on a common port.
 func (e *Emulator) instanceIsPresent() bool {
 	host := os.Getenv("DATASTORE_HOST")
-	if host == "" {
+	projectID := os.Getenv("DATASTORE_PROJECT_ID")
+	if (host == "" || projectID == "") && e.gcloudConfig {
+		if c, err := DiscoverFromGcloudConfig(); err == nil {
+			host, projectID = e.scheme+"://"+c.Endpoint, c.ProjectID
+		}
+	}
+	if host != "" && projectID != "" && e.adopt(host, projectID) {
+		return true
+	}
+	if e.randomPort || len(e.candidates) > 0 || e.reclaimPort {
 		return false
 	}
-	projectID := os.Getenv("DATASTORE_PROJECT_ID")
-	if projectID == "" {
+	if !e.adopt(e.scheme+"://"+e.hostPort, cmp.Or(projectID, e.project)) {
 		return false
 	}
-	// check health of the running instance
-	if err := e.request(host, http.MethodGet); err != nil {
+	if e.keepAlive {
+		return true
+	}
+	if err := e.datastoreProbe(); err != nil {
+		_ = e.closeSharedClient()
+		e.Host, e.ProjectID, e.reused = "", "", false
+		e.ready.Store(false)
 		return false
 	}
+	return true
+}
+
+// adopt adopts the emulator at host if it's healthy.
+func (e *Emulator) adopt(host, projectID string) bool {
 	e.Host = host
+	if err := e.probe(); err != nil {
+		e.Host = ""
+		return false
+	}
 	e.ProjectID = projectID
+	e.reused = true
 	return true
 }
 
-// Close terminates the emulator process and cleans up the environemental
-// variables (only if an instance was started and not recycled).
+// checkNoInstance returns ErrInstanceAlreadyRunning if a healthy emulator is
+// advertised by the environment or listens on the configured host-port.
+func (e *Emulator) checkNoInstance() error {
+	if e.instanceIsPresent() {
+		host := e.Host
+		e.Host, e.ProjectID, e.reused = "", "", false
+		e.ready.Store(false)
+		return fmt.Errorf("%w: %s", ErrInstanceAlreadyRunning, host)
+	}
+	if e.randomPort || len(e.candidates) > 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pollingRate)
+	defer cancel()
+	url := e.scheme + "://" + e.hostPort
+	if e.doRequest(ctx, url+healthcheckEndpoint, http.MethodGet, http.StatusOK) == nil {
+		return fmt.Errorf("%w: %s", ErrInstanceAlreadyRunning, url)
+	}
+	return nil
+}
+
+// checkProject returns ErrProjectMismatch with the WithEnforceProject option
+// if the project of the reused emulator differs from the configured one,
+// giving up the reused emulator.
+func (e *Emulator) checkProject() error {
+	if !e.enforceProject || e.ProjectID == e.project {
+		return nil
+	}
+	projectID := e.ProjectID
+	e.Host, e.ProjectID, e.reused = "", "", false
+	e.ready.Store(false)
+	return fmt.Errorf("%w: %q, want %q", ErrProjectMismatch, projectID, e.project)
+}
+
+// started reports whether the Emulator was started (or adopted a running
+// instance). A dry run doesn't count.
+func (e *Emulator) started() bool {
+	return e.Host != "" && !e.dryRun
+}
+
+// Reused reports whether Start adopted an already running instance of the
+// emulator instead of starting a new one. Resetting a reused instance affects
+// everyone else using it.
+func (e *Emulator) Reused() bool {
+	return e.reused
+}
+
+// OwnsProcess reports whether the emulator process was started by this
+// Emulator.
+func (e *Emulator) OwnsProcess() bool {
+	return !e.reused && e.proc != nil
+}
+
+// LastHealthLatency returns the round-trip time of the last successful
+// health check of the emulator, or zero if there was none yet. An increasing
+// latency is a sign of an emulator degrading under load.
+func (e *Emulator) LastHealthLatency() time.Duration {
+	return time.Duration(e.healthLatency.Load())
+}
+
+// Errors returns a channel streaming the lines of the emulator stderr which
+// match the error pattern (see WithErrorPattern), e.g. warnings about missing
+// indexes, so that tests can assert on them. The lines are dropped if they're
+// not received fast enough. The channel is closed by Close.
+func (e *Emulator) Errors() <-chan string {
+	e.init()
+	return e.errw.c
+}
+
+// Ready reports whether the last health check of the emulator succeeded,
+// without checking it again, which makes it cheap enough for hot paths. It
+// reflects the last known state, not the live one: use WaitHealthy to check
+// the emulator actively. It's false after Close.
+func (e *Emulator) Ready() bool {
+	return e.ready.Load()
+}
+
+// Consistency returns the consistency the emulator is configured with (see
+// WithConsistency), 1.0 by default, so that the tests depending on it can
+// branch or skip. For a reused emulator it's the configured value, which the
+// running emulator may not have been started with.
+func (e *Emulator) Consistency() float64 {
+	e.init()
+	return e.consistency
+}
+
+// DatasetID returns the dataset ID set with WithDatasetID, or the project ID
+// if none was set.
+func (e *Emulator) DatasetID() string {
+	if e.datasetID != "" {
+		return e.datasetID
+	}
+	return e.ProjectID
+}
+
+// Name returns the name of the emulator, see WithName.
+func (e *Emulator) Name() string {
+	return e.name
+}
+
+// Close terminates the emulator process and restores the environemental
+// variables to their values from before Start (only if an instance was
+// started and not recycled). With the keep alive option the process is left
+// running. Close also stops all the goroutines started by the Emulator, so
+// that none are leaked, except for the one watching a process kept alive.
+// All the cleanup steps are performed even if some of them fail, and the
+// returned error joins the errors of the failed ones.
 func (e *Emulator) Close() error {
-	if !e.stopOnClose {
+	return e.close(e.stopOnClose)
+}
+
+// ForceClose is like Close, but it terminates the emulator process started by
+// this Emulator even with the keep alive option.
+func (e *Emulator) ForceClose() error {
+	return e.close(e.proc != nil && !e.reused)
+}
+
+// CloseGraceful is like Close, but it first waits for the resets in progress,
+// e.g. started with ResetAsync, to finish, so that none is interrupted. If the
+// context is done before they do, the emulator is closed with ForceClose.
+func (e *Emulator) CloseGraceful(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		e.resetMu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		defer e.resetMu.Unlock()
+		return e.Close()
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			e.resetMu.Unlock()
+		}()
+		return errors.Join(fmt.Errorf("wait for resets: %w", ctx.Err()), e.ForceClose())
+	}
+}
+
+// close performs the cleanup steps, stopping the emulator process if stop is
+// true, and returns their joined errors.
+func (e *Emulator) close(stop bool) error {
+	if e.leakDetection {
+		e.unwatchLeak()
+	}
+	e.setState(StateClosing)
+	defer e.setState(StateClosed)
+	e.unwatchEntityLimit()
+	e.untrackActive()
+	var errs []error
+	if !e.persistEnv {
+		errs = append(errs, e.restoreEnv())
+	}
+	if stop {
+		errs = append(errs, e.stop(), e.removeTmpDataDir())
+		e.stopFake()
+	} else if e.dryRun {
+		// no process uses the data dir holding the indexes
+		errs = append(errs, e.removeTmpDataDir())
+	}
+	if e.unixProxy != nil {
+		errs = append(errs, e.unixProxy.close())
+		e.unixProxy = nil
+	}
+	if e.recorder != nil {
+		errs = append(errs, e.recorder.close())
+		e.recorder = nil
+	}
+	if e.errw != nil {
+		e.errw.close()
+	}
+	errs = append(errs, e.closeSharedClient())
+	e.closeIdleConnections()
+	e.ready.Store(false)
+	return errors.Join(errs...)
+}
+
+func (e *Emulator) removeTmpDataDir() error {
+	if e.tmpDataDir == "" {
 		return nil
 	}
-	os.Unsetenv("DATASTORE_EMULATOR_HOST")
-	os.Unsetenv("DATASTORE_PROJECT_ID")
-	if e.isHealthy() {
-		return e.request(shutdownEndpoint, http.MethodPost)
+	if err := os.RemoveAll(e.tmpDataDir); err != nil {
+		return fmt.Errorf("remove temporary data dir: %w", err)
 	}
+	e.tmpDataDir = ""
 	return nil
 }
 
+// stop shuts down the emulator process and waits for it to exit, killing it
+// if it doesn't exit within the close grace period, which includes the time
+// spent retrying the shutdown request.
+func (e *Emulator) stop() error {
+	deadline := time.Now().Add(e.closeGrace)
+	var errs []error
+	if e.grpcHealthCheck && e.proc != nil {
+		// there is no shutdown endpoint to call
+		if err := e.proc.kill(); err != nil {
+			errs = append(errs, fmt.Errorf("kill: %w", err))
+		}
+	} else if e.isHealthy() {
+		err := e.requestShutdown(deadline)
+		var se *StatusError
+		switch {
+		case errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed):
+			// the emulator version doesn't implement the endpoint, there is
+			// no point in waiting for it to exit
+			if e.proc != nil {
+				if err := e.proc.kill(); err != nil {
+					errs = append(errs, fmt.Errorf("kill: %w", err))
+				}
+			}
+		case err != nil:
+			errs = append(errs, fmt.Errorf("shutdown: %w", err))
+		}
+	}
+	if e.proc != nil {
+		if err := e.proc.wait(max(time.Until(deadline), 0)); err != nil {
+			errs = append(errs, fmt.Errorf("kill: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// requestShutdown requests the shutdown of the emulator, retrying the
+// transient failures up to the number of shutdown retries as long as the
+// deadline allows it.
+func (e *Emulator) requestShutdown(deadline time.Time) error {
+	for attempt := 0; ; attempt++ {
+		err := e.request(shutdownEndpoint, http.MethodPost)
+		if err == nil || attempt >= e.shutdownRetries || !isRetryable(err) {
+			return err
+		}
+		if time.Until(deadline) < pollingRate {
+			return err
+		}
+		<-e.clock.After(pollingRate)
+	}
+}
+
 func (e *Emulator) initEnv() {
 }
 
 func (e *Emulator) isHealthy() bool {
-	if err := e.request(healthcheckEndpoint, http.MethodGet); err != nil {
-		return false
+	return e.probe() == nil
+}
+
+// probe performs a single health check of the emulator, records its outcome
+// for Ready and its latency if it succeeds.
+func (e *Emulator) probe() error {
+	began := time.Now()
+	err := e.probeOnce()
+	if err == nil {
+		e.healthLatency.Store(int64(time.Since(began)))
 	}
-	return true
+	e.ready.Store(err == nil)
+	return err
 }
 
-func (e *Emulator) confirmStartup() error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	t := time.NewTicker(pollingRate)
-	for {
+// probeOnce performs the health check, using the gRPC health service with the
+// gRPC health check option. If a HEAD health check is not supported by the
+// emulator it falls back to GET for good.
+func (e *Emulator) probeOnce() error {
+	if e.grpcHealthCheck {
+		return e.grpcProbe()
+	}
+	path := healthcheckEndpoint
+	if e.healthCheck.Path != "" {
+		path = e.healthCheck.Path
+	}
+	if e.healthCheck.Method != http.MethodHead {
+		return e.request(path, http.MethodGet, http.StatusOK)
+	}
+	err := e.request(path, http.MethodHead, http.StatusOK)
+	var se *StatusError
+	if errors.As(err, &se) && (se.Code == http.StatusMethodNotAllowed || se.Code == http.StatusNotImplemented) {
+		e.healthCheck.Method = http.MethodGet
+		return e.request(path, http.MethodGet, http.StatusOK)
+	}
+	return err
+}
+
+func (e *Emulator) confirmStartup(ctx context.Context) *StartupError {
+	deadline := e.clock.After(e.timeout)
+	t := e.clock.NewTicker(pollingRate)
+	defer t.Stop()
+	began := e.clock.Now()
+	var lastErr error
+	var healthySince time.Time // of the consecutive successful probes
+	for attempt := 1; ; attempt++ {
 		select {
-		case <-t.C:
-			if e.isHealthy() {
-				t.Stop()
-				return nil
+		case <-t.C():
+			lastErr = e.probe()
+			if lastErr == nil && e.readyProbe == ProbeDatastore {
+				lastErr = e.datastoreProbe()
+			}
+			if e.startupProgress != nil {
+				e.startupProgress(attempt, lastErr)
+			}
+			if lastErr == nil {
+				if healthySince.IsZero() {
+					healthySince = e.clock.Now()
+				}
+				if e.clock.Now().Sub(healthySince) >= e.stableWindow {
+					return nil
+				}
+				continue
+			}
+			healthySince = time.Time{}
+			// failures are expected until the emulator binds its port
+			if e.clock.Now().Sub(began) >= e.initialDelay {
+				e.logf("emulator health check failed: %v", lastErr)
+			}
+		case <-e.proc.exited():
+			err := fmt.Errorf("emulator exited before startup was confirmed: %v", e.proc.err)
+			return &StartupError{Err: err, LastProbe: lastErr}
+		case <-deadline:
+			err := error(context.DeadlineExceeded)
+			var se *StatusError
+			if errors.As(lastErr, &se) && se.Code == http.StatusNotFound {
+				// a 404 is expected while the emulator initializes, but not
+				// until the timeout
+				err = fmt.Errorf("%w; the health check path may be misconfigured", err)
 			}
+			return &StartupError{Err: err, LastProbe: lastErr}
 		case <-ctx.Done():
-			t.Stop()
-			return ctx.Err()
+			return &StartupError{Err: ctx.Err(), LastProbe: lastErr}
 		}
 	}
 }
 
-func (e *Emulator) command(extraArgs ...string) *exec.Cmd {
-	args := []string{"beta", "emulators", "datastore"}
-	args = append(args, extraArgs...)
-	return exec.Command("gcloud", args...)
+// command returns the gcloud emulator command with the given arguments,
+// prefixed with the emulator command group of the installed gcloud, whose
+// detection is aborted when the context is done.
+func (e *Emulator) command(ctx context.Context, extraArgs ...string) *exec.Cmd {
+	args := append([]string(nil), e.commandPrefix(ctx)...)
+	return e.gcloud(append(args, extraArgs...)...)
 }
 
-func (e *Emulator) request(path, method string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), pollingRate)
+// commandPrefix returns the arguments selecting the emulator command group:
+// the one set with WithCommandPrefix if any, otherwise the one supported by
+// the installed gcloud, which is detected once. Recent SDKs moved the
+// emulators out of beta, older ones only have the beta commands. In dry-run
+// mode nothing is executed, so the beta commands are assumed. The detection is
+// limited by the startup timeout, as gcloud may hang trying to reach the
+// network, and the beta commands are assumed if it doesn't complete.
+func (e *Emulator) commandPrefix(ctx context.Context) []string {
+	if e.cmdPrefix != nil {
+		return e.cmdPrefix
+	}
+	if e.dryRun {
+		return betaCommandPrefix
+	}
+	e.cmdPrefix = betaCommandPrefix
+	probe := e.gcloud(append(append([]string(nil), gaCommandPrefix...), "--help")...)
+	probe.Stdout, probe.Stderr = io.Discard, io.Discard
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, method, e.Host+path, nil)
-	if err != nil {
+	if runContext(ctx, probe) == nil {
+		e.cmdPrefix = gaCommandPrefix
+	}
+	return e.cmdPrefix
+}
+
+// runContext runs the command, killing it if the context is done before it
+// completes. The output of the processes it may have spawned isn't waited
+// for long after it exits.
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.WaitDelay = pollingRate
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		<-done
+		return ctx.Err()
 	}
-	c := http.Client{}
-	resp, err := c.Do(req)
+}
+
+// gcloud returns the gcloud command with the given arguments, built with the
+// function set with WithCommand if any. The environment is only set if the
+// function didn't set it.
+func (e *Emulator) gcloud(args ...string) *exec.Cmd {
+	if e.commandFunc != nil {
+		cmd := e.commandFunc(args)
+		if cmd.Env == nil {
+			cmd.Env = e.buildEnv()
+		}
+		return cmd
+	}
+	cmd := exec.Command("gcloud", args...)
+	cmd.Env = e.buildEnv()
+	return cmd
+}
+
+// buildEnv returns the environment of the emulator subprocess. It starts from
+// the environment of the current process (or from an empty one if the clean
+// env option is set) and overlays the gcloud specific variables on top of it:
+// first the ones preventing gcloud from reaching out to the network, which
+// may hang in air-gapped environments, then the ones set with options.
+func (e *Emulator) buildEnv() []string {
+	var env []string
+	if !e.cleanEnv {
+		env = os.Environ()
+	}
+	env = append(env,
+		"CLOUDSDK_CORE_DISABLE_USAGE_REPORTING=true",
+		"CLOUDSDK_COMPONENT_MANAGER_DISABLE_UPDATE_CHECK=true",
+		"CLOUDSDK_CORE_CHECK_GCE_METADATA=false",
+		"NO_GCE_CHECK=True",
+	)
+	return append(env, e.gcloudEnv...)
+}
+
+// httpClient returns the HTTP client used for the requests to the emulator.
+func (e *Emulator) httpClient() *http.Client {
+	if e.httpc == nil {
+		return http.DefaultClient
+	}
+	return e.httpc
+}
+
+// closeIdleConnections closes the idle connections of the HTTP client, which
+// would otherwise keep their goroutines running.
+func (e *Emulator) closeIdleConnections() {
+	if e.httpc != nil {
+		e.httpc.CloseIdleConnections()
+	}
+}
+
+// request sends a request to the emulator endpoint at path. The request fails
+// unless the response status code is one of the accepted ones (any 2xx if
+// none are given).
+func (e *Emulator) request(path, method string, accepted ...int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pollingRate)
+	defer cancel()
+	return e.doRequest(ctx, e.endpointURL(path), method, accepted...)
+}
+
+// requestContext is like request, but it uses the given context instead of
+// limiting the request to the polling rate. With the WithRequestBackoff option
+// the request is retried on connection failures and server errors until the
+// context is done.
+func (e *Emulator) requestContext(ctx context.Context, path, method string, accepted ...int) error {
+	for attempt := 0; ; attempt++ {
+		err := e.doRequest(ctx, e.endpointURL(path), method, accepted...)
+		if err == nil || e.backoffBase == 0 || !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-e.clock.After(e.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before retrying a request after the failed
+// attempt (counted from 0): a random duration up to the base delay doubled
+// with each attempt and capped at the max delay, i.e. the full jitter, which
+// keeps the retries of parallel tests from synchronizing.
+func (e *Emulator) backoff(attempt int) time.Duration {
+	d := e.backoffMax
+	if attempt < 32 {
+		d = min(e.backoffBase<<attempt, e.backoffMax)
+	}
+	if d <= 0 {
+		d = e.backoffMax
+	}
+	return rand.N(d + 1)
+}
+
+// doRequest sends a request to the url, checking the response status code
+// like request does.
+func (e *Emulator) doRequest(ctx context.Context, url, method string, accepted ...int) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status code error: %d", resp.StatusCode)
+	resp, err := e.httpClient().Do(req)
+	if err != nil {
+		return classifyError(err)
 	}
-	return nil
+	defer resp.Body.Close()
+	return checkStatus(resp, accepted...)
 }
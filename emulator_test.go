@@ -0,0 +1,1435 @@
+package emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_GCLOUD") == "1" {
+		os.Exit(runFakeGcloud(os.Args[1:]))
+	}
+	// the tests expect no emulator to be advertised by the environment
+	for _, k := range []string{"DATASTORE_HOST", "DATASTORE_PROJECT_ID", "DATASTORE_EMULATOR_HOST"} {
+		os.Unsetenv(k)
+	}
+	pollingRate = 50 * time.Millisecond
+	startRetryDelay = 20 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestBuildEnv(t *testing.T) {
+	t.Setenv("INHERITED", "parent")
+	noNetwork := []string{
+		"CLOUDSDK_CORE_DISABLE_USAGE_REPORTING=true",
+		"CLOUDSDK_COMPONENT_MANAGER_DISABLE_UPDATE_CHECK=true",
+		"CLOUDSDK_CORE_CHECK_GCE_METADATA=false",
+		"NO_GCE_CHECK=True",
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		e := &Emulator{}
+		for _, opt := range []Option{WithCleanEnv(), WithGcloudEnv("CLOUDSDK_CONFIG", "/tmp/config"), WithGcloudEnv("NO_GCE_CHECK", "False")} {
+			if err := opt(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := append(slices.Clone(noNetwork), "CLOUDSDK_CONFIG=/tmp/config", "NO_GCE_CHECK=False")
+		if got := e.buildEnv(); !slices.Equal(got, want) {
+			t.Errorf("buildEnv() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("inherited", func(t *testing.T) {
+		e := &Emulator{}
+		if err := WithGcloudEnv("INHERITED", "child")(e); err != nil {
+			t.Fatal(err)
+		}
+		env := e.buildEnv()
+		if !slices.Contains(env, "INHERITED=parent") {
+			t.Errorf("buildEnv() doesn't inherit INHERITED=parent: %q", env)
+		}
+		// the overlay comes last, so it takes precedence on exec
+		if got := env[len(env)-len(noNetwork)-1:]; !slices.Equal(got, append(slices.Clone(noNetwork), "INHERITED=child")) {
+			t.Errorf("buildEnv() ends with %q", got)
+		}
+	})
+
+	t.Run("subprocess", func(t *testing.T) {
+		file := t.TempDir() + "/env"
+		newFakeEmulator(t, []string{"FAKE_ENV_FILE=" + file}, WithCleanEnv(), WithGcloudEnv("CUSTOM", "value"))
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := strings.Split(string(data), "\n")
+		if !contains(env, "CUSTOM=value") {
+			t.Errorf("the subprocess environment lacks CUSTOM=value: %q", env)
+		}
+		if contains(env, "INHERITED=parent") {
+			t.Errorf("the subprocess inherited the environment with WithCleanEnv: %q", env)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, key := range []string{"", "A=B"} {
+			if err := WithGcloudEnv(key, "v")(&Emulator{}); err == nil {
+				t.Errorf("WithGcloudEnv(%q) error = nil", key)
+			}
+		}
+	})
+}
+
+func TestFakeGcloud(t *testing.T) {
+	e := newFakeEmulator(t, nil)
+	if got, want := os.Getenv("DATASTORE_EMULATOR_HOST"), strings.TrimPrefix(e.Host, "http://"); got != want {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q, want %q", got, want)
+	}
+	if err := e.Reset(); err != nil {
+		t.Errorf("Reset() error = %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Error("DATASTORE_EMULATOR_HOST is still set after Close")
+	}
+	for deadline := time.Now().Add(time.Second); e.isHealthy(); time.Sleep(pollingRate) {
+		if time.Now().After(deadline) {
+			t.Fatal("the emulator is still healthy after Close")
+		}
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	t.Run("bind race", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "launches")
+		knobs := []string{"FAKE_FAIL=bind", "FAKE_FAIL_ONCE=" + filepath.Join(t.TempDir(), "once"), "FAKE_LAUNCHES=" + file}
+		newFakeEmulator(t, knobs, WithStartRetries(2))
+		if n := launches(t, file); n != 2 {
+			t.Errorf("the emulator was launched %d times, want 2", n)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "launches")
+		opts := append(fakeGcloud("FAKE_FAIL=bind", "FAKE_LAUNCHES="+file), WithStartRetries(2))
+		_, err := New(opts...)
+		if !errors.Is(err, ErrPortInUse) {
+			t.Errorf("New() error = %v, want ErrPortInUse", err)
+		}
+		if n := launches(t, file); n != 3 {
+			t.Errorf("the emulator was launched %d times, want 3", n)
+		}
+	})
+
+	t.Run("not transient", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "launches")
+		opts := append(fakeGcloud("FAKE_FAIL=exit", "FAKE_LAUNCHES="+file), WithStartRetries(2))
+		if _, err := New(opts...); err == nil || errors.Is(err, ErrPortInUse) {
+			t.Errorf("New() error = %v, want a startup error", err)
+		}
+		if n := launches(t, file); n != 1 {
+			t.Errorf("the emulator was launched %d times, want 1", n)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if err := WithStartRetries(-1)(&Emulator{}); err == nil {
+			t.Error("WithStartRetries(-1) error = nil")
+		}
+	})
+}
+
+func TestReused(t *testing.T) {
+	t.Run("started", func(t *testing.T) {
+		e := newFakeEmulator(t, nil)
+		if e.Reused() || !e.OwnsProcess() {
+			t.Errorf("Reused() = %v, OwnsProcess() = %v, want false, true", e.Reused(), e.OwnsProcess())
+		}
+	})
+
+	t.Run("adopted", func(t *testing.T) {
+		f := startFakeServer(t, fakeConfig{})
+		adoptFakeServer(t, f, "shared")
+		e := newTestEmulator(t, WithRandomPort())
+		if !e.Reused() || e.OwnsProcess() {
+			t.Errorf("Reused() = %v, OwnsProcess() = %v, want true, false", e.Reused(), e.OwnsProcess())
+		}
+		if e.Host != f.url() || e.ProjectID != "shared" {
+			t.Errorf("Host, ProjectID = %q, %q, want %q, %q", e.Host, e.ProjectID, f.url(), "shared")
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, shutdowns := f.stats(); shutdowns != 0 {
+			t.Errorf("Close() shut down the adopted emulator")
+		}
+	})
+}
+
+func TestNoReuse(t *testing.T) {
+	t.Run("advertised", func(t *testing.T) {
+		f := startFakeServer(t, fakeConfig{})
+		adoptFakeServer(t, f, "shared")
+		e := applyOptions(t, append(fakeGcloud(), WithNoReuse())...)
+		err := e.Start()
+		if !errors.Is(err, ErrInstanceAlreadyRunning) || !strings.Contains(err.Error(), f.url()) {
+			t.Errorf("Start() error = %v, want ErrInstanceAlreadyRunning naming the emulator", err)
+		}
+		if e.Host != "" || e.Reused() {
+			t.Errorf("Host = %q, Reused() = %v after the refused Start, want no adoption", e.Host, e.Reused())
+		}
+	})
+
+	t.Run("host-port", func(t *testing.T) {
+		f := startFakeServer(t, fakeConfig{})
+		e := applyOptions(t, append(fakeGcloud(), withFixedHostPort(f.addr), WithNoReuse())...)
+		if err := e.Start(); !errors.Is(err, ErrInstanceAlreadyRunning) {
+			t.Errorf("Start() error = %v, want ErrInstanceAlreadyRunning", err)
+		}
+		if checks, _, _ := f.stats(); checks == 0 {
+			t.Error("Start() didn't probe the host-port")
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		e := newFakeEmulator(t, nil, WithNoReuse())
+		if e.Reused() || !e.OwnsProcess() {
+			t.Errorf("Reused() = %v, OwnsProcess() = %v, want false, true", e.Reused(), e.OwnsProcess())
+		}
+	})
+}
+
+func TestEnforceProject(t *testing.T) {
+	f := startFakeServer(t, fakeConfig{})
+	adoptFakeServer(t, f, "shared")
+
+	e := applyOptions(t, WithRandomPort(), WithProject("mine"), WithEnforceProject())
+	err := e.Start()
+	if !errors.Is(err, ErrProjectMismatch) || !strings.Contains(err.Error(), `"shared"`) || !strings.Contains(err.Error(), `"mine"`) {
+		t.Errorf("Start() error = %v, want ErrProjectMismatch naming both projects", err)
+	}
+	if e.Host != "" || e.Reused() {
+		t.Errorf("Host = %q, Reused() = %v after the mismatch, want no adoption", e.Host, e.Reused())
+	}
+
+	for _, opts := range [][]Option{
+		{WithRandomPort(), WithProject("shared"), WithEnforceProject()},
+		{WithRandomPort(), WithProject("mine")}, // lenient by default
+	} {
+		e := newTestEmulator(t, opts...)
+		if !e.Reused() || e.ProjectID != "shared" {
+			t.Errorf("Reused() = %v, ProjectID = %q, want the emulator adopted", e.Reused(), e.ProjectID)
+		}
+	}
+}
+
+func TestSetConsistency(t *testing.T) {
+	args := filepath.Join(t.TempDir(), "args")
+	e := newFakeEmulator(t, []string{"FAKE_ARGS_FILE=" + args})
+	host := e.Host
+	if err := e.SetConsistency(context.Background(), 0.5); err != nil {
+		t.Fatalf("SetConsistency() error = %v", err)
+	}
+	if got := readArgs(t, args); !contains(got, "--consistency=0.5") {
+		t.Errorf("the emulator was restarted with %q, want --consistency=0.5", got)
+	}
+	if e.Host != host {
+		t.Errorf("Host = %q after the restart, want %q", e.Host, host)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	t.Run("owner", func(t *testing.T) {
+		args := filepath.Join(t.TempDir(), "args")
+		e := newFakeEmulator(t, []string{"FAKE_ARGS_FILE=" + args})
+		proc := e.proc
+		if err := e.Restart(WithConsistency(0.9)); err != nil {
+			t.Fatalf("Restart() error = %v", err)
+		}
+		if e.proc == proc {
+			t.Error("Restart() didn't launch a new process")
+		}
+		select {
+		case <-proc.exited():
+		default:
+			t.Error("the previous process is still running after Restart")
+		}
+		if got := readArgs(t, args); !contains(got, "--consistency=0.9") || !contains(got, "--host-port="+e.addr) {
+			t.Errorf("the emulator was restarted with %q, want --consistency=0.9 on %s", got, e.addr)
+		}
+	})
+
+	t.Run("not owner", func(t *testing.T) {
+		e, _ := newAdoptingEmulator(t, fakeConfig{})
+		if err := e.Restart(); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("Restart() error = %v, want ErrNotOwner", err)
+		}
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	index := filepath.Join(t.TempDir(), "index.yaml")
+	if err := os.WriteFile(index, []byte("indexes:\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(WithDryRun(), WithProject("dry"), WithHostPort("localhost:9999"), WithRequireIndexes(index))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	args := e.CommandArgs()
+	want := []string{"gcloud", "beta", "emulators", "datastore", "start", "--consistency=1", "--host-port=localhost:9999", "--project=dry", "--no-store-on-disk", "--data-dir=" + e.tmpDataDir, "--require-indexes"}
+	if !slices.Equal(args, want) {
+		t.Errorf("CommandArgs() = %q, want %q", args, want)
+	}
+	if e.Host != "http://localhost:9999" || e.ProjectID != "dry" {
+		t.Errorf("Host, ProjectID = %q, %q", e.Host, e.ProjectID)
+	}
+	if _, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Error("DATASTORE_EMULATOR_HOST is set by a dry run")
+	}
+	if e.proc != nil {
+		t.Error("a dry run started a process")
+	}
+	if err := e.Reset(); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("Reset() error = %v, want ErrNotStarted", err)
+	}
+	dir := e.tmpDataDir
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the temporary data dir %s survived Close: %v", dir, err)
+	}
+}
+func TestStartupError(t *testing.T) {
+	tests := []struct {
+		name  string
+		knobs []string
+		want  error
+	}{
+		{name: "not listening", knobs: []string{"FAKE_START_DELAY=1m"}, want: ErrConnectionRefused},
+		{name: "bad status", knobs: []string{"FAKE_HEALTH=500"}, want: ErrUnexpectedStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var progress []error
+			opts := append(fakeGcloud(tt.knobs...), WithTimeout(300*time.Millisecond), WithStartupProgress(func(attempt int, err error) {
+				if attempt != len(progress)+1 {
+					t.Errorf("attempt = %d, want %d", attempt, len(progress)+1)
+				}
+				progress = append(progress, err)
+			}))
+			_, err := New(opts...)
+			var se *StartupError
+			if !errors.As(err, &se) {
+				t.Fatalf("New() error = %v, want a StartupError", err)
+			}
+			if !errors.Is(se.Err, context.DeadlineExceeded) || !errors.Is(se.LastProbe, tt.want) {
+				t.Errorf("StartupError = %v, want a timeout with the last probe failing with %v", err, tt.want)
+			}
+			if len(progress) == 0 || !errors.Is(progress[len(progress)-1], tt.want) {
+				t.Errorf("progress = %v, want the probe errors", progress)
+			}
+		})
+	}
+
+	t.Run("exited", func(t *testing.T) {
+		_, err := New(fakeGcloud("FAKE_FAIL=exit", "FAKE_STDERR=some diagnostics")...)
+		var se *StartupError
+		if !errors.As(err, &se) || !strings.Contains(se.Err.Error(), "exited") {
+			t.Fatalf("New() error = %v, want a StartupError of the exited process", err)
+		}
+		if !strings.Contains(se.Output, "some diagnostics") {
+			t.Errorf("Output = %q, want the emulator output", se.Output)
+		}
+	})
+}
+
+func TestKeepAlive(t *testing.T) {
+	opts := append(fakeGcloud(), withFreeHostPort(t), WithKeepAlive())
+	e1 := newTestEmulator(t, opts...)
+	ctx := context.Background()
+	if err := e1.SeedFixtures(ctx, Fixture{Kind: "Kind", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e1.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Error("DATASTORE_EMULATOR_HOST is still set after Close")
+	}
+	select {
+	case <-e1.proc.exited():
+		t.Fatal("Close() stopped the emulator kept alive")
+	default:
+	}
+
+	e2 := newTestEmulator(t, opts...)
+	if !e2.Reused() || e2.Host != e1.Host {
+		t.Errorf("Reused() = %v, Host = %q, want the emulator at %q reused", e2.Reused(), e2.Host, e1.Host)
+	}
+	if n, err := e2.Count(ctx, "Kind", ""); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v, want the data of the first Emulator", n, err)
+	}
+	if err := e2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e1.ForceClose(); err != nil {
+		t.Fatalf("ForceClose() error = %v", err)
+	}
+	select {
+	case <-e1.proc.exited():
+	default:
+		t.Error("ForceClose() didn't stop the emulator kept alive")
+	}
+}
+
+func TestHostPortAdoption(t *testing.T) {
+	// a server answering the health check, but not the datastore queries
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	hostPort := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := New(append(fakeGcloud(), withFixedHostPort(hostPort))...)
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("New() on the host-port of another server error = %v, want ErrPortInUse", err)
+	}
+	e := newTestEmulator(t, append(fakeGcloud(), withFixedHostPort(hostPort), WithKeepAlive())...)
+	if !e.Reused() {
+		t.Error("Reused() = false, want the server adopted with WithKeepAlive")
+	}
+
+	e1 := newFakeEmulator(t, nil, withFreeHostPort(t))
+	e2 := newTestEmulator(t, append(fakeGcloud(), withFixedHostPort(e1.addr))...)
+	if !e2.Reused() || e2.Host != e1.Host {
+		t.Errorf("Reused() = %v, Host = %q, want the emulator at %q reused", e2.Reused(), e2.Host, e1.Host)
+	}
+}
+
+func TestHealthCheckHead(t *testing.T) {
+	for _, headSupported := range []bool{true, false} {
+		var methods []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			if r.Method == http.MethodHead && !headSupported {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}))
+		e := applyOptions(t, WithHealthCheck(HealthCheck{Method: http.MethodHead}))
+		e.Host = srv.URL
+		for range 2 {
+			if err := e.probe(); err != nil {
+				t.Errorf("probe() error = %v", err)
+			}
+		}
+		srv.Close()
+		want := []string{http.MethodHead, http.MethodHead}
+		if !headSupported {
+			// the check falls back to GET for good
+			want = []string{http.MethodHead, http.MethodGet, http.MethodGet}
+		}
+		if !slices.Equal(methods, want) {
+			t.Errorf("HEAD supported %v: methods = %q, want %q", headSupported, methods, want)
+		}
+	}
+
+	if err := WithHealthCheck(HealthCheck{Method: http.MethodPost})(&Emulator{}); err == nil {
+		t.Error("WithHealthCheck() with POST error = nil")
+	}
+}
+
+func TestReclaimPort(t *testing.T) {
+	t.Run("leftover emulator", func(t *testing.T) {
+		leftover := startFakeServer(t, fakeConfig{})
+		go func() {
+			<-leftover.stopped
+			leftover.close()
+		}()
+		e := newFakeEmulator(t, nil, withFixedHostPort(leftover.addr), WithReclaimPort())
+		if !e.OwnsProcess() || e.addr != leftover.addr {
+			t.Errorf("OwnsProcess() = %v, addr = %s, want the emulator started on %s", e.OwnsProcess(), e.addr, leftover.addr)
+		}
+		if _, _, shutdowns := leftover.stats(); shutdowns != 1 {
+			t.Errorf("the leftover emulator received %d shutdown requests, want 1", shutdowns)
+		}
+	})
+
+	t.Run("other occupant", func(t *testing.T) {
+		var shutdowns int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == shutdownEndpoint {
+				shutdowns++
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+		_, err := New(append(fakeGcloud(), withFixedHostPort(strings.TrimPrefix(srv.URL, "http://")), WithReclaimPort())...)
+		if !errors.Is(err, ErrPortInUse) {
+			t.Errorf("New() error = %v, want ErrPortInUse", err)
+		}
+		if shutdowns != 0 {
+			t.Errorf("the occupant which isn't an emulator received %d shutdown requests", shutdowns)
+		}
+	})
+}
+
+func TestReconfigure(t *testing.T) {
+	e := newFakeEmulator(t, nil)
+	addr := e.addr
+	ctx := context.Background()
+	if err := e.Reconfigure(ctx, WithProject("second"), WithConsistency(0.8)); err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+	if e.addr != addr || e.ProjectID != "second" || e.Consistency() != 0.8 {
+		t.Errorf("addr, ProjectID, Consistency() = %s, %q, %v, want %s, second, 0.8", e.addr, e.ProjectID, e.Consistency(), addr)
+	}
+	if got := os.Getenv("DATASTORE_PROJECT_ID"); got != "second" {
+		t.Errorf("DATASTORE_PROJECT_ID = %q, want second", got)
+	}
+	if !slices.Contains(e.StartArgs(), "--project=second") {
+		t.Errorf("StartArgs() = %q, want --project=second", e.StartArgs())
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := e.Reconfigure(canceled, WithProject("third")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Reconfigure() with a canceled context error = %v, want context.Canceled", err)
+	}
+	if e.ProjectID != "second" {
+		t.Errorf("ProjectID = %q after a canceled Reconfigure", e.ProjectID)
+	}
+
+	// the relaunched emulator doesn't come up before the deadline
+	short, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	err := e.Reconfigure(short, WithGcloudEnv("FAKE_START_DELAY", "1m"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Reconfigure() error = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(began); d > 5*time.Second {
+		t.Errorf("Reconfigure() returned after %v, want it bound by the context", d)
+	}
+}
+
+func TestNotStarted(t *testing.T) {
+	ctx := context.Background()
+	e := &Emulator{}
+	checks := map[string]func() error{
+		"Reset":        e.Reset,
+		"ResetContext": func() error { return e.ResetContext(ctx) },
+		"Client": func() error {
+			_, err := e.Client(ctx)
+			return err
+		},
+		"Started": func() error {
+			_, err := e.Started()
+			return err
+		},
+		"AdminRequest": func() error {
+			_, err := e.AdminRequest(ctx, http.MethodGet, "/", nil)
+			return err
+		},
+		"IsEmulator": func() error {
+			_, err := e.IsEmulator(ctx)
+			return err
+		},
+		"Count": func() error {
+			_, err := e.Count(ctx, "Kind", "")
+			return err
+		},
+		"WaitHealthy": func() error { return e.WaitHealthy(ctx) },
+		"WaitForPort": func() error { return e.WaitForPort(ctx) },
+	}
+	for name, check := range checks {
+		if err := check(); !errors.Is(err, ErrNotStarted) {
+			t.Errorf("%s() error = %v, want ErrNotStarted", name, err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Errorf("Close() error = %v, want nil", err)
+	}
+	if err := (&Emulator{}).ForceClose(); err != nil {
+		t.Errorf("ForceClose() error = %v, want nil", err)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	cycle := func() {
+		e, err := New(append(fakeGcloud(), WithOutput(io.Discard))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.DeleteAll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first cycle starts the goroutines shared by the process, e.g. the
+	// ones of the gRPC resolvers
+	cycle()
+	before := settledGoroutines(-1)
+	cycle()
+	if after := settledGoroutines(before); after > before {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines before New, %d after Close:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// settledGoroutines returns the number of goroutines once it drops to want
+// (or stops changing if want is negative), or after a while, as the
+// goroutines stopped by Close may take a moment to return.
+func settledGoroutines(want int) int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		prev := n
+		n = runtime.NumGoroutine()
+		if want < 0 && n == prev || want >= 0 && n <= want {
+			break
+		}
+	}
+	return n
+}
+
+func TestWithCommand(t *testing.T) {
+	var gotArgs []string
+	var own, out syncBuffer
+	e := newFakeEmulator(t, []string{"FAKE_STDOUT=hello"}, WithOutput(&out), WithCommand(func(args []string) *exec.Cmd {
+		gotArgs = args
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Stdout = &own
+		return cmd
+	}))
+	want := append(slices.Clone(gaCommandPrefix), e.StartArgs()...)
+	if !slices.Equal(gotArgs, want) {
+		t.Errorf("the command was built with %q, want %q", gotArgs, want)
+	}
+	if args := e.CommandArgs(); !slices.Equal(args[1:], want) {
+		t.Errorf("CommandArgs() = %q, want the arguments of the command", args)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(own.String(), "hello") || !strings.Contains(out.String(), "hello") {
+		t.Errorf("the output was written to %q and %q, want both", own.String(), out.String())
+	}
+}
+
+func TestRequireIndexes(t *testing.T) {
+	if _, err := New(WithRequireIndexes(filepath.Join(t.TempDir(), "index.yaml"))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("New() with a missing index file error = %v, want ErrNotExist", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "index.yaml")
+	index := "indexes:\n- kind: Kind\n  properties:\n  - name: A\n  - name: B\n"
+	if err := os.WriteFile(file, []byte(index), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := newFakeEmulator(t, nil, WithRequireIndexes(file))
+	if !e.RequireIndexes() {
+		t.Error("RequireIndexes() = false, want true")
+	}
+	args := e.StartArgs()
+	if !slices.Contains(args, "--require-indexes") || !slices.ContainsFunc(args, func(arg string) bool {
+		return strings.HasPrefix(arg, "--data-dir=")
+	}) {
+		t.Errorf("StartArgs() = %q, want --require-indexes and a data dir", args)
+	}
+
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var dst []struct{ A, B, C int }
+	if _, err := c.GetAll(ctx, datastore.NewQuery("Kind").FilterField("A", "=", 1).Order("B"), &dst); err != nil {
+		t.Errorf("GetAll() with a declared index error = %v", err)
+	}
+	if _, err := c.GetAll(ctx, datastore.NewQuery("Kind").FilterField("A", "=", 1).Order("C"), &dst); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("GetAll() with an undeclared index error = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestCloseJoinedError(t *testing.T) {
+	e := newFakeEmulator(t, []string{"FAKE_SHUTDOWN=500"}, WithCloseGrace(300*time.Millisecond))
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Fatal("DATASTORE_EMULATOR_HOST isn't set while the emulator runs")
+	}
+	err := e.Close()
+	var se *StatusError
+	if !errors.As(err, &se) || se.Code != http.StatusInternalServerError {
+		t.Errorf("Close() error = %v, want the shutdown StatusError", err)
+	}
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q after Close, want it restored", v)
+	}
+}
+
+func TestShutdownRetries(t *testing.T) {
+	knobs := []string{"FAKE_SHUTDOWN=503,200"}
+	e := newFakeEmulator(t, knobs, WithShutdownRetries(2), WithCloseGrace(5*time.Second))
+	if err := e.Close(); err != nil {
+		t.Errorf("Close() with a transient shutdown failure error = %v, want the retried shutdown", err)
+	}
+	select {
+	case <-e.proc.exited():
+	default:
+		t.Error("the emulator is still running after Close")
+	}
+
+	e = newFakeEmulator(t, knobs, WithCloseGrace(300*time.Millisecond))
+	var se *StatusError
+	if err := e.Close(); !errors.As(err, &se) || se.Code != http.StatusServiceUnavailable {
+		t.Errorf("Close() without retries error = %v, want the shutdown StatusError", err)
+	}
+
+	if err := WithShutdownRetries(-1)(&Emulator{}); err == nil {
+		t.Error("WithShutdownRetries(-1) error = nil")
+	}
+}
+
+func TestNewWithRetry(t *testing.T) {
+	countCalls := func(calls *int, name string) Option {
+		return WithCommand(func(args []string) *exec.Cmd {
+			*calls++
+			return exec.Command(name, args...)
+		})
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		calls := 0
+		knobs := fakeGcloud("FAKE_FAIL=bind", "FAKE_FAIL_ONCE="+filepath.Join(t.TempDir(), "once"))
+		e, err := NewWithRetry(3, 10*time.Millisecond, append(knobs, countCalls(&calls, os.Args[0]))...)
+		if err != nil {
+			t.Fatalf("NewWithRetry() error = %v", err)
+		}
+		defer e.ForceClose()
+		if calls != 2 {
+			t.Errorf("the emulator was launched %d times, want 2", calls)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		calls := 0
+		opts := append(fakeGcloud("FAKE_START_DELAY=1m"), WithTimeout(200*time.Millisecond), countCalls(&calls, os.Args[0]))
+		_, err := NewWithRetry(2, 10*time.Millisecond, opts...)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("NewWithRetry() error = %v, want a startup timeout", err)
+		}
+		if calls != 2 {
+			t.Errorf("the emulator was launched %d times, want 2", calls)
+		}
+	})
+
+	t.Run("not transient", func(t *testing.T) {
+		calls := 0
+		_, err := NewWithRetry(3, 10*time.Millisecond, append(fakeGcloud("FAKE_FAIL=exit"), countCalls(&calls, os.Args[0]))...)
+		var se *StartupError
+		if !errors.As(err, &se) {
+			t.Errorf("NewWithRetry() error = %v, want a StartupError", err)
+		}
+		if calls != 1 {
+			t.Errorf("the emulator exiting on startup was launched %d times, want 1", calls)
+		}
+
+		t.Setenv("PATH", t.TempDir())
+		calls = 0
+		_, err = NewWithRetry(3, 10*time.Millisecond, append(fakeGcloud(), countCalls(&calls, "gcloud"))...)
+		if !errors.Is(err, ErrGcloudNotFound) {
+			t.Errorf("NewWithRetry() error = %v, want ErrGcloudNotFound", err)
+		}
+		if calls != 1 {
+			t.Errorf("the emulator was launched %d times, want 1", calls)
+		}
+	})
+
+	t.Run("invalid attempts", func(t *testing.T) {
+		calls := 0
+		if _, err := NewWithRetry(0, 0, append(fakeGcloud(), countCalls(&calls, os.Args[0]))...); err == nil {
+			t.Error("NewWithRetry() with 0 attempts error = nil")
+		}
+		if calls != 0 {
+			t.Errorf("the emulator was launched %d times with 0 attempts, want 0", calls)
+		}
+	})
+}
+
+func TestVerbosity(t *testing.T) {
+	knobs := []string{"FAKE_STDOUT=stdout line", "FAKE_STDERR=stderr line"}
+	var out, debug syncBuffer
+	e := newFakeEmulator(t, knobs, WithVerbosity("debug"), WithOutput(&out), WithDebugOutput(&debug))
+	if args := e.StartArgs(); !slices.Contains(args, "--verbosity=debug") {
+		t.Errorf("StartArgs() = %q, want --verbosity=debug", args)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(debug.String(), "stderr line") || strings.Contains(debug.String(), "stdout line") {
+		t.Errorf("the debug output is %q, want the stderr only", debug.String())
+	}
+	if !strings.Contains(out.String(), "stdout line") || strings.Contains(out.String(), "stderr line") {
+		t.Errorf("the output is %q, want the stdout only", out.String())
+	}
+
+	var info syncBuffer
+	newFakeEmulator(t, knobs, WithVerbosity("info"), WithOutput(&info), WithDebugOutput(io.Discard)).Close()
+	if !strings.Contains(info.String(), "stderr line") {
+		t.Errorf("the output with the info verbosity is %q, want the stderr", info.String())
+	}
+
+	if err := WithVerbosity("verbose")(&Emulator{}); err == nil {
+		t.Error(`WithVerbosity("verbose") error = nil`)
+	}
+}
+
+func TestCloseGrace(t *testing.T) {
+	t.Run("honored", func(t *testing.T) {
+		e := newFakeEmulator(t, []string{"FAKE_SHUTDOWN_DELAY=300ms"}, WithCloseGrace(5*time.Second))
+		began := time.Now()
+		if err := e.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		if d := time.Since(began); d < 300*time.Millisecond {
+			t.Errorf("Close() returned after %v, before the emulator exited", d)
+		}
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		e := newFakeEmulator(t, []string{"FAKE_SHUTDOWN_DELAY=1m"}, WithCloseGrace(200*time.Millisecond))
+		proc := e.proc
+		began := time.Now()
+		_ = e.Close()
+		if d := time.Since(began); d < 200*time.Millisecond || d > 5*time.Second {
+			t.Errorf("Close() returned after %v, want the emulator killed after the grace", d)
+		}
+		select {
+		case <-proc.exited():
+		default:
+			t.Error("the emulator process is still running after Close")
+		}
+	})
+}
+
+func TestShutdownUnsupported(t *testing.T) {
+	for _, code := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		e := newFakeEmulator(t, []string{fmt.Sprintf("FAKE_SHUTDOWN=%d", code)}, WithCloseGrace(5*time.Second))
+		began := time.Now()
+		if err := e.Close(); err != nil {
+			t.Errorf("Close() with a %d shutdown error = %v, want the process killed", code, err)
+		}
+		if d := time.Since(began); d > time.Second {
+			t.Errorf("Close() with a %d shutdown took %v, want no wait for the process to exit", code, d)
+		}
+		select {
+		case <-e.proc.exited():
+		default:
+			t.Errorf("Close() with a %d shutdown didn't terminate the process", code)
+		}
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	knobs := []string{"FAKE_START_DELAY=300ms"}
+	for _, tt := range []struct {
+		delay      time.Duration
+		wantLogged bool
+	}{
+		{delay: time.Minute},
+		{delay: 0, wantLogged: true},
+	} {
+		var out syncBuffer
+		newFakeEmulator(t, knobs, WithInitialDelay(tt.delay), WithLogger(log.New(&out, "", 0)))
+		if logged := strings.Contains(out.String(), "health check failed"); logged != tt.wantLogged {
+			t.Errorf("with the initial delay %v the failed health checks logged = %v, want %v: %q", tt.delay, logged, tt.wantLogged, out.String())
+		}
+	}
+	if err := WithInitialDelay(-time.Second)(&Emulator{}); err == nil {
+		t.Error("WithInitialDelay(-1s) error = nil")
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	ctx := context.Background()
+	detect := func(t *testing.T, help string, opts ...Option) ([]string, int) {
+		calls := 0
+		opts = append([]Option{
+			WithCommand(func(args []string) *exec.Cmd {
+				calls++
+				return exec.Command(os.Args[0], args...)
+			}),
+			WithGcloudEnv("FAKE_GCLOUD", "1"),
+			WithGcloudEnv("FAKE_HELP", help),
+		}, opts...)
+		e := applyOptions(t, opts...)
+		prefix := e.commandPrefix(ctx)
+		if again := e.commandPrefix(ctx); !slices.Equal(again, prefix) {
+			t.Errorf("commandPrefix() = %q, then %q", prefix, again)
+		}
+		return prefix, calls
+	}
+
+	tests := []struct {
+		name      string
+		help      string
+		opts      []Option
+		want      []string
+		wantCalls int
+	}{
+		{name: "ga", want: gaCommandPrefix, wantCalls: 1},
+		{name: "beta", help: "fail", want: betaCommandPrefix, wantCalls: 1},
+		{name: "hanging", help: "hang", opts: []Option{WithTimeout(200 * time.Millisecond)}, want: betaCommandPrefix, wantCalls: 1},
+		{name: "override", opts: []Option{WithCommandPrefix("alpha", "emulators", "datastore")}, want: []string{"alpha", "emulators", "datastore"}},
+		{name: "dry run", opts: []Option{WithDryRun()}, want: betaCommandPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, calls := detect(t, tt.help, tt.opts...)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("commandPrefix() = %q, want %q", got, tt.want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("gcloud was probed %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestName(t *testing.T) {
+	if a, b := applyOptions(t).Name(), applyOptions(t).Name(); a == "" || a == b {
+		t.Errorf("the default names are %q and %q, want distinct ids", a, b)
+	}
+
+	var logs, out syncBuffer
+	m := &namedRecordingMetrics{}
+	e := newFakeEmulator(t, []string{"FAKE_STDOUT=hello"}, WithName("alpha"), WithLogger(log.New(&logs, "", 0)), WithOutput(&out), WithMetrics(m))
+	if got := e.Name(); got != "alpha" {
+		t.Errorf("Name() = %q, want alpha", got)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.HasPrefix(line, "[alpha] ") {
+			t.Errorf("log line %q lacks the name", line)
+		}
+	}
+	if !strings.Contains(out.String(), "[alpha] hello") {
+		t.Errorf("the output is %q, want the lines prefixed with the name", out.String())
+	}
+	if len(m.names) == 0 || slices.ContainsFunc(m.names, func(name string) bool { return name != "alpha" }) {
+		t.Errorf("the metrics were recorded for %q, want alpha", m.names)
+	}
+	if err := WithName("")(&Emulator{}); err == nil {
+		t.Error(`WithName("") error = nil`)
+	}
+}
+
+func TestScheme(t *testing.T) {
+	f := startFakeServer(t, fakeConfig{})
+	srv := httptest.NewUnstartedServer(f)
+	srv.EnableHTTP2 = true
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the untrusting handshake
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	advertise(t, srv.URL, DefaultProject)
+	e := newTestEmulator(t, WithScheme("https"), WithRandomPort(), WithTLSConfig(&tls.Config{RootCAs: pool}), ResetAllProjects())
+	if e.Host != srv.URL {
+		t.Errorf("Host = %q, want %q", e.Host, srv.URL)
+	}
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	if _, err := c.Put(ctx, e.NameKey("Kind", "a", nil), &entity{N: 1}); err != nil {
+		t.Errorf("Put() over TLS error = %v", err)
+	}
+	if err := e.Reset(); err != nil {
+		t.Errorf("Reset() over TLS error = %v", err)
+	}
+	if _, resets, _ := f.stats(); resets != 1 {
+		t.Errorf("the reset endpoint was requested %d times, want 1", resets)
+	}
+
+	untrusting := applyOptions(t, WithScheme("https"))
+	untrusting.Host = srv.URL
+	if err := untrusting.request("/", http.MethodGet); err == nil {
+		t.Error("request() with an untrusted certificate error = nil")
+	}
+	if err := WithScheme("ftp")(&Emulator{}); err == nil {
+		t.Error(`WithScheme("ftp") error = nil`)
+	}
+}
+
+func TestLastHealthLatency(t *testing.T) {
+	const delay = 5 * time.Millisecond // well within the probe timeout, even with -race
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(delay)
+	}))
+	defer srv.Close()
+	e := &Emulator{Host: srv.URL}
+	e.init()
+	if got := e.LastHealthLatency(); got != 0 {
+		t.Errorf("LastHealthLatency() before any health check = %v, want 0", got)
+	}
+	// a loaded machine may still exceed the probe timeout now and then
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		err := e.probe()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	got := e.LastHealthLatency()
+	if got < delay {
+		t.Errorf("LastHealthLatency() = %v, want at least %v", got, delay)
+	}
+	fail.Store(true)
+	if err := e.probe(); err == nil {
+		t.Fatal("probe() of a failing emulator error = nil")
+	}
+	if after := e.LastHealthLatency(); after != got {
+		t.Errorf("LastHealthLatency() after a failed health check = %v, want %v", after, got)
+	}
+}
+
+func TestAdvertiseHostPort(t *testing.T) {
+	port, err := AllocateFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := fmt.Sprintf("localhost:%d", port)
+	const advertise = "emulator.example:9999"
+	e := newFakeEmulator(t, nil, func(e *Emulator) error {
+		e.randomPort = false
+		return WithBindHostPort(bind)(e)
+	}, WithAdvertiseHostPort(advertise))
+	if args := e.StartArgs(); !slices.Contains(args, "--host-port="+bind) {
+		t.Errorf("StartArgs() = %q, want the bind host-port", args)
+	}
+	if e.Host != "http://"+advertise || e.GRPCEndpoint() != advertise || e.Config().Endpoint != advertise {
+		t.Errorf("Host, GRPCEndpoint(), Config().Endpoint = %q, %q, %q, want the advertised host-port", e.Host, e.GRPCEndpoint(), e.Config().Endpoint)
+	}
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != advertise {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q, want %q", got, advertise)
+	}
+	// the package itself talks to the bound address
+	if err := e.WaitHealthy(context.Background()); err != nil {
+		t.Errorf("WaitHealthy() error = %v", err)
+	}
+	if err := WithAdvertiseHostPort("no-port")(&Emulator{}); err == nil {
+		t.Error(`WithAdvertiseHostPort("no-port") error = nil`)
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	_, err := NewContext(ctx, fakeGcloud("FAKE_START_DELAY=1m")...)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("NewContext() error = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(began); d > 5*time.Second {
+		t.Errorf("NewContext() returned after %v, want it aborted promptly", d)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewContext(canceled, fakeGcloud()...); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewContext() with a canceled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestResetWithIndexes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "index.yaml")
+	writeIndex := func(props ...string) {
+		index := "indexes:\n- kind: Kind\n  properties:\n"
+		for _, p := range props {
+			index += "  - name: " + p + "\n"
+		}
+		if err := os.WriteFile(file, []byte(index), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeIndex("A", "B")
+	e := newFakeEmulator(t, nil, WithRequireIndexes(file))
+	ctx := context.Background()
+	query := func() error {
+		_, err := GetAll[struct{ A, B, C int }](ctx, e, datastore.NewQuery("Kind").FilterField("A", "=", 1).Order("C"))
+		return err
+	}
+	if err := query(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("query with an undeclared index error = %v, want FailedPrecondition", err)
+	}
+	writeIndex("A", "C")
+	if err := e.ResetWithIndexes(ctx); err != nil {
+		t.Fatalf("ResetWithIndexes() error = %v", err)
+	}
+	if err := query(); err != nil {
+		t.Errorf("query with the index re-applied by ResetWithIndexes error = %v", err)
+	}
+
+	// without an index file it's a plain reset
+	plain := newFakeEmulator(t, nil)
+	if err := plain.ResetWithIndexes(ctx); err != nil {
+		t.Errorf("ResetWithIndexes() without an index file error = %v", err)
+	}
+}
+
+func TestReinitialize(t *testing.T) {
+	e := newFakeEmulator(t, nil)
+	ctx := context.Background()
+	putEntities(t, e, "Kind", "", 3)
+	pid, host, env := e.proc.cmd.Process.Pid, e.Host, os.Getenv("DATASTORE_EMULATOR_HOST")
+	if err := e.Reinitialize(ctx); err != nil {
+		t.Fatalf("Reinitialize() error = %v", err)
+	}
+	if got := e.proc.cmd.Process.Pid; got != pid {
+		t.Errorf("PID after Reinitialize = %d, want the process %d kept", got, pid)
+	}
+	if e.Host != host || os.Getenv("DATASTORE_EMULATOR_HOST") != env {
+		t.Errorf("Host, DATASTORE_EMULATOR_HOST after Reinitialize = %q, %q, want %q, %q", e.Host, os.Getenv("DATASTORE_EMULATOR_HOST"), host, env)
+	}
+	if n, err := e.Count(ctx, "Kind", ""); err != nil || n != 0 {
+		t.Errorf("Count() after Reinitialize = %d, %v, want the data flushed", n, err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	errPreflight := errors.New("no emulator component")
+	calls := 0
+	launched := false
+	opts := append(fakeGcloud(), WithPreflight(func(ctx context.Context) error {
+		calls++
+		return errPreflight
+	}), WithCommand(func(args []string) *exec.Cmd {
+		launched = true
+		return exec.Command(os.Args[0], args...)
+	}))
+	if _, err := New(opts...); !errors.Is(err, errPreflight) {
+		t.Errorf("New() error = %v, want the preflight error", err)
+	}
+	if calls != 1 || launched {
+		t.Errorf("the preflight was called %d times and the emulator launched %v, want 1 and false", calls, launched)
+	}
+
+	calls = 0
+	newAdoptingEmulator(t, fakeConfig{}, WithPreflight(func(ctx context.Context) error {
+		calls++
+		return errPreflight
+	}))
+	if calls != 0 {
+		t.Errorf("the preflight was called %d times for a reused emulator, want 0", calls)
+	}
+}
+
+func TestRequestBackoff(t *testing.T) {
+	const base, maxDelay = 10 * time.Millisecond, 80 * time.Millisecond
+	bound := func(attempt int) time.Duration { return min(base<<attempt, maxDelay) }
+
+	t.Run("bounds", func(t *testing.T) {
+		e := applyOptions(t, WithRequestBackoff(base, maxDelay))
+		for attempt := range 40 {
+			var longest time.Duration
+			for range 100 {
+				d := e.backoff(attempt)
+				if d < 0 || d > bound(attempt) {
+					t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, bound(attempt))
+				}
+				longest = max(longest, d)
+			}
+			if longest <= bound(attempt)/4 {
+				t.Errorf("backoff(%d) was at most %v in 100 draws, want it jittered up to %v", attempt, longest, bound(attempt))
+			}
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		srv := httptest.NewServer(statusHandler(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK))
+		defer srv.Close()
+		c := &instantClock{}
+		e := applyOptions(t, WithRequestBackoff(base, maxDelay), withClock(c))
+		e.Host = srv.URL
+		if err := e.requestContext(context.Background(), resetEndpoint, http.MethodPost); err != nil {
+			t.Fatalf("requestContext() error = %v", err)
+		}
+		if len(c.delays) != 3 {
+			t.Fatalf("the request was retried after %v, want 3 delays", c.delays)
+		}
+		for attempt, d := range c.delays {
+			if d < 0 || d > bound(attempt) {
+				t.Errorf("delay %d = %v, want within [0, %v]", attempt, d, bound(attempt))
+			}
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		srv := httptest.NewServer(statusHandler(http.StatusServiceUnavailable))
+		defer srv.Close()
+		e := applyOptions(t, WithRequestBackoff(time.Hour, time.Hour))
+		e.Host = srv.URL
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		began := time.Now()
+		var se *StatusError
+		if err := e.requestContext(ctx, resetEndpoint, http.MethodPost); !errors.As(err, &se) {
+			t.Errorf("requestContext() error = %v, want the last StatusError", err)
+		}
+		if d := time.Since(began); d > 5*time.Second {
+			t.Errorf("requestContext() returned after %v, want when the context is done", d)
+		}
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		srv := httptest.NewServer(statusHandler(http.StatusBadRequest, http.StatusOK))
+		defer srv.Close()
+		c := &instantClock{}
+		e := applyOptions(t, WithRequestBackoff(base, maxDelay), withClock(c))
+		e.Host = srv.URL
+		if err := e.requestContext(context.Background(), resetEndpoint, http.MethodPost); err == nil || len(c.delays) != 0 {
+			t.Errorf("requestContext() = %v after %d retries, want the client error without retries", err, len(c.delays))
+		}
+	})
+
+	if err := WithRequestBackoff(time.Second, time.Millisecond)(&Emulator{}); err == nil {
+		t.Error("WithRequestBackoff() with a max below the base error = nil")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	const requests = 50
+	connections := func(t *testing.T, opts ...Option) int {
+		var conns atomic.Int32
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.Start()
+		defer srv.Close()
+		e := applyOptions(t, opts...)
+		e.Host = srv.URL
+		defer e.closeIdleConnections()
+		for range requests {
+			if err := e.request(healthcheckEndpoint, http.MethodGet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return int(conns.Load())
+	}
+	if n := connections(t); n != 1 {
+		t.Errorf("%d requests opened %d connections, want the connection reused", requests, n)
+	}
+	if n := connections(t, WithTransport(&http.Transport{DisableKeepAlives: true})); n != requests {
+		t.Errorf("%d requests with keep-alives disabled opened %d connections, want the transport used", requests, n)
+	}
+	if err := WithTransport(nil)(applyOptions(t)); err == nil {
+		t.Error("WithTransport(nil) error = nil")
+	}
+
+	tlsConfig := &tls.Config{ServerName: "emulator"}
+	for name, opts := range map[string]func(*http.Transport) []Option{
+		"TLS config first": func(tr *http.Transport) []Option { return []Option{WithTLSConfig(tlsConfig), WithTransport(tr)} },
+		"transport first":  func(tr *http.Transport) []Option { return []Option{WithTransport(tr), WithTLSConfig(tlsConfig)} },
+	} {
+		tr := &http.Transport{}
+		e := applyOptions(t, opts(tr)...)
+		if tr.TLSClientConfig != nil && tr.TLSClientConfig.ServerName != "" {
+			t.Errorf("%s: the TLS config of the transport of the caller was modified", name)
+		}
+		if got := e.httpc.Transport.(*http.Transport).TLSClientConfig; got == nil || got.ServerName != "emulator" {
+			t.Errorf("%s: the TLS config of the transport = %+v, want the one set", name, got)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	f := startFakeServer(t, fakeConfig{ignoreShutdown: true})
+	// an ingress serving the emulator under a path
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, "/datastore-emulator")
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = "/" + strings.TrimPrefix(rest, "/")
+		f.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	for i, prefix := range []string{"/datastore-emulator", "datastore-emulator", "/datastore-emulator/", "//datastore-emulator//"} {
+		e := applyOptions(t, WithBasePath(prefix))
+		e.Host = srv.URL
+		if err := e.probe(); err != nil {
+			t.Errorf("WithBasePath(%q): health check error = %v", prefix, err)
+		}
+		if err := e.request(resetEndpoint, http.MethodPost); err != nil {
+			t.Errorf("WithBasePath(%q): reset error = %v", prefix, err)
+		}
+		if err := e.request(shutdownEndpoint, http.MethodPost); err != nil {
+			t.Errorf("WithBasePath(%q): shutdown error = %v", prefix, err)
+		}
+		if _, resets, shutdowns := f.stats(); resets != i+1 || shutdowns != i+1 {
+			t.Errorf("WithBasePath(%q): the emulator received %d resets and %d shutdowns, want %d", prefix, resets, shutdowns, i+1)
+		}
+	}
+	e := applyOptions(t)
+	e.Host = srv.URL
+	if err := e.probe(); err == nil {
+		t.Error("health check without the base path error = nil")
+	}
+}
+
+func TestCloudSDKConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config", "gcloud")
+	file := filepath.Join(t.TempDir(), "env")
+	newFakeEmulator(t, []string{"FAKE_ENV_FILE=" + file}, WithCloudSDKConfig(dir))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("the config dir wasn't created: %v", err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := strings.Split(string(data), "\n"); !slices.Contains(env, "CLOUDSDK_CONFIG="+dir) {
+		t.Errorf("the subprocess environment lacks CLOUDSDK_CONFIG=%s: %q", dir, env)
+	}
+	if err := WithCloudSDKConfig("")(&Emulator{}); err == nil {
+		t.Error(`WithCloudSDKConfig("") error = nil`)
+	}
+}
+
+func TestReady(t *testing.T) {
+	e := applyOptions(t, fakeGcloud()...)
+	if e.Ready() {
+		t.Error("Ready() before Start = true")
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = e.ForceClose() })
+	if !e.Ready() {
+		t.Error("Ready() after Start = false")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Ready() {
+		t.Error("Ready() after Close = true")
+	}
+
+	a, f := newAdoptingEmulator(t, fakeConfig{})
+	f.close()
+	_ = a.probe()
+	if a.Ready() {
+		t.Error("Ready() after a failed health check = true")
+	}
+}
+
+func TestFailureOutput(t *testing.T) {
+	t.Run("failure", func(t *testing.T) {
+		var dump syncBuffer
+		_, err := New(append(fakeGcloud("FAKE_FAIL=exit", "FAKE_STDOUT=booting"), WithFailureOutput(&dump))...)
+		if err == nil {
+			t.Fatal("New() error = nil")
+		}
+		if got := dump.String(); !strings.Contains(got, "booting") || !strings.Contains(got, "ERROR: the emulator failed") {
+			t.Errorf("the failure output is %q, want the output of the emulator", got)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var dump syncBuffer
+		newFakeEmulator(t, []string{"FAKE_STDOUT=booting"}, WithFailureOutput(&dump))
+		if got := dump.String(); got != "" {
+			t.Errorf("the failure output of a successful startup is %q, want none", got)
+		}
+	})
+
+	t.Run("shown output", func(t *testing.T) {
+		var dump, out syncBuffer
+		_, err := New(append(fakeGcloud("FAKE_FAIL=exit"), WithFailureOutput(&dump), WithOutput(&out))...)
+		if err == nil {
+			t.Fatal("New() error = nil")
+		}
+		if dump.String() != "" || !strings.Contains(out.String(), "ERROR: the emulator failed") {
+			t.Errorf("the failure output is %q and the output %q, want the output shown only once", dump.String(), out.String())
+		}
+	})
+}
+
+func TestHostPortCandidates(t *testing.T) {
+	occupied, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	port, err := AllocateFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := fmt.Sprintf("localhost:%d", port)
+	candidates := func(hostPorts ...string) Option {
+		return func(e *Emulator) error {
+			e.randomPort = false
+			return WithHostPortCandidates(hostPorts...)(e)
+		}
+	}
+
+	e := newFakeEmulator(t, nil, candidates(occupied.Addr().String(), free))
+	if e.addr != free || e.Host != "http://"+free {
+		t.Errorf("addr, Host = %q, %q, want the second candidate %s", e.addr, e.Host, free)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(append(fakeGcloud(), candidates(occupied.Addr().String()))...)
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("New() with all the candidates in use error = %v, want ErrPortInUse", err)
+	}
+	if err := WithHostPortCandidates()(&Emulator{}); err == nil {
+		t.Error("WithHostPortCandidates() error = nil")
+	}
+}
@@ -0,0 +1,80 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// PropertyList builds a datastore.PropertyList from a map of property names
+// to values, so that entities can be put without declaring a struct. The
+// supported values are nil, strings, integers, floats, bools, time.Time,
+// []byte, *datastore.Key, json.Number, slices of the supported values
+// ([]any) and nested maps (map[string]any), which are stored as nested
+// entities.
+func PropertyList(props map[string]any) (datastore.PropertyList, error) {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pl := make(datastore.PropertyList, 0, len(props))
+	for _, name := range names {
+		v, err := propertyValue(props[name])
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", name, err)
+		}
+		pl = append(pl, datastore.Property{Name: name, Value: v})
+	}
+	return pl, nil
+}
+
+// propertyValue converts a value to one of the types accepted by the
+// datastore client.
+func propertyValue(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, string, bool, int64, float64, time.Time, []byte, *datastore.Key:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case []any:
+		values := make([]any, len(v))
+		for i, item := range v {
+			iv, err := propertyValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = iv
+		}
+		return values, nil
+	case map[string]any:
+		pl, err := PropertyList(v)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Properties: pl}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
@@ -0,0 +1,85 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestPropertyList(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	key := datastore.NameKey("Kind", "a", nil)
+	tests := []struct {
+		value any
+		want  any
+	}{
+		{value: nil, want: nil},
+		{value: "s", want: "s"},
+		{value: true, want: true},
+		{value: 1, want: int64(1)},
+		{value: int8(2), want: int64(2)},
+		{value: int16(3), want: int64(3)},
+		{value: int32(4), want: int64(4)},
+		{value: int64(5), want: int64(5)},
+		{value: uint8(6), want: int64(6)},
+		{value: uint16(7), want: int64(7)},
+		{value: uint32(8), want: int64(8)},
+		{value: float32(1.5), want: 1.5},
+		{value: 2.5, want: 2.5},
+		{value: json.Number("9"), want: int64(9)},
+		{value: json.Number("9.5"), want: 9.5},
+		{value: now, want: now},
+		{value: []byte("b"), want: []byte("b")},
+		{value: key, want: key},
+		{value: []any{1, "s"}, want: []any{int64(1), "s"}},
+		{value: map[string]any{"b": 1, "a": "s"}, want: &datastore.Entity{Properties: datastore.PropertyList{
+			{Name: "a", Value: "s"},
+			{Name: "b", Value: int64(1)},
+		}}},
+	}
+	for _, tt := range tests {
+		pl, err := PropertyList(map[string]any{"p": tt.value})
+		if err != nil {
+			t.Errorf("PropertyList(%T) error = %v", tt.value, err)
+			continue
+		}
+		if want := (datastore.PropertyList{{Name: "p", Value: tt.want}}); !reflect.DeepEqual(pl, want) {
+			t.Errorf("PropertyList(%T) = %#v, want %#v", tt.value, pl, want)
+		}
+	}
+
+	for _, value := range []any{uint64(1), struct{}{}, []any{struct{}{}}, map[string]any{"x": struct{}{}}} {
+		if _, err := PropertyList(map[string]any{"p": value}); err == nil {
+			t.Errorf("PropertyList(%T) error = nil", value)
+		}
+	}
+}
+
+func TestPropertyListPut(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	pl, err := PropertyList(map[string]any{"name": "a", "n": 1, "tags": []any{"x", "y"}, "nested": map[string]any{"k": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := e.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &pl); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	var got datastore.PropertyList
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pl) {
+		t.Errorf("Get() = %v, want %v", got, pl)
+	}
+}
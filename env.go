@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// prevEnvVar is the value of an environment variable before it was set by
+// the Emulator.
+type prevEnvVar struct {
+	value string
+	set   bool
+}
+
+// envValues are the environment variables which can be managed by the
+// Emulator, with the functions returning their values given the host-port
+// advertised to the clients.
+var envValues = map[string]func(e *Emulator, hostPort string) string{
+	"DATASTORE_EMULATOR_HOST":      func(_ *Emulator, hostPort string) string { return hostPort },
+	"DATASTORE_EMULATOR_HOST_PATH": func(_ *Emulator, hostPort string) string { return hostPort + "/datastore" },
+	"DATASTORE_HOST":               func(e *Emulator, hostPort string) string { return e.scheme + "://" + hostPort },
+	"DATASTORE_PROJECT_ID":         func(e *Emulator, _ string) string { return e.ProjectID },
+	"DATASTORE_DATASET":            func(e *Emulator, _ string) string { return e.DatasetID() },
+	"GOOGLE_CLOUD_PROJECT":         func(e *Emulator, _ string) string { return e.ProjectID },
+}
+
+// defaultManagedEnvVars are the environment variables set by Start unless
+// set otherwise with WithManagedEnvVars.
+var defaultManagedEnvVars = []string{"DATASTORE_EMULATOR_HOST", "DATASTORE_PROJECT_ID"}
+
+// managedEnv returns the values of the managed environment variables for the
+// emulator advertised at hostPort.
+func (e *Emulator) managedEnv(hostPort string) map[string]string {
+	names := e.managedEnvVars
+	if names == nil {
+		names = defaultManagedEnvVars
+	}
+	if e.datasetID != "" && !slices.Contains(names, "DATASTORE_DATASET") {
+		names = append(slices.Clone(names), "DATASTORE_DATASET")
+	}
+	vars := make(map[string]string, len(names))
+	for _, name := range names {
+		vars[name] = envValues[name](e, hostPort)
+	}
+	return vars
+}
+
+// setEnv sets the environment variables. The values they had before they were
+// first set are remembered, so that they can be restored by restoreEnv.
+func (e *Emulator) setEnv(vars map[string]string) {
+	if e.prevEnv == nil {
+		e.prevEnv = map[string]prevEnvVar{}
+	}
+	for k, v := range vars {
+		if _, ok := e.prevEnv[k]; !ok {
+			prev, set := os.LookupEnv(k)
+			e.prevEnv[k] = prevEnvVar{value: prev, set: set}
+		}
+		os.Setenv(k, v)
+	}
+}
+
+// restoreEnv restores the environment variables set by setEnv to their
+// previous values, unsetting the ones which were not set before.
+func (e *Emulator) restoreEnv() error {
+	var errs []error
+	for k, prev := range e.prevEnv {
+		var err error
+		if prev.set {
+			err = os.Setenv(k, prev.value)
+		} else {
+			err = os.Unsetenv(k)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restore %s: %w", k, err))
+		}
+	}
+	e.prevEnv = nil
+	return errors.Join(errs...)
+}
+
+// WithEnvApplied sets the environment variables pointing clients at the
+// emulator (see Env), runs fn and restores the variables to their previous
+// values, even if fn panics. It's useful for mixing code using the emulator
+// and code which must not see it in a single process.
+func (e *Emulator) WithEnvApplied(fn func()) {
+	prev := map[string]prevEnvVar{}
+	for _, kv := range e.Env() {
+		k, v, _ := strings.Cut(kv, "=")
+		value, set := os.LookupEnv(k)
+		prev[k] = prevEnvVar{value: value, set: set}
+		os.Setenv(k, v)
+	}
+	defer func() {
+		for k, p := range prev {
+			if p.set {
+				os.Setenv(k, p.value)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,141 @@
+package emulator
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRestoreEnv(t *testing.T) {
+	t.Setenv("DATASTORE_EMULATOR_HOST", "ci-emulator:8081")
+	t.Setenv("DATASTORE_PROJECT_ID", "")
+	os.Unsetenv("DATASTORE_PROJECT_ID")
+	e := newFakeEmulator(t, nil, WithProject("mine"))
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != e.addr {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q, want %q", got, e.addr)
+	}
+	if got := os.Getenv("DATASTORE_PROJECT_ID"); got != "mine" {
+		t.Errorf("DATASTORE_PROJECT_ID = %q, want %q", got, "mine")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != "ci-emulator:8081" {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q after Close, want the previous value", got)
+	}
+	if v, ok := os.LookupEnv("DATASTORE_PROJECT_ID"); ok {
+		t.Errorf("DATASTORE_PROJECT_ID = %q after Close, want it unset", v)
+	}
+}
+
+func TestWithEnvApplied(t *testing.T) {
+	t.Setenv("DATASTORE_PROJECT_ID", "outer")
+	t.Setenv("DATASTORE_EMULATOR_HOST", "")
+	os.Unsetenv("DATASTORE_EMULATOR_HOST")
+	e := &Emulator{Host: "http://localhost:1234", ProjectID: "inner"}
+	e.init()
+
+	var inside map[string]string
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the panic of fn", r)
+			}
+		}()
+		e.WithEnvApplied(func() {
+			inside = map[string]string{
+				"DATASTORE_EMULATOR_HOST": os.Getenv("DATASTORE_EMULATOR_HOST"),
+				"DATASTORE_PROJECT_ID":    os.Getenv("DATASTORE_PROJECT_ID"),
+			}
+			panic("boom")
+		})
+	}()
+	if inside["DATASTORE_EMULATOR_HOST"] != "localhost:1234" || inside["DATASTORE_PROJECT_ID"] != "inner" {
+		t.Errorf("the environment of fn = %v, want the emulator's", inside)
+	}
+	if got := os.Getenv("DATASTORE_PROJECT_ID"); got != "outer" {
+		t.Errorf("DATASTORE_PROJECT_ID = %q after the panic, want the previous value", got)
+	}
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q after the panic, want it unset", v)
+	}
+}
+
+func TestPersistEnvOnClose(t *testing.T) {
+	// t.Setenv restores the environment left set by the option
+	t.Setenv("DATASTORE_EMULATOR_HOST", "")
+	t.Setenv("DATASTORE_PROJECT_ID", "")
+	e := newFakeEmulator(t, nil, WithProject("kept"), WithPersistEnvOnClose())
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != e.addr {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q after Close, want %q", got, e.addr)
+	}
+	if got := os.Getenv("DATASTORE_PROJECT_ID"); got != "kept" {
+		t.Errorf("DATASTORE_PROJECT_ID = %q after Close, want kept", got)
+	}
+}
+
+func TestManagedEnvVars(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "previous")
+	t.Setenv("DATASTORE_DATASET", "")
+	os.Unsetenv("DATASTORE_DATASET")
+	managed := []string{"DATASTORE_EMULATOR_HOST", "DATASTORE_EMULATOR_HOST_PATH", "DATASTORE_HOST", "DATASTORE_DATASET", "GOOGLE_CLOUD_PROJECT"}
+	e := newFakeEmulator(t, nil, WithProject("managed"), WithManagedEnvVars(managed...))
+	want := map[string]string{
+		"DATASTORE_EMULATOR_HOST":      e.addr,
+		"DATASTORE_EMULATOR_HOST_PATH": e.addr + "/datastore",
+		"DATASTORE_HOST":               "http://" + e.addr,
+		"DATASTORE_DATASET":            "managed",
+		"GOOGLE_CLOUD_PROJECT":         "managed",
+	}
+	for k, v := range want {
+		if got := os.Getenv(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if v, ok := os.LookupEnv("DATASTORE_PROJECT_ID"); ok {
+		t.Errorf("DATASTORE_PROJECT_ID = %q, want the unmanaged variable left unset", v)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOOGLE_CLOUD_PROJECT"); got != "previous" {
+		t.Errorf("GOOGLE_CLOUD_PROJECT = %q after Close, want the previous value", got)
+	}
+	for _, k := range managed[:4] {
+		if v, ok := os.LookupEnv(k); ok {
+			t.Errorf("%s = %q after Close, want it unset", k, v)
+		}
+	}
+	if err := WithManagedEnvVars("PATH")(&Emulator{}); err == nil {
+		t.Error(`WithManagedEnvVars("PATH") error = nil`)
+	}
+}
+
+func TestDatasetID(t *testing.T) {
+	t.Setenv("DATASTORE_DATASET", "")
+	os.Unsetenv("DATASTORE_DATASET")
+	e := newFakeEmulator(t, nil, WithProject("proj"), WithDatasetID("legacy"))
+	if got := e.DatasetID(); got != "legacy" {
+		t.Errorf("DatasetID() = %q, want legacy", got)
+	}
+	for k, want := range map[string]string{"DATASTORE_DATASET": "legacy", "DATASTORE_PROJECT_ID": "proj"} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := os.LookupEnv("DATASTORE_DATASET"); ok {
+		t.Errorf("DATASTORE_DATASET = %q after Close, want it restored", v)
+	}
+
+	if got := newFakeEmulator(t, nil, WithProject("proj")).DatasetID(); got != "proj" {
+		t.Errorf("DatasetID() by default = %q, want the project", got)
+	}
+	if err := WithDatasetID("")(&Emulator{}); err == nil {
+		t.Error("WithDatasetID(\"\") error = nil")
+	}
+}
@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+var (
+	// ErrPortInUse is returned by Start when the emulator can't bind to its
+	// host-port because another process is listening on it.
+	ErrPortInUse = errors.New("port already in use")
+
+	// ErrGcloudNotFound is returned by Start when the gcloud executable can't
+	// be found in the PATH.
+	ErrGcloudNotFound = errors.New("gcloud executable not found")
+
+	// ErrNetwork is wrapped by the StartupError when the output of the
+	// emulator suggests that the startup hung trying to reach the network.
+	ErrNetwork = errors.New("emulator startup blocked on network access")
+
+	// ErrNotOwner is returned when an operation requires the emulator process
+	// to be owned by the Emulator, i.e. it was not reused.
+	ErrNotOwner = errors.New("emulator process is not owned by this instance")
+
+	// ErrNotStarted is returned when an operation requires a running
+	// emulator, but the Emulator was not started.
+	ErrNotStarted = errors.New("emulator not started")
+
+	// ErrConnectionRefused is returned when nothing listens on the emulator
+	// host-port, e.g. because the emulator is not up yet.
+	ErrConnectionRefused = errors.New("connection refused")
+
+	// ErrRequestTimeout is returned when a request to the emulator doesn't
+	// complete in time.
+	ErrRequestTimeout = errors.New("request timeout")
+
+	// ErrUnexpectedStatus is returned when the emulator responds with an
+	// unexpected status code. The returned error is a *StatusError.
+	ErrUnexpectedStatus = errors.New("unexpected status code")
+
+	// ErrInstanceAlreadyRunning is returned by Start with the WithNoReuse
+	// option when a healthy emulator is already running, e.g. one left over
+	// by a previous CI job.
+	ErrInstanceAlreadyRunning = errors.New("emulator instance already running")
+
+	// ErrNotEmulator is returned by the destructive operations like Reset
+	// when the Emulator can't confirm that it talks to an emulator rather
+	// than to the production Datastore, see IsEmulator.
+	ErrNotEmulator = errors.New("not confirmed to be an emulator")
+
+	// ErrProjectMismatch is returned by Start with the WithEnforceProject
+	// option when the reused emulator is advertised with a different project
+	// than the configured one.
+	ErrProjectMismatch = errors.New("project of the reused emulator doesn't match")
+)
+
+// maxErrorBody is the maximum number of bytes of the response body included
+// in a StatusError.
+const maxErrorBody = 1024
+
+// StatusError is returned when the emulator responds with an unexpected
+// status code.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("status code error: %d", e.Code)
+	}
+	return fmt.Sprintf("status code error: %d: %s", e.Code, e.Body)
+}
+
+// Is makes StatusError match ErrUnexpectedStatus.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrUnexpectedStatus
+}
+
+// StartupError is returned by Start when the emulator doesn't become healthy,
+// either because it exited or because the startup timeout was reached.
+type StartupError struct {
+	// Err is the reason the startup failed.
+	Err error
+	// LastProbe is the error returned by the last health check, if any.
+	LastProbe error
+	// Output is the output of the emulator process.
+	Output string
+}
+
+func (e *StartupError) Error() string {
+	if e.LastProbe == nil {
+		return fmt.Sprintf("emulator startup failed: %v", e.Err)
+	}
+	return fmt.Sprintf("emulator startup failed: %v (last health check: %v)", e.Err, e.LastProbe)
+}
+
+// Unwrap returns the reason the startup failed.
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient reports whether the startup error might go away on retry: a
+// timeout, unless it's caused by the blocked network access, or a port bind
+// race.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrNetwork) {
+		return false
+	}
+	return errors.Is(err, ErrPortInUse) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrRequestTimeout)
+}
+
+// checkStatus returns a *StatusError if the response status code is not one
+// of the accepted ones. Any 2xx status code is accepted if none are given.
+func checkStatus(resp *http.Response, accepted ...int) error {
+	if len(accepted) == 0 && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	for _, code := range accepted {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &StatusError{Code: resp.StatusCode, Body: string(body)}
+}
+
+// classifyError wraps the error returned by the HTTP client into one of the
+// package errors where it can be recognized.
+func classifyError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %w", ErrConnectionRefused, err)
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w", ErrRequestTimeout, err)
+	}
+	return err
+}
+
+// isRetryable reports whether a failed request to the emulator is worth
+// retrying: the connection failed or the emulator returned a server error.
+func isRetryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
+	}
+	return errors.Is(err, ErrConnectionRefused) || errors.Is(err, ErrRequestTimeout)
+}
@@ -0,0 +1,125 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + l.Addr().String()
+	l.Close()
+	block := make(chan struct{})
+	defer close(block)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		case "/fail":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	request := func(url string) error {
+		e := &Emulator{Host: url}
+		return e.request("", http.MethodGet)
+	}
+
+	t.Run("connection refused", func(t *testing.T) {
+		if err := request(closedURL); !errors.Is(err, ErrConnectionRefused) {
+			t.Errorf("error = %v, want ErrConnectionRefused", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := request(srv.URL + "/slow")
+		if !errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("error = %v, want ErrRequestTimeout", err)
+		}
+		if errors.Is(err, ErrConnectionRefused) {
+			t.Errorf("error = %v, want no ErrConnectionRefused", err)
+		}
+	})
+
+	t.Run("unexpected status", func(t *testing.T) {
+		err := request(srv.URL + "/fail")
+		var se *StatusError
+		if !errors.As(err, &se) || !errors.Is(err, ErrUnexpectedStatus) {
+			t.Fatalf("error = %v, want a StatusError", err)
+		}
+		if se.Code != http.StatusInternalServerError || se.Body != "boom\n" {
+			t.Errorf("StatusError = %+v, want code 500 and the body", se)
+		}
+	})
+
+	t.Run("other", func(t *testing.T) {
+		err := request("unknown://host")
+		if err == nil || errors.Is(err, ErrConnectionRefused) || errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("error = %v, want an unclassified error", err)
+		}
+	})
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		code     int
+		accepted []int
+		wantErr  bool
+	}{
+		{code: http.StatusOK},
+		{code: http.StatusNoContent},
+		{code: http.StatusInternalServerError, wantErr: true},
+		{code: http.StatusOK, accepted: []int{http.StatusOK}},
+		{code: http.StatusNoContent, accepted: []int{http.StatusOK}, wantErr: true},
+		{code: http.StatusInternalServerError, accepted: []int{http.StatusOK}, wantErr: true},
+		{code: http.StatusNotFound, accepted: []int{http.StatusOK, http.StatusNotFound}},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+		e := &Emulator{Host: srv.URL}
+		e.init()
+		err := e.request("/", http.MethodPost, tt.accepted...)
+		srv.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("status %d, accepted %v: error = %v, want error %v", tt.code, tt.accepted, err, tt.wantErr)
+		}
+		var se *StatusError
+		if tt.wantErr && (!errors.As(err, &se) || se.Code != tt.code) {
+			t.Errorf("status %d, accepted %v: error = %v, want a StatusError with the code", tt.code, tt.accepted, err)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: localhost:8081", ErrPortInUse), true},
+		{&StartupError{Err: context.DeadlineExceeded}, true},
+		{fmt.Errorf("health check: %w", ErrRequestTimeout), true},
+		{&StartupError{Err: fmt.Errorf("%w: %w", ErrNetwork, context.DeadlineExceeded)}, false},
+		{&StartupError{Err: errors.New("emulator exited before startup was confirmed: exit status 1")}, false},
+		{&StartupError{Err: context.Canceled}, false},
+		{fmt.Errorf("%w: exec: \"gcloud\": executable file not found in $PATH", ErrGcloudNotFound), false},
+		{ErrConnectionRefused, false},
+	} {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
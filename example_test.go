@@ -0,0 +1,22 @@
+package emulator_test
+
+import (
+	"log"
+
+	emulator "github.com/fwojciec/datastore-emulator-go"
+	"google.golang.org/grpc"
+)
+
+func ExampleEmulator_GRPCDialOptions() {
+	e, err := emulator.New(emulator.WithRandomPort())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer e.Close()
+	conn, err := grpc.NewClient(e.GRPCEndpoint(), e.GRPCDialOptions()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	// use conn, e.g. with the datastorepb or the health service clients
+}
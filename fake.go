@@ -0,0 +1,59 @@
+package emulator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// Backend selects what Start launches.
+type Backend int
+
+const (
+	// BackendGcloud launches the real emulator with gcloud (the default).
+	BackendGcloud Backend = iota
+	// BackendFake launches an in-process HTTP stub implementing only the
+	// health, reset and shutdown endpoints of the emulator. It doesn't
+	// require gcloud, but it doesn't implement the datastore API either, so
+	// it's only useful for exercising the lifecycle of the Emulator (Start,
+	// Reset, Close), not for testing code using a datastore client.
+	BackendFake
+)
+
+// startFake starts the fake backend.
+func (e *Emulator) startFake() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(resetEndpoint, fakePost)
+	mux.HandleFunc(shutdownEndpoint, fakePost)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("Ok\n"))
+	})
+	e.fake = httptest.NewServer(mux)
+	e.stopOnClose = true
+	e.Host = e.fake.URL
+	e.addr = strings.TrimPrefix(e.fake.URL, "http://")
+	e.ProjectID = e.project
+	e.ready.Store(true)
+	e.setEnv(e.managedEnv(e.addr))
+	return nil
+}
+
+func fakePost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	_, _ = w.Write([]byte("Ok\n"))
+}
+
+// stopFake stops the fake backend, if it's running.
+func (e *Emulator) stopFake() {
+	if e.fake != nil {
+		e.fake.Close()
+		e.fake = nil
+	}
+}
@@ -0,0 +1,37 @@
+package emulator
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestBackendFake(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // no gcloud
+	e, err := New(WithBackend(BackendFake))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := e.probe(); err != nil {
+		t.Errorf("probe() error = %v", err)
+	}
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != e.GRPCEndpoint() {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q, want %q", got, e.GRPCEndpoint())
+	}
+	if err := e.Reset(); err != nil {
+		t.Errorf("Reset() error = %v", err)
+	}
+	host := e.Host
+	if err := e.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := http.Get(host); err == nil {
+		t.Error("the fake backend is still serving after Close")
+	}
+	if _, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Error("DATASTORE_EMULATOR_HOST is still set after Close")
+	}
+	if err := WithBackend(Backend(-1))(&Emulator{}); err == nil {
+		t.Error("WithBackend(-1) error = nil")
+	}
+}
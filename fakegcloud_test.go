@@ -0,0 +1,232 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as a fake gcloud: when it's run with FAKE_GCLOUD=1
+// in its environment, TestMain runs runFakeGcloud instead of the tests. The
+// fake is configured with the FAKE_* environment variables:
+//
+//	FAKE_HELP            "fail" fails the command group probe, "hang" hangs it
+//	FAKE_FAIL            "bind", "network" or "exit" fails the startup
+//	FAKE_FAIL_ONCE       a file: the startup only fails if it doesn't exist yet
+//	FAKE_STDOUT          a line written to stdout on startup
+//	FAKE_STDERR          a line written to stderr on startup
+//	FAKE_START_DELAY     a delay before the port is bound
+//	FAKE_HEALTH          the status codes of the health checks, e.g. "404,200"
+//	FAKE_SHUTDOWN        the status codes of the shutdown requests
+//	FAKE_SHUTDOWN_DELAY  a delay between a shutdown request and the exit
+//	FAKE_LAUNCHES        a file a line is appended to on each launch
+//	FAKE_ARGS_FILE       a file the arguments are written to, one per line
+//	FAKE_ENV_FILE        a file the environment is written to, one per line
+func runFakeGcloud(args []string) int {
+	if file := os.Getenv("FAKE_LAUNCHES"); file != "" {
+		if f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			fmt.Fprintln(f, strings.Join(args, " "))
+			f.Close()
+		}
+	}
+	if file := os.Getenv("FAKE_ARGS_FILE"); file != "" {
+		_ = os.WriteFile(file, []byte(strings.Join(args, "\n")), 0o644)
+	}
+	if file := os.Getenv("FAKE_ENV_FILE"); file != "" {
+		_ = os.WriteFile(file, []byte(strings.Join(os.Environ(), "\n")), 0o644)
+	}
+	if contains(args, "--help") {
+		switch os.Getenv("FAKE_HELP") {
+		case "fail":
+			return 2
+		case "hang":
+			select {}
+		}
+		return 0
+	}
+	if !contains(args, "start") {
+		fmt.Fprintf(os.Stderr, "fake gcloud: unsupported command %q\n", args)
+		return 2
+	}
+	go exitWithParent()
+	if line := os.Getenv("FAKE_STDOUT"); line != "" {
+		fmt.Println(line)
+	}
+	if line := os.Getenv("FAKE_STDERR"); line != "" {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	if failure := os.Getenv("FAKE_FAIL"); failure != "" && shouldFail() {
+		switch failure {
+		case "bind":
+			fmt.Fprintln(os.Stderr, "java.net.BindException: Address already in use")
+			return 1
+		case "network":
+			fmt.Fprintln(os.Stderr, "ERROR: gcloud crashed: unable to reach metadata.google.internal")
+			select {}
+		default:
+			fmt.Fprintln(os.Stderr, "ERROR: the emulator failed")
+			return 1
+		}
+	}
+	if d, err := time.ParseDuration(os.Getenv("FAKE_START_DELAY")); err == nil {
+		time.Sleep(d)
+	}
+	cfg := fakeConfig{
+		health:   parseCodes(os.Getenv("FAKE_HEALTH")),
+		shutdown: parseCodes(os.Getenv("FAKE_SHUTDOWN")),
+	}
+	var hostPort, dataDir string
+	requireIndexes := false
+	for _, arg := range args {
+		switch k, v, _ := strings.Cut(arg, "="); k {
+		case "--host-port":
+			hostPort = v
+		case "--data-dir":
+			dataDir = v
+		case "--require-indexes":
+			requireIndexes = true
+		}
+	}
+	if requireIndexes {
+		cfg.indexFile = filepath.Join(dataDir, "WEB-INF", "index.yaml")
+	}
+	f, err := newFakeServer(cfg, hostPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "java.net.BindException: Address already in use: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "[datastore] Dev App Server is now running.")
+	<-f.stopped
+	if d, err := time.ParseDuration(os.Getenv("FAKE_SHUTDOWN_DELAY")); err == nil {
+		time.Sleep(d)
+	}
+	f.close()
+	return 0
+}
+
+// shouldFail reports whether the startup should fail: always, unless
+// FAKE_FAIL_ONCE names a file, which is created by the first failure.
+func shouldFail() bool {
+	file := os.Getenv("FAKE_FAIL_ONCE")
+	if file == "" {
+		return true
+	}
+	if _, err := os.Stat(file); err == nil {
+		return false
+	}
+	return os.WriteFile(file, nil, 0o644) == nil
+}
+
+// exitWithParent exits when the test process dies, so that a crashed test run
+// leaves no fake emulators behind.
+func exitWithParent() {
+	parent := os.Getppid()
+	for range time.Tick(100 * time.Millisecond) {
+		if os.Getppid() != parent {
+			os.Exit(1)
+		}
+	}
+}
+
+func parseCodes(s string) []int {
+	var codes []int
+	for _, f := range strings.Split(s, ",") {
+		if code, err := strconv.Atoi(strings.TrimSpace(f)); err == nil {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// launches returns the number of launches of the fake gcloud recorded in the
+// FAKE_LAUNCHES file.
+func launches(tb testing.TB, file string) int {
+	tb.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		tb.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+// readArgs returns the arguments of the last launch of the fake gcloud, read
+// from the FAKE_ARGS_FILE file.
+func readArgs(tb testing.TB, file string) []string {
+	tb.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// fakeGcloud returns the options making the Emulator launch the fake gcloud
+// instead of gcloud, on a random port, configured with the knobs, which are
+// KEY=VALUE pairs (see runFakeGcloud).
+func fakeGcloud(knobs ...string) []Option {
+	opts := []Option{
+		WithCommand(func(args []string) *exec.Cmd {
+			return exec.Command(os.Args[0], args...)
+		}),
+		WithCommandPrefix(gaCommandPrefix...),
+		WithRandomPort(),
+		WithGcloudEnv("FAKE_GCLOUD", "1"),
+	}
+	for _, knob := range knobs {
+		i := strings.Index(knob, "=")
+		opts = append(opts, WithGcloudEnv(knob[:i], knob[i+1:]))
+	}
+	return opts
+}
+
+// newTestEmulator starts an Emulator with the options, failing the test if it
+// doesn't start, and force closes it at the end of the test.
+func newTestEmulator(tb testing.TB, opts ...Option) *Emulator {
+	tb.Helper()
+	e, err := New(opts...)
+	if err != nil {
+		tb.Fatalf("New() error = %v", err)
+	}
+	tb.Cleanup(func() { _ = e.ForceClose() })
+	return e
+}
+
+// newFakeEmulator starts an Emulator launching the fake gcloud configured
+// with the knobs, with the additional options.
+func newFakeEmulator(tb testing.TB, knobs []string, opts ...Option) *Emulator {
+	tb.Helper()
+	return newTestEmulator(tb, append(fakeGcloud(knobs...), opts...)...)
+}
+
+// withFreeHostPort overrides the random port of fakeGcloud with a fixed free
+// host-port, on which the emulators left running can be found.
+func withFreeHostPort(tb testing.TB) Option {
+	tb.Helper()
+	port, err := AllocateFreePort()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return withFixedHostPort(fmt.Sprintf("localhost:%d", port))
+}
+
+// withFixedHostPort overrides the random port of fakeGcloud with hostPort.
+func withFixedHostPort(hostPort string) Option {
+	return func(e *Emulator) error {
+		e.randomPort = false
+		return WithHostPort(hostPort)(e)
+	}
+}
@@ -0,0 +1,932 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeConfig tunes the behavior of the fake emulator.
+type fakeConfig struct {
+	// health are the status codes of the successive health checks, the last
+	// one repeating, 200 if empty.
+	health []int
+	// shutdown are the status codes of the successive shutdown requests, the
+	// last one repeating, 200 if empty. The server stops after a successful
+	// one, unless ignoreShutdown is set.
+	shutdown       []int
+	ignoreShutdown bool
+	// resetDelay delays the reset requests.
+	resetDelay time.Duration
+	// noReset makes the reset endpoint respond with 404, like an emulator
+	// storing its data on disk.
+	noReset bool
+	// opPolls is the number of polls an admin operation takes to complete,
+	// it never completes if negative.
+	opPolls int
+	// indexFile is the index.yaml file declaring the composite indexes, which
+	// are required if it's set.
+	indexFile string
+}
+
+// fakeServer is a stand-in for the Datastore emulator: it serves the HTTP
+// endpoints of the emulator (health check, reset, shutdown, export, import)
+// and an in-memory implementation of the datastore gRPC API on a single port,
+// like the emulator does.
+type fakeServer struct {
+	datastorepb.UnimplementedDatastoreServer
+
+	cfg     fakeConfig
+	addr    string
+	srv     *http.Server
+	grpc    *grpc.Server
+	stopped chan struct{} // closed by a successful shutdown request
+
+	mu        sync.Mutex
+	projects  map[string]map[string]*fakeEntity
+	versions  map[string]int64 // survive the deletes, for conflict detection
+	version   int64
+	nextID    int64
+	txns      map[string]map[string]int64 // the versions read by each transaction
+	txnSeq    int
+	ops       map[string]*fakeOperation
+	rpcs      map[string]int
+	checks    int // health checks
+	shutdowns int // shutdown requests
+	resets    int // reset requests
+}
+
+type fakeEntity struct {
+	entity  *datastorepb.Entity
+	version int64
+}
+
+type fakeOperation struct {
+	polls     int
+	outputURL string
+}
+
+// newFakeServer starts a fake emulator listening on hostPort.
+func newFakeServer(cfg fakeConfig, hostPort string) (*fakeServer, error) {
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeServer{
+		cfg:      cfg,
+		addr:     l.Addr().String(),
+		stopped:  make(chan struct{}),
+		projects: map[string]map[string]*fakeEntity{},
+		versions: map[string]int64{},
+		nextID:   1000,
+		txns:     map[string]map[string]int64{},
+		ops:      map[string]*fakeOperation{},
+		rpcs:     map[string]int{},
+	}
+	f.grpc = grpc.NewServer(
+		grpc.MaxRecvMsgSize(64<<20),
+		grpc.MaxSendMsgSize(64<<20),
+		grpc.UnaryInterceptor(f.countRPC),
+	)
+	datastorepb.RegisterDatastoreServer(f.grpc, f)
+	healthpb.RegisterHealthServer(f.grpc, health.NewServer())
+	f.srv = &http.Server{Handler: f, Protocols: new(http.Protocols)}
+	f.srv.Protocols.SetHTTP1(true)
+	f.srv.Protocols.SetUnencryptedHTTP2(true)
+	go f.srv.Serve(l)
+	return f, nil
+}
+
+// startFakeServer starts a fake emulator on a free loopback port, which is
+// stopped at the end of the test.
+func startFakeServer(tb testing.TB, cfg fakeConfig) *fakeServer {
+	tb.Helper()
+	f, err := newFakeServer(cfg, "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(f.close)
+	return f
+}
+
+// adoptFakeServer points the environment at the fake emulator, so that the
+// Emulators started by the test adopt it instead of launching one.
+func adoptFakeServer(tb testing.TB, f *fakeServer, projectID string) {
+	advertise(tb, f.url(), projectID)
+}
+
+// advertise points the environment at the emulator at url.
+func advertise(tb testing.TB, url, projectID string) {
+	tb.Setenv("DATASTORE_HOST", url)
+	tb.Setenv("DATASTORE_PROJECT_ID", projectID)
+}
+
+// newAdoptingEmulator starts a fake emulator and an Emulator adopting it.
+func newAdoptingEmulator(tb testing.TB, cfg fakeConfig, opts ...Option) (*Emulator, *fakeServer) {
+	tb.Helper()
+	f := startFakeServer(tb, cfg)
+	adoptFakeServer(tb, f, DefaultProject)
+	return newTestEmulator(tb, append([]Option{WithRandomPort()}, opts...)...), f
+}
+
+func (f *fakeServer) close() {
+	_ = f.srv.Close()
+}
+
+func (f *fakeServer) url() string {
+	return "http://" + f.addr
+}
+
+func (f *fakeServer) countRPC(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	f.mu.Lock()
+	f.rpcs[path.Base(info.FullMethod)]++
+	f.mu.Unlock()
+	return handler(ctx, req)
+}
+
+// rpcCount returns the number of calls of the gRPC method, e.g. "Lookup".
+func (f *fakeServer) rpcCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rpcs[method]
+}
+
+// stats returns the number of health checks, reset and shutdown requests.
+func (f *fakeServer) stats() (checks, resets, shutdowns int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks, f.resets, f.shutdowns
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		f.grpc.ServeHTTP(w, r)
+		return
+	}
+	switch p := r.URL.Path; {
+	case p == "/":
+		f.serveHealth(w, r)
+	case p == resetEndpoint:
+		f.serveReset(w, r)
+	case p == shutdownEndpoint:
+		f.serveShutdown(w, r)
+	case strings.HasPrefix(p, "/v1/"):
+		f.serveAdmin(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// nth returns the n-th (from 1) of the codes, the last one repeating, or 200
+// if there are none.
+func nth(codes []int, n int) int {
+	if len(codes) == 0 {
+		return http.StatusOK
+	}
+	return codes[min(n, len(codes))-1]
+}
+
+func (f *fakeServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.checks++
+	code := nth(f.cfg.health, f.checks)
+	f.mu.Unlock()
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte("Ok\n"))
+}
+
+func (f *fakeServer) serveReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.Lock()
+	f.resets++
+	f.mu.Unlock()
+	if f.cfg.noReset {
+		http.NotFound(w, r)
+		return
+	}
+	select {
+	case <-time.After(f.cfg.resetDelay):
+	case <-r.Context().Done():
+		return
+	}
+	f.mu.Lock()
+	f.projects = map[string]map[string]*fakeEntity{}
+	f.mu.Unlock()
+	_, _ = w.Write([]byte("Resetting...\n"))
+}
+
+func (f *fakeServer) serveShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.Lock()
+	f.shutdowns++
+	code := nth(f.cfg.shutdown, f.shutdowns)
+	f.mu.Unlock()
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte("Shutting down...\n"))
+	if code == http.StatusOK && !f.cfg.ignoreShutdown {
+		select {
+		case <-f.stopped:
+		default:
+			close(f.stopped)
+		}
+	}
+}
+
+// serveAdmin serves the export and import endpoints and the polling of their
+// operations. The exports are written as JSON lines of entities to the
+// metadata file, which only the fake understands.
+func (f *fakeServer) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/")
+	project, action, ok := strings.Cut(strings.TrimPrefix(rest, "projects/"), ":")
+	switch {
+	case strings.Contains(rest, "/operations/") && r.Method == http.MethodGet:
+		f.serveOperation(w, rest)
+	case ok && action == "export" && r.Method == http.MethodPost:
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		url, err := f.export(project, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.writeOperation(w, project, url)
+	case ok && action == "import" && r.Method == http.MethodPost:
+		var req struct {
+			InputURL string `json:"inputUrl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.importFile(project, req.InputURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.writeOperation(w, project, "")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeServer) writeOperation(w http.ResponseWriter, project, outputURL string) {
+	f.mu.Lock()
+	name := fmt.Sprintf("projects/%s/operations/%d", project, len(f.ops)+1)
+	op := &fakeOperation{outputURL: outputURL}
+	f.ops[name] = op
+	f.mu.Unlock()
+	f.writeOperationStatus(w, name, op)
+}
+
+func (f *fakeServer) serveOperation(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	op, ok := f.ops[name]
+	if ok {
+		op.polls++
+	}
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	f.writeOperationStatus(w, name, op)
+}
+
+func (f *fakeServer) writeOperationStatus(w http.ResponseWriter, name string, op *fakeOperation) {
+	var resp operation
+	resp.Name = name
+	resp.Done = f.cfg.opPolls >= 0 && op.polls >= f.cfg.opPolls
+	if resp.Done {
+		resp.Response.OutputURL = op.outputURL
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// export writes the entities of the project matching the filter to a new
+// directory under the output prefix and returns the path of its metadata file.
+func (f *fakeServer) export(project string, req exportRequest) (string, error) {
+	name := strconv.FormatInt(time.Now().UnixNano(), 10)
+	dir := filepath.Join(req.OutputURLPrefix, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	f.mu.Lock()
+	for _, k := range f.sortedKeys(project) {
+		entity := f.projects[project][k].entity
+		if req.EntityFilter != nil {
+			if kinds := req.EntityFilter.Kinds; len(kinds) > 0 && !slices.Contains(kinds, kindOf(entity.Key)) {
+				continue
+			}
+			if nss := req.EntityFilter.NamespaceIDs; len(nss) > 0 && !slices.Contains(nss, entity.Key.GetPartitionId().GetNamespaceId()) {
+				continue
+			}
+		}
+		b, err := protojson.Marshal(entity)
+		if err != nil {
+			f.mu.Unlock()
+			return "", err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	f.mu.Unlock()
+	file := filepath.Join(dir, name+metadataSuffix)
+	return file, os.WriteFile(file, buf.Bytes(), 0o644)
+}
+
+// importFile upserts the entities of an export written by export.
+func (f *fakeServer) importFile(project, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 64<<20)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s.Scan() {
+		entity := &datastorepb.Entity{}
+		if err := protojson.Unmarshal(s.Bytes(), entity); err != nil {
+			return err
+		}
+		f.put(project, entity)
+	}
+	return s.Err()
+}
+
+// entities returns the entities of the project, creating the map if needed.
+func (f *fakeServer) entities(project string) map[string]*fakeEntity {
+	m := f.projects[project]
+	if m == nil {
+		m = map[string]*fakeEntity{}
+		f.projects[project] = m
+	}
+	return m
+}
+
+func (f *fakeServer) sortedKeys(project string) []string {
+	keys := make([]string, 0, len(f.projects[project]))
+	for k := range f.projects[project] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeServer) put(project string, entity *datastorepb.Entity) int64 {
+	f.version++
+	k := project + "/" + keyString(entity.Key)
+	f.versions[k] = f.version
+	f.entities(project)[keyString(entity.Key)] = &fakeEntity{entity: proto.Clone(entity).(*datastorepb.Entity), version: f.version}
+	return f.version
+}
+
+func (f *fakeServer) remove(project string, key *datastorepb.Key) int64 {
+	f.version++
+	f.versions[project+"/"+keyString(key)] = f.version
+	delete(f.entities(project), keyString(key))
+	return f.version
+}
+
+// keyString returns a string identifying the key within its project.
+func keyString(k *datastorepb.Key) string {
+	var b strings.Builder
+	b.WriteString(k.GetPartitionId().GetNamespaceId())
+	for _, p := range k.GetPath() {
+		b.WriteByte(0)
+		b.WriteString(p.Kind)
+		b.WriteByte(0)
+		switch id := p.IdType.(type) {
+		case *datastorepb.Key_PathElement_Name:
+			b.WriteString("n" + id.Name)
+		case *datastorepb.Key_PathElement_Id:
+			fmt.Fprintf(&b, "i%020d", id.Id)
+		}
+	}
+	return b.String()
+}
+
+func kindOf(k *datastorepb.Key) string {
+	if len(k.GetPath()) == 0 {
+		return ""
+	}
+	return k.Path[len(k.Path)-1].Kind
+}
+
+func isIncomplete(k *datastorepb.Key) bool {
+	return len(k.GetPath()) > 0 && k.Path[len(k.Path)-1].IdType == nil
+}
+
+// readTxn returns the transaction the reads are made in, beginning a new one
+// if requested, and whether it was begun.
+func (f *fakeServer) readTxn(opts *datastorepb.ReadOptions) (string, bool, error) {
+	switch {
+	case opts.GetNewTransaction() != nil:
+		return f.beginTxn(), true, nil
+	case opts.GetTransaction() != nil:
+		id := string(opts.GetTransaction())
+		if _, ok := f.txns[id]; !ok {
+			return "", false, status.Error(codes.InvalidArgument, "unknown transaction")
+		}
+		return id, false, nil
+	}
+	return "", false, nil
+}
+
+func (f *fakeServer) beginTxn() string {
+	f.txnSeq++
+	id := "txn-" + strconv.Itoa(f.txnSeq)
+	f.txns[id] = map[string]int64{}
+	return id
+}
+
+func (f *fakeServer) Lookup(_ context.Context, req *datastorepb.LookupRequest) (*datastorepb.LookupResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	txn, begun, err := f.readTxn(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	resp := &datastorepb.LookupResponse{}
+	if begun {
+		resp.Transaction = []byte(txn)
+	}
+	for _, key := range req.Keys {
+		k := keyString(key)
+		if txn != "" {
+			f.txns[txn][k] = f.versions[req.ProjectId+"/"+k]
+		}
+		if e, ok := f.entities(req.ProjectId)[k]; ok {
+			resp.Found = append(resp.Found, &datastorepb.EntityResult{Entity: proto.Clone(e.entity).(*datastorepb.Entity), Version: e.version})
+		} else {
+			resp.Missing = append(resp.Missing, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: key}, Version: f.version})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeServer) RunQuery(_ context.Context, req *datastorepb.RunQueryRequest) (*datastorepb.RunQueryResponse, error) {
+	q := req.GetQuery()
+	if q == nil {
+		return nil, status.Error(codes.Unimplemented, "only structured queries are supported")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	txn, begun, err := f.readTxn(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkIndex(q); err != nil {
+		return nil, err
+	}
+	namespace := req.GetPartitionId().GetNamespaceId()
+	kind := ""
+	if len(q.Kind) > 0 {
+		kind = q.Kind[0].Name
+	}
+	var results []*datastorepb.Entity
+	switch kind {
+	case "__namespace__":
+		results = f.namespaces(req.ProjectId)
+	case "__kind__":
+		results = f.kinds(req.ProjectId, namespace)
+	default:
+		for _, k := range f.sortedKeys(req.ProjectId) {
+			e := f.projects[req.ProjectId][k].entity
+			if e.Key.GetPartitionId().GetNamespaceId() != namespace || (kind != "" && kindOf(e.Key) != kind) {
+				continue
+			}
+			ok, err := matches(e, q.Filter)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				results = append(results, e)
+			}
+		}
+	}
+	sortEntities(results, q.Order)
+	skipped := min(int(q.Offset), len(results))
+	results = results[skipped:]
+	if q.Limit != nil && int(q.Limit.Value) < len(results) {
+		results = results[:q.Limit.Value]
+	}
+	keysOnly := len(q.Projection) > 0 && q.Projection[0].GetProperty().GetName() == "__key__"
+	batch := &datastorepb.QueryResultBatch{
+		SkippedResults:   int32(skipped),
+		EntityResultType: datastorepb.EntityResult_FULL,
+		EndCursor:        []byte("end"),
+		MoreResults:      datastorepb.QueryResultBatch_NO_MORE_RESULTS,
+	}
+	if keysOnly {
+		batch.EntityResultType = datastorepb.EntityResult_KEY_ONLY
+	}
+	for _, e := range results {
+		if txn != "" {
+			f.txns[txn][keyString(e.Key)] = f.versions[req.ProjectId+"/"+keyString(e.Key)]
+		}
+		e = proto.Clone(e).(*datastorepb.Entity)
+		if keysOnly {
+			e.Properties = nil
+		}
+		batch.EntityResults = append(batch.EntityResults, &datastorepb.EntityResult{Entity: e, Version: f.version})
+	}
+	resp := &datastorepb.RunQueryResponse{Batch: batch, Query: q}
+	if begun {
+		resp.Transaction = []byte(txn)
+	}
+	return resp, nil
+}
+
+// namespaces returns the __namespace__ entities of the project.
+func (f *fakeServer) namespaces(project string) []*datastorepb.Entity {
+	seen := map[string]bool{}
+	var results []*datastorepb.Entity
+	for _, k := range f.sortedKeys(project) {
+		ns := f.projects[project][k].entity.Key.GetPartitionId().GetNamespaceId()
+		if seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		el := &datastorepb.Key_PathElement{Kind: "__namespace__", IdType: &datastorepb.Key_PathElement_Name{Name: ns}}
+		if ns == "" {
+			el.IdType = &datastorepb.Key_PathElement_Id{Id: 1}
+		}
+		results = append(results, &datastorepb.Entity{Key: &datastorepb.Key{
+			PartitionId: &datastorepb.PartitionId{ProjectId: project},
+			Path:        []*datastorepb.Key_PathElement{el},
+		}})
+	}
+	return results
+}
+
+// kinds returns the __kind__ entities of the namespace.
+func (f *fakeServer) kinds(project, namespace string) []*datastorepb.Entity {
+	seen := map[string]bool{}
+	var results []*datastorepb.Entity
+	for _, k := range f.sortedKeys(project) {
+		key := f.projects[project][k].entity.Key
+		kind := kindOf(key)
+		if key.GetPartitionId().GetNamespaceId() != namespace || seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		results = append(results, &datastorepb.Entity{Key: &datastorepb.Key{
+			PartitionId: &datastorepb.PartitionId{ProjectId: project, NamespaceId: namespace},
+			Path:        []*datastorepb.Key_PathElement{{Kind: "__kind__", IdType: &datastorepb.Key_PathElement_Name{Name: kind}}},
+		}})
+	}
+	return results
+}
+
+// checkIndex fails the queries needing an undeclared composite index, i.e.
+// the sorted queries involving several properties, if the indexes are
+// required.
+func (f *fakeServer) checkIndex(q *datastorepb.Query) error {
+	if f.cfg.indexFile == "" || len(q.Order) == 0 {
+		return nil
+	}
+	props := map[string]bool{}
+	filterProperties(q.Filter, props)
+	for _, o := range q.Order {
+		props[o.GetProperty().GetName()] = true
+	}
+	delete(props, "__key__")
+	if len(props) < 2 {
+		return nil
+	}
+	data, err := os.ReadFile(f.cfg.indexFile)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	var config struct {
+		Indexes []struct {
+			Kind       string
+			Properties []struct{ Name string }
+		}
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	kind := ""
+	if len(q.Kind) > 0 {
+		kind = q.Kind[0].Name
+	}
+	for _, index := range config.Indexes {
+		if index.Kind != kind || len(index.Properties) != len(props) {
+			continue
+		}
+		declared := true
+		for _, p := range index.Properties {
+			declared = declared && props[p.Name]
+		}
+		if declared {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "no matching index found for kind %s", kind)
+}
+
+func filterProperties(filter *datastorepb.Filter, props map[string]bool) {
+	if cf := filter.GetCompositeFilter(); cf != nil {
+		for _, f := range cf.Filters {
+			filterProperties(f, props)
+		}
+	}
+	if pf := filter.GetPropertyFilter(); pf != nil {
+		props[pf.GetProperty().GetName()] = true
+	}
+}
+
+// matches reports whether the entity matches the filter.
+func matches(e *datastorepb.Entity, filter *datastorepb.Filter) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	if cf := filter.GetCompositeFilter(); cf != nil {
+		for _, sub := range cf.Filters {
+			ok, err := matches(e, sub)
+			if err != nil {
+				return false, err
+			}
+			if ok == (cf.Op == datastorepb.CompositeFilter_OR) {
+				return ok, nil
+			}
+		}
+		return cf.Op != datastorepb.CompositeFilter_OR, nil
+	}
+	pf := filter.GetPropertyFilter()
+	name := pf.GetProperty().GetName()
+	var v *datastorepb.Value
+	if name == "__key__" {
+		v = &datastorepb.Value{ValueType: &datastorepb.Value_KeyValue{KeyValue: e.Key}}
+	} else if v = e.Properties[name]; v == nil {
+		return false, nil
+	}
+	values := []*datastorepb.Value{v}
+	if arr := v.GetArrayValue(); arr != nil {
+		values = arr.Values
+	}
+	for _, v := range values {
+		ok, err := compareOp(v, pf.Op, pf.Value)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func compareOp(v *datastorepb.Value, op datastorepb.PropertyFilter_Operator, want *datastorepb.Value) (bool, error) {
+	switch op {
+	case datastorepb.PropertyFilter_IN, datastorepb.PropertyFilter_NOT_IN:
+		in := false
+		for _, w := range want.GetArrayValue().GetValues() {
+			in = in || compareValues(v, w) == 0
+		}
+		return in == (op == datastorepb.PropertyFilter_IN), nil
+	}
+	c := compareValues(v, want)
+	switch op {
+	case datastorepb.PropertyFilter_EQUAL:
+		return c == 0, nil
+	case datastorepb.PropertyFilter_NOT_EQUAL:
+		return c != 0, nil
+	case datastorepb.PropertyFilter_LESS_THAN:
+		return c < 0, nil
+	case datastorepb.PropertyFilter_LESS_THAN_OR_EQUAL:
+		return c <= 0, nil
+	case datastorepb.PropertyFilter_GREATER_THAN:
+		return c > 0, nil
+	case datastorepb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+		return c >= 0, nil
+	}
+	return false, status.Errorf(codes.Unimplemented, "unsupported operator %v", op)
+}
+
+// compareValues compares two values of the same type, the values of
+// different types being ordered by type.
+func compareValues(a, b *datastorepb.Value) int {
+	switch av := a.ValueType.(type) {
+	case *datastorepb.Value_IntegerValue:
+		switch bv := b.ValueType.(type) {
+		case *datastorepb.Value_IntegerValue:
+			return cmpOrdered(av.IntegerValue, bv.IntegerValue)
+		case *datastorepb.Value_DoubleValue:
+			return cmpOrdered(float64(av.IntegerValue), bv.DoubleValue)
+		}
+	case *datastorepb.Value_DoubleValue:
+		switch bv := b.ValueType.(type) {
+		case *datastorepb.Value_IntegerValue:
+			return cmpOrdered(av.DoubleValue, float64(bv.IntegerValue))
+		case *datastorepb.Value_DoubleValue:
+			return cmpOrdered(av.DoubleValue, bv.DoubleValue)
+		}
+	case *datastorepb.Value_StringValue:
+		if bv, ok := b.ValueType.(*datastorepb.Value_StringValue); ok {
+			return strings.Compare(av.StringValue, bv.StringValue)
+		}
+	case *datastorepb.Value_BooleanValue:
+		if bv, ok := b.ValueType.(*datastorepb.Value_BooleanValue); ok {
+			return cmpOrdered(boolInt(av.BooleanValue), boolInt(bv.BooleanValue))
+		}
+	case *datastorepb.Value_TimestampValue:
+		if bv, ok := b.ValueType.(*datastorepb.Value_TimestampValue); ok {
+			return av.TimestampValue.AsTime().Compare(bv.TimestampValue.AsTime())
+		}
+	case *datastorepb.Value_KeyValue:
+		if bv, ok := b.ValueType.(*datastorepb.Value_KeyValue); ok {
+			return strings.Compare(keyString(av.KeyValue), keyString(bv.KeyValue))
+		}
+	case *datastorepb.Value_NullValue:
+		if _, ok := b.ValueType.(*datastorepb.Value_NullValue); ok {
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%T", a.ValueType), fmt.Sprintf("%T", b.ValueType))
+}
+
+func cmpOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortEntities(entities []*datastorepb.Entity, orders []*datastorepb.PropertyOrder) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		for _, o := range orders {
+			name := o.GetProperty().GetName()
+			a, b := entities[i].Properties[name], entities[j].Properties[name]
+			if name == "__key__" {
+				a = &datastorepb.Value{ValueType: &datastorepb.Value_KeyValue{KeyValue: entities[i].Key}}
+				b = &datastorepb.Value{ValueType: &datastorepb.Value_KeyValue{KeyValue: entities[j].Key}}
+			}
+			if a == nil || b == nil {
+				continue
+			}
+			c := compareValues(a, b)
+			if o.Direction == datastorepb.PropertyOrder_DESCENDING {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+func (f *fakeServer) BeginTransaction(context.Context, *datastorepb.BeginTransactionRequest) (*datastorepb.BeginTransactionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &datastorepb.BeginTransactionResponse{Transaction: []byte(f.beginTxn())}, nil
+}
+
+func (f *fakeServer) Rollback(_ context.Context, req *datastorepb.RollbackRequest) (*datastorepb.RollbackResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.txns, string(req.Transaction))
+	return &datastorepb.RollbackResponse{}, nil
+}
+
+// Commit applies the mutations, failing the transactions which read entities
+// modified since with Aborted, like the emulator does.
+func (f *fakeServer) Commit(_ context.Context, req *datastorepb.CommitRequest) (*datastorepb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id := req.GetTransaction(); id != nil {
+		reads, ok := f.txns[string(id)]
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "unknown transaction")
+		}
+		delete(f.txns, string(id))
+		for k, v := range reads {
+			if f.versions[req.ProjectId+"/"+k] != v {
+				return nil, status.Error(codes.Aborted, "too much contention on these datastore entities")
+			}
+		}
+	}
+	entities := f.entities(req.ProjectId)
+	for _, m := range req.Mutations {
+		switch op := m.Operation.(type) {
+		case *datastorepb.Mutation_Insert:
+			if _, ok := entities[keyString(op.Insert.Key)]; ok && !isIncomplete(op.Insert.Key) {
+				return nil, status.Error(codes.AlreadyExists, "entity already exists")
+			}
+		case *datastorepb.Mutation_Update:
+			if _, ok := entities[keyString(op.Update.Key)]; !ok {
+				return nil, status.Error(codes.NotFound, "no entity to update")
+			}
+		}
+	}
+	resp := &datastorepb.CommitResponse{}
+	for _, m := range req.Mutations {
+		var entity *datastorepb.Entity
+		switch op := m.Operation.(type) {
+		case *datastorepb.Mutation_Insert:
+			entity = op.Insert
+		case *datastorepb.Mutation_Update:
+			entity = op.Update
+		case *datastorepb.Mutation_Upsert:
+			entity = op.Upsert
+		case *datastorepb.Mutation_Delete:
+			v := f.remove(req.ProjectId, op.Delete)
+			resp.MutationResults = append(resp.MutationResults, &datastorepb.MutationResult{Version: v})
+			continue
+		default:
+			return nil, status.Errorf(codes.Unimplemented, "unsupported mutation %T", op)
+		}
+		result := &datastorepb.MutationResult{}
+		if isIncomplete(entity.Key) {
+			entity = proto.Clone(entity).(*datastorepb.Entity)
+			f.allocate(entity.Key)
+			result.Key = entity.Key
+		}
+		result.Version = f.put(req.ProjectId, entity)
+		resp.MutationResults = append(resp.MutationResults, result)
+	}
+	return resp, nil
+}
+
+// allocate completes the incomplete key with a new ID.
+func (f *fakeServer) allocate(key *datastorepb.Key) {
+	f.nextID++
+	key.Path[len(key.Path)-1].IdType = &datastorepb.Key_PathElement_Id{Id: f.nextID}
+}
+
+func (f *fakeServer) AllocateIds(_ context.Context, req *datastorepb.AllocateIdsRequest) (*datastorepb.AllocateIdsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &datastorepb.AllocateIdsResponse{}
+	for _, key := range req.Keys {
+		if !isIncomplete(key) {
+			return nil, status.Error(codes.InvalidArgument, "key is complete")
+		}
+		key = proto.Clone(key).(*datastorepb.Key)
+		f.allocate(key)
+		resp.Keys = append(resp.Keys, key)
+	}
+	return resp, nil
+}
+
+func (f *fakeServer) ReserveIds(context.Context, *datastorepb.ReserveIdsRequest) (*datastorepb.ReserveIdsResponse, error) {
+	return &datastorepb.ReserveIdsResponse{}, nil
+}
+
+// written returns the keys (see keyString) of the entities ever written or
+// deleted in the project, deleted ones included.
+func (f *fakeServer) written(project string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.versions {
+		if rest, ok := strings.CutPrefix(k, project+"/"); ok {
+			keys = append(keys, rest)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,103 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Group is a set of emulators started and closed together, e.g. for a test
+// matrix, see NewGroup.
+type Group struct {
+	emulators []*Emulator
+	byName    map[string]*Emulator
+}
+
+// NewGroup starts an emulator per config in parallel and returns them as a
+// Group. Only the ProjectID and Endpoint of the configs are used: each
+// emulator gets the project, which must be unique within the group and is
+// also its name (see WithName), and listens on the endpoint, or on a random
+// port if it's empty. The options are applied to all the emulators after the
+// ones derived from the configs.
+//
+// The emulators of a group can't share the environment variables, so none are
+// managed (see WithManagedEnvVars) and the clients should be built with the
+// Client method of each emulator. For the same reason, they refuse to reuse a
+// running emulator (see WithNoReuse). If any of the emulators fails to start,
+// the started ones are closed.
+func NewGroup(configs []Config, opts ...Option) (*Group, error) {
+	g := &Group{
+		emulators: make([]*Emulator, len(configs)),
+		byName:    make(map[string]*Emulator, len(configs)),
+	}
+	groupOpts := make([][]Option, len(configs))
+	for i, c := range configs {
+		if c.ProjectID == "" {
+			return nil, fmt.Errorf("config %d: project must not be empty", i)
+		}
+		if _, ok := g.byName[c.ProjectID]; ok {
+			return nil, fmt.Errorf("config %d: duplicate project %s", i, c.ProjectID)
+		}
+		g.byName[c.ProjectID] = nil
+		port := WithRandomPort()
+		if c.Endpoint != "" {
+			port = WithHostPort(c.Endpoint)
+		}
+		groupOpts[i] = append([]Option{port, WithProject(c.ProjectID), WithName(c.ProjectID), WithManagedEnvVars(), WithNoReuse()}, opts...)
+	}
+	errs := make([]error, len(configs))
+	var wg sync.WaitGroup
+	for i := range configs {
+		wg.Go(func() {
+			g.emulators[i], errs[i] = New(groupOpts[i]...)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("emulator %s: %w", configs[i].ProjectID, errs[i])
+			}
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, errors.Join(err, g.Close())
+	}
+	for i, c := range configs {
+		g.byName[c.ProjectID] = g.emulators[i]
+	}
+	return g, nil
+}
+
+// Get returns the emulator started for the config at index i, or nil if
+// there is no such config.
+func (g *Group) Get(i int) *Emulator {
+	if i < 0 || i >= len(g.emulators) {
+		return nil
+	}
+	return g.emulators[i]
+}
+
+// Named returns the emulator with the project ID, or nil if there is no such
+// emulator in the group.
+func (g *Group) Named(projectID string) *Emulator {
+	return g.byName[projectID]
+}
+
+// Len returns the number of emulators in the group.
+func (g *Group) Len() int {
+	return len(g.emulators)
+}
+
+// Close closes all the emulators of the group in parallel and returns their
+// joined errors.
+func (g *Group) Close() error {
+	errs := make([]error, len(g.emulators))
+	var wg sync.WaitGroup
+	for i, e := range g.emulators {
+		if e == nil {
+			continue
+		}
+		wg.Go(func() {
+			errs[i] = e.Close()
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+package emulator
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestNewGroup(t *testing.T) {
+	t.Setenv("DATASTORE_EMULATOR_HOST", "outside:8081")
+	g, err := NewGroup([]Config{{ProjectID: "one"}, {ProjectID: "two"}, {ProjectID: "three"}}, fakeGcloud()...)
+	if err != nil {
+		t.Fatalf("NewGroup() error = %v", err)
+	}
+	t.Cleanup(func() { _ = g.Close() })
+	if g.Len() != 3 || g.Get(-1) != nil || g.Get(3) != nil || g.Named("four") != nil {
+		t.Errorf("Len() = %d, want 3 and nil for the unknown emulators", g.Len())
+	}
+	ctx := context.Background()
+	addrs := map[string]bool{}
+	for i := range g.Len() {
+		e := g.Get(i)
+		if e != g.Named(e.ProjectID) || e.Name() != e.ProjectID {
+			t.Errorf("Get(%d) = %s, Named(%s) = %v, want the same emulator", i, e.ProjectID, e.ProjectID, g.Named(e.ProjectID))
+		}
+		addrs[e.addr] = true
+		putEntities(t, e, "Kind", "", i+1)
+	}
+	if len(addrs) != 3 {
+		t.Errorf("the emulators listen on %v, want 3 distinct host-ports", addrs)
+	}
+	for i, project := range []string{"one", "two", "three"} {
+		if n, err := g.Named(project).Count(ctx, "Kind", ""); err != nil || n != i+1 {
+			t.Errorf("Count() of %s = %d, %v, want %d", project, n, err, i+1)
+		}
+	}
+	if got := os.Getenv("DATASTORE_EMULATOR_HOST"); got != "outside:8081" {
+		t.Errorf("DATASTORE_EMULATOR_HOST = %q, want the group to leave it alone", got)
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	for i := range g.Len() {
+		if got := g.Get(i).State(); got != StateClosed {
+			t.Errorf("State() of %s after Close = %v, want %v", g.Get(i).ProjectID, got, StateClosed)
+		}
+	}
+
+	for _, configs := range [][]Config{{{ProjectID: ""}}, {{ProjectID: "a"}, {ProjectID: "a"}}} {
+		if _, err := NewGroup(configs, fakeGcloud()...); err == nil {
+			t.Errorf("NewGroup(%+v) error = nil", configs)
+		}
+	}
+	if _, err := NewGroup([]Config{{ProjectID: "a"}, {ProjectID: "b"}}, fakeGcloud("FAKE_FAIL=exit")...); err == nil {
+		t.Error("NewGroup() with failing emulators error = nil")
+	}
+}
@@ -0,0 +1,84 @@
+package emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPCEndpoint returns the host:port of the emulator gRPC endpoint, without
+// the scheme.
+func (e *Emulator) GRPCEndpoint() string {
+	if u, err := url.Parse(e.Host); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.TrimPrefix(e.Host, e.scheme+"://")
+}
+
+// GRPCDialOptions returns the options needed to dial the emulator gRPC
+// endpoint, i.e. the transport credentials (insecure unless the scheme is
+// https) and the custom dialer set with WithGRPCDialer, if any.
+//
+//	conn, err := grpc.Dial(e.GRPCEndpoint(), e.GRPCDialOptions()...)
+func (e *Emulator) GRPCDialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(e.transportCredentials()),
+	}
+	if e.grpcDialer != nil {
+		opts = append(opts, grpc.WithContextDialer(e.grpcDialer))
+	}
+	return opts
+}
+
+// transportCredentials returns the gRPC transport credentials matching the
+// scheme of the emulator.
+func (e *Emulator) transportCredentials() credentials.TransportCredentials {
+	if e.scheme != "https" {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(e.tlsClientConfig())
+}
+
+// tlsClientConfig returns the TLS config set with WithTLSConfig, or the
+// default one.
+func (e *Emulator) tlsClientConfig() *tls.Config {
+	if e.tlsConfig == nil {
+		return &tls.Config{}
+	}
+	return e.tlsConfig.Clone()
+}
+
+// grpcProbe checks the health of the emulator with the gRPC health service.
+func (e *Emulator) grpcProbe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pollingRate)
+	defer cancel()
+	addr := e.addr
+	if addr == "" {
+		addr = e.GRPCEndpoint()
+	}
+	opts := e.GRPCDialOptions()
+	if e.unixSocket != "" {
+		// the socket is only forwarded once the startup is confirmed
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(e.transportCredentials())}
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return classifyError(err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("gRPC health status: %s", resp.GetStatus())
+	}
+	return nil
+}
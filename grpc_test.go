@@ -0,0 +1,88 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCEndpoint(t *testing.T) {
+	for host, want := range map[string]string{
+		"http://localhost:8081":  "localhost:8081",
+		"https://localhost:8081": "localhost:8081",
+		"http://[::1]:8081":      "[::1]:8081",
+	} {
+		e := &Emulator{Host: host}
+		e.init()
+		if got := e.GRPCEndpoint(); got != want {
+			t.Errorf("GRPCEndpoint() with Host %q = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestGRPCDialOptions(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	conn, err := grpc.NewClient(e.GRPCEndpoint(), e.GRPCDialOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = datastorepb.NewDatastoreClient(conn).Lookup(context.Background(), &datastorepb.LookupRequest{
+		ProjectId: e.ProjectID,
+		Keys: []*datastorepb.Key{{Path: []*datastorepb.Key_PathElement{
+			{Kind: "Kind", IdType: &datastorepb.Key_PathElement_Name{Name: "a"}},
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if n := f.rpcCount("Lookup"); n != 1 {
+		t.Errorf("the emulator received %d Lookup calls, want 1", n)
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	t.Run("probe", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := grpc.NewServer()
+		hs := health.NewServer()
+		healthpb.RegisterHealthServer(srv, hs)
+		go srv.Serve(l)
+		defer srv.Stop()
+
+		e := &Emulator{Host: "http://" + l.Addr().String()}
+		e.init()
+		if err := WithGRPCHealthCheck()(e); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.probe(); err != nil {
+			t.Errorf("probe() of a serving gRPC server error = %v", err)
+		}
+		hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		if err := e.probe(); err == nil {
+			t.Error("probe() of a not serving gRPC server error = nil")
+		}
+	})
+
+	t.Run("no HTTP", func(t *testing.T) {
+		e, f := newAdoptingEmulator(t, fakeConfig{}, WithGRPCHealthCheck())
+		putEntities(t, e, "Kind", "", 3)
+		if err := e.Reset(); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		if n, err := e.Count(context.Background(), "Kind", ""); err != nil || n != 0 {
+			t.Errorf("Count() after Reset = %d, %v, want 0", n, err)
+		}
+		if checks, resets, _ := f.stats(); checks != 0 || resets != 0 {
+			t.Errorf("the emulator got %d HTTP health checks and %d resets, want none", checks, resets)
+		}
+	})
+}
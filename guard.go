@@ -0,0 +1,77 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// IsEmulator reports whether the Emulator is confirmed to talk to an emulator
+// rather than to the production Datastore. The address the Emulator dials,
+// which may differ from the advertised Host, must resolve to loopback
+// addresses, and the DATASTORE_EMULATOR_HOST environment variable must be
+// set. The exceptions are:
+//
+//   - a reused emulator doesn't require the variable, as it may have been
+//     found through DATASTORE_HOST or the gcloud configuration instead;
+//   - neither does an Emulator which doesn't manage it, see
+//     WithManagedEnvVars;
+//   - a non-loopback address is accepted if it answers the health check of
+//     the emulator, which the production Datastore doesn't serve, e.g. for an
+//     emulator running in another container.
+func (e *Emulator) IsEmulator(ctx context.Context) (bool, error) {
+	if !e.started() {
+		return false, ErrNotStarted
+	}
+	if _, managed := e.managedEnv("")["DATASTORE_EMULATOR_HOST"]; managed && !e.reused && os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		return false, nil
+	}
+	u, err := url.Parse(e.localURL())
+	if err != nil {
+		return false, fmt.Errorf("parse endpoint: %w", err)
+	}
+	loopback, err := isLoopback(ctx, u.Hostname())
+	if err != nil {
+		return false, err
+	}
+	if loopback {
+		return true, nil
+	}
+	return e.probeOnce() == nil, nil
+}
+
+// checkEmulator returns ErrNotEmulator unless IsEmulator confirms that the
+// Emulator talks to an emulator.
+func (e *Emulator) checkEmulator(ctx context.Context) error {
+	ok, err := e.IsEmulator(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotEmulator, err)
+	}
+	if !ok {
+		return ErrNotEmulator
+	}
+	return nil
+}
+
+// isLoopback reports whether all the addresses host resolves to are loopback
+// addresses.
+func isLoopback(ctx context.Context, host string) (bool, error) {
+	if host == "localhost" {
+		return true, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback(), nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	for _, a := range addrs {
+		if !a.IP.IsLoopback() {
+			return false, nil
+		}
+	}
+	return len(addrs) > 0, nil
+}
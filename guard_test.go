@@ -0,0 +1,68 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestIsEmulator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("emulator", func(t *testing.T) {
+		e := newFakeEmulator(t, nil)
+		if ok, err := e.IsEmulator(ctx); err != nil || !ok {
+			t.Errorf("IsEmulator() = %v, %v, want true", ok, err)
+		}
+		if err := e.ResetKinds(ctx, "Kind"); err != nil {
+			t.Errorf("ResetKinds() error = %v", err)
+		}
+	})
+
+	t.Run("unset environment", func(t *testing.T) {
+		e := newFakeEmulator(t, nil)
+		t.Setenv("DATASTORE_EMULATOR_HOST", "")
+		os.Unsetenv("DATASTORE_EMULATOR_HOST")
+		if ok, err := e.IsEmulator(ctx); err != nil || ok {
+			t.Errorf("IsEmulator() without DATASTORE_EMULATOR_HOST = %v, %v, want false", ok, err)
+		}
+		for name, call := range map[string]func() error{
+			"Reset":      e.Reset,
+			"ResetKinds": func() error { return e.ResetKinds(ctx, "Kind") },
+			"DeleteAll":  func() error { return e.DeleteAll(ctx) },
+		} {
+			if err := call(); !errors.Is(err, ErrNotEmulator) {
+				t.Errorf("%s() error = %v, want ErrNotEmulator", name, err)
+			}
+		}
+	})
+
+	t.Run("remote endpoint", func(t *testing.T) {
+		// a non-loopback address which doesn't answer the health check
+		e := applyOptions(t)
+		e.Host, e.reused = "http://192.0.2.1:8081", true
+		if ok, err := e.IsEmulator(ctx); err != nil || ok {
+			t.Errorf("IsEmulator() of a remote endpoint = %v, %v, want false", ok, err)
+		}
+		if err := e.DeleteAll(ctx); !errors.Is(err, ErrNotEmulator) {
+			t.Errorf("DeleteAll() error = %v, want ErrNotEmulator", err)
+		}
+	})
+
+	t.Run("remote dialed address", func(t *testing.T) {
+		// the advertised host is a loopback one, not the address dialed
+		e := applyOptions(t)
+		e.Host, e.addr = "http://localhost:8081", "192.0.2.1:8081"
+		t.Setenv("DATASTORE_EMULATOR_HOST", "localhost:8081")
+		if ok, err := e.IsEmulator(ctx); err != nil || ok {
+			t.Errorf("IsEmulator() dialing a remote address = %v, %v, want false", ok, err)
+		}
+	})
+
+	for host, want := range map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true, "192.0.2.1": false} {
+		if got, err := isLoopback(ctx, host); err != nil || got != want {
+			t.Errorf("isLoopback(%q) = %v, %v, want %v", host, got, err, want)
+		}
+	}
+}
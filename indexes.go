@@ -0,0 +1,85 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MissingIndexError is returned by CheckIndexes when some of the queries need
+// a composite index which is not declared.
+type MissingIndexError struct {
+	// Failures are the failed queries, in the order they were given.
+	Failures []IndexFailure
+}
+
+// IndexFailure is a query failed for the lack of a composite index.
+type IndexFailure struct {
+	// Index is the position of the query among the checked ones.
+	Index int
+	// Query is the failed query.
+	Query *datastore.Query
+	// Err is the error returned by the emulator, describing the index.
+	Err error
+}
+
+func (e *MissingIndexError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d queries need a missing index:", len(e.Failures))
+	for _, f := range e.Failures {
+		fmt.Fprintf(&b, "\n\tquery %d: %v", f.Index, f.Err)
+	}
+	return b.String()
+}
+
+// CheckIndexes runs each query (limited to a single result) against the
+// emulator requiring the composite indexes (see WithRequireIndexes) and
+// returns a MissingIndexError listing the queries which need an undeclared
+// index, which turns the index requirements of the code into an explicit
+// test. Other errors are returned as they happen.
+func (e *Emulator) CheckIndexes(ctx context.Context, queries ...*datastore.Query) error {
+	if !e.RequireIndexes() {
+		return errors.New("check indexes: the emulator doesn't require indexes, see WithRequireIndexes")
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	var missing MissingIndexError
+	for i, q := range queries {
+		err := runOnce(ctx, c, q)
+		switch {
+		case err == nil:
+		case isMissingIndex(err):
+			missing.Failures = append(missing.Failures, IndexFailure{Index: i, Query: q, Err: err})
+		default:
+			return fmt.Errorf("query %d: %w", i, err)
+		}
+	}
+	if len(missing.Failures) > 0 {
+		return &missing
+	}
+	return nil
+}
+
+// runOnce runs the query fetching at most one result.
+func runOnce(ctx context.Context, c *datastore.Client, q *datastore.Query) error {
+	var entity datastore.PropertyList
+	_, err := c.Run(ctx, q.Limit(1)).Next(&entity)
+	if errors.Is(err, iterator.Done) {
+		return nil
+	}
+	return err
+}
+
+// isMissingIndex reports whether the query error is caused by a missing
+// composite index.
+func isMissingIndex(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition && strings.Contains(strings.ToLower(err.Error()), "index")
+}
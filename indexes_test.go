@@ -0,0 +1,47 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestCheckIndexes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "index.yaml")
+	index := "indexes:\n- kind: Kind\n  properties:\n  - name: A\n  - name: B\n"
+	if err := os.WriteFile(file, []byte(index), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := newFakeEmulator(t, nil, WithRequireIndexes(file))
+	ctx := context.Background()
+	queries := []*datastore.Query{
+		datastore.NewQuery("Kind"),
+		datastore.NewQuery("Kind").FilterField("A", "=", 1).Order("B"),
+		datastore.NewQuery("Kind").FilterField("A", "=", 1).Order("C"),
+		datastore.NewQuery("Kind").FilterField("B", "=", 1).Order("C"),
+	}
+	if err := e.CheckIndexes(ctx, queries[:2]...); err != nil {
+		t.Errorf("CheckIndexes() of the declared queries error = %v", err)
+	}
+	err := e.CheckIndexes(ctx, queries...)
+	var missing *MissingIndexError
+	if !errors.As(err, &missing) {
+		t.Fatalf("CheckIndexes() error = %v, want a MissingIndexError", err)
+	}
+	if len(missing.Failures) != 2 || missing.Failures[0].Index != 2 || missing.Failures[1].Index != 3 || missing.Failures[0].Query != queries[2] {
+		t.Errorf("Failures = %+v, want the queries 2 and 3", missing.Failures)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "2 queries need a missing index") || !strings.Contains(msg, "query 3:") {
+		t.Errorf("Error() = %q, want the failed queries listed", msg)
+	}
+
+	plain := newFakeEmulator(t, nil)
+	if err := plain.CheckIndexes(ctx, queries...); err == nil || errors.As(err, &missing) {
+		t.Errorf("CheckIndexes() without WithRequireIndexes error = %v, want the misconfiguration", err)
+	}
+}
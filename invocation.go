@@ -0,0 +1,51 @@
+package emulator
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// secretEnvPatterns are the fragments of the names of the environment
+// variables which are redacted by Invocation.
+var secretEnvPatterns = []string{
+	"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "PRIVATE", "API_KEY", "ACCESS_KEY", "AUTH",
+}
+
+// Invocation describes the command used to start the emulator.
+type Invocation struct {
+	Path string
+	Args []string
+	// Env is the environment of the command, with the values of the variables
+	// which look like they hold secrets redacted.
+	Env []string
+}
+
+// Invocation returns the command used to start the emulator, which helps to
+// reproduce its behavior outside of the tests.
+func (e *Emulator) Invocation() Invocation {
+	inv := Invocation{
+		Path: e.invocation.Path,
+		Args: append([]string(nil), e.invocation.Args...),
+	}
+	for _, kv := range e.invocation.Env {
+		inv.Env = append(inv.Env, redactEnv(kv))
+	}
+	return inv
+}
+
+func newInvocation(cmd *exec.Cmd) Invocation {
+	return Invocation{Path: cmd.Path, Args: cmd.Args, Env: cmd.Env}
+}
+
+// redactEnv redacts the value of the "key=value" environment variable if the
+// key looks like it names a secret.
+func redactEnv(kv string) string {
+	k, _, _ := strings.Cut(kv, "=")
+	upper := strings.ToUpper(k)
+	for _, p := range secretEnvPatterns {
+		if strings.Contains(upper, p) {
+			return k + "=REDACTED"
+		}
+	}
+	return kv
+}
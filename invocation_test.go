@@ -0,0 +1,39 @@
+package emulator
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRedactEnv(t *testing.T) {
+	tests := []struct{ kv, want string }{
+		{kv: "API_TOKEN=abc", want: "API_TOKEN=REDACTED"},
+		{kv: "db_password=abc", want: "db_password=REDACTED"},
+		{kv: "GOOGLE_APPLICATION_CREDENTIALS=/key.json", want: "GOOGLE_APPLICATION_CREDENTIALS=REDACTED"},
+		{kv: "AWS_SECRET_ACCESS_KEY=abc", want: "AWS_SECRET_ACCESS_KEY=REDACTED"},
+		{kv: "HOME=/root", want: "HOME=/root"},
+		{kv: "EMPTY", want: "EMPTY"},
+	}
+	for _, tt := range tests {
+		if got := redactEnv(tt.kv); got != tt.want {
+			t.Errorf("redactEnv(%q) = %q, want %q", tt.kv, got, tt.want)
+		}
+	}
+}
+
+func TestInvocation(t *testing.T) {
+	var out syncBuffer
+	e := newFakeEmulator(t, []string{"MY_TOKEN=s3cret", "PLAIN=visible"}, WithLogger(log.New(&out, "", 0)))
+	inv := e.Invocation()
+	if !slices.Equal(inv.Args[1:], e.CommandArgs()[1:]) {
+		t.Errorf("Invocation().Args = %q, want %q", inv.Args, e.CommandArgs())
+	}
+	if !slices.Contains(inv.Env, "MY_TOKEN=REDACTED") || !slices.Contains(inv.Env, "PLAIN=visible") {
+		t.Errorf("Invocation().Env = %q, want MY_TOKEN redacted and PLAIN visible", inv.Env)
+	}
+	if logged := out.String(); !strings.Contains(logged, "MY_TOKEN=REDACTED") || strings.Contains(logged, "s3cret") {
+		t.Errorf("the logged invocation %q, want the secret redacted", logged)
+	}
+}
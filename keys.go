@@ -0,0 +1,96 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KeyBuilder builds datastore keys in a namespace. Child keys are put in the
+// namespace of their parent.
+type KeyBuilder struct {
+	Namespace string
+}
+
+// Name is like datastore.NameKey, but it puts the key in the namespace of the
+// builder.
+func (b KeyBuilder) Name(kind, name string, parent *datastore.Key) *datastore.Key {
+	k := datastore.NameKey(kind, name, parent)
+	k.Namespace = b.namespaceOf(parent)
+	return k
+}
+
+// ID is like datastore.IDKey, but it puts the key in the namespace of the
+// builder.
+func (b KeyBuilder) ID(kind string, id int64, parent *datastore.Key) *datastore.Key {
+	k := datastore.IDKey(kind, id, parent)
+	k.Namespace = b.namespaceOf(parent)
+	return k
+}
+
+// Incomplete is like datastore.IncompleteKey, but it puts the key in the
+// namespace of the builder.
+func (b KeyBuilder) Incomplete(kind string, parent *datastore.Key) *datastore.Key {
+	k := datastore.IncompleteKey(kind, parent)
+	k.Namespace = b.namespaceOf(parent)
+	return k
+}
+
+func (b KeyBuilder) namespaceOf(parent *datastore.Key) string {
+	if parent != nil {
+		return parent.Namespace
+	}
+	return b.Namespace
+}
+
+// The key helpers below apply the namespace set with WithDefaultNamespace to
+// the keys they build. Keys built directly with the datastore package are not
+// affected, as the emulator has no notion of a default namespace.
+
+// Keys returns a KeyBuilder for the default namespace of the Emulator.
+func (e *Emulator) Keys() KeyBuilder {
+	return KeyBuilder{Namespace: e.namespace}
+}
+
+// NameKey is like datastore.NameKey, but it puts the key in the default
+// namespace of the Emulator.
+func (e *Emulator) NameKey(kind, name string, parent *datastore.Key) *datastore.Key {
+	return e.Keys().Name(kind, name, parent)
+}
+
+// IDKey is like datastore.IDKey, but it puts the key in the default namespace
+// of the Emulator.
+func (e *Emulator) IDKey(kind string, id int64, parent *datastore.Key) *datastore.Key {
+	return e.Keys().ID(kind, id, parent)
+}
+
+// IncompleteKey is like datastore.IncompleteKey, but it puts the key in the
+// default namespace of the Emulator.
+func (e *Emulator) IncompleteKey(kind string, parent *datastore.Key) *datastore.Key {
+	return e.Keys().Incomplete(kind, parent)
+}
+
+// Namespace returns the default namespace set with WithDefaultNamespace.
+func (e *Emulator) Namespace() string {
+	return e.namespace
+}
+
+// AllocateIDs allocates n IDs of the kind in the namespace, "" being the
+// default one, and returns the complete keys, to exercise the code relying
+// on server-allocated IDs.
+func (e *Emulator) AllocateIDs(ctx context.Context, kind, namespace string, n int) ([]*datastore.Key, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of IDs to allocate: %d", n)
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.IncompleteKey(kind, nil)
+		keys[i].Namespace = namespace
+	}
+	return c.AllocateIDs(ctx, keys)
+}
@@ -0,0 +1,88 @@
+package emulator
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestDefaultNamespace(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{}, WithDefaultNamespace("tenant"))
+	if e.Namespace() != "tenant" {
+		t.Errorf("Namespace() = %q, want tenant", e.Namespace())
+	}
+	other := datastore.NameKey("Parent", "p", nil)
+	other.Namespace = "other"
+	keys := map[string]*datastore.Key{
+		"NameKey":       e.NameKey("Kind", "a", nil),
+		"IDKey":         e.IDKey("Kind", 1, nil),
+		"IncompleteKey": e.IncompleteKey("Kind", nil),
+	}
+	for name, k := range keys {
+		if k.Namespace != "tenant" {
+			t.Errorf("%s() namespace = %q, want tenant", name, k.Namespace)
+		}
+	}
+	if k := e.NameKey("Kind", "child", other); k.Namespace != "other" {
+		t.Errorf("NameKey() with a parent namespace = %q, want the namespace of the parent", k.Namespace)
+	}
+
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	for _, k := range []*datastore.Key{keys["NameKey"], keys["IDKey"], datastore.NameKey("Kind", "default", nil)} {
+		if _, err := c.Put(ctx, k, &entity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []entity
+	if _, err := c.GetAll(ctx, datastore.NewQuery("Kind").Namespace("tenant"), &got); err != nil || len(got) != 2 {
+		t.Errorf("GetAll() of the namespace = %d entities, %v, want 2", len(got), err)
+	}
+	if keys, err := c.GetAll(ctx, datastore.NewQuery("Kind").KeysOnly(), nil); err != nil || len(keys) != 1 {
+		t.Errorf("GetAll() of the default namespace = %d keys, %v, want 1", len(keys), err)
+	}
+}
+
+func TestKeyBuilder(t *testing.T) {
+	b := KeyBuilder{Namespace: "ns"}
+	parent := b.Name("Parent", "p", nil)
+	tests := []struct {
+		key  *datastore.Key
+		want *datastore.Key
+	}{
+		{key: parent, want: &datastore.Key{Kind: "Parent", Name: "p", Namespace: "ns"}},
+		{key: b.ID("Kind", 7, nil), want: &datastore.Key{Kind: "Kind", ID: 7, Namespace: "ns"}},
+		{key: b.Incomplete("Kind", nil), want: &datastore.Key{Kind: "Kind", Namespace: "ns"}},
+		{key: KeyBuilder{}.Name("Kind", "c", parent), want: &datastore.Key{Kind: "Kind", Name: "c", Parent: parent, Namespace: "ns"}},
+	}
+	for _, tt := range tests {
+		if !tt.key.Equal(tt.want) {
+			t.Errorf("key = %v, want %v", tt.key, tt.want)
+		}
+	}
+}
+
+func TestAllocateIDs(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	keys, err := e.AllocateIDs(ctx, "Kind", "ns", 5)
+	if err != nil || len(keys) != 5 {
+		t.Fatalf("AllocateIDs() = %v, %v, want 5 keys", keys, err)
+	}
+	seen := map[int64]bool{}
+	for _, k := range keys {
+		if k.Incomplete() || k.Kind != "Kind" || k.Namespace != "ns" || seen[k.ID] {
+			t.Errorf("AllocateIDs() key %v, want a complete distinct key of Kind in ns", k)
+		}
+		seen[k.ID] = true
+	}
+	if _, err := e.AllocateIDs(ctx, "Kind", "", 0); err == nil {
+		t.Error("AllocateIDs() of 0 IDs error = nil")
+	}
+}
@@ -0,0 +1,38 @@
+package emulator
+
+import (
+	"log"
+	"runtime"
+)
+
+// watchLeak sets a finalizer warning about the emulator process being leaked
+// if the Emulator is garbage collected without being closed.
+//
+// Finalizers come with caveats: they only run when the garbage collector
+// notices the Emulator is unreachable, which may be never (e.g. if the test
+// binary exits first), and SetFinalizer panics if the Emulator is not the
+// beginning of an allocation, e.g. when it's embedded in another struct by
+// value. That's why the leak detection is opt-in.
+func (e *Emulator) watchLeak() {
+	runtime.SetFinalizer(e, func(e *Emulator) {
+		if e.proc == nil || e.reused || !e.stopOnClose {
+			return
+		}
+		select {
+		case <-e.proc.exited():
+			return
+		default:
+		}
+		var l Logger = log.Default()
+		if e.logger != nil {
+			l = e.logger
+		}
+		l.Printf("datastore emulator (%v) was garbage collected without Close, killing it", e.Host)
+		_ = e.proc.kill()
+	})
+}
+
+// unwatchLeak removes the finalizer set by watchLeak.
+func (e *Emulator) unwatchLeak() {
+	runtime.SetFinalizer(e, nil)
+}
@@ -0,0 +1,63 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanLogger sends the logged messages to a channel.
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...any) {
+	select {
+	case l <- fmt.Sprintf(format, v...):
+	default:
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	// the leaked emulator doesn't restore the environment
+	for _, k := range []string{"DATASTORE_EMULATOR_HOST", "DATASTORE_PROJECT_ID"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	for name, opts := range map[string][]Option{
+		"default":              nil,
+		"entity limit warning": {WithEntityLimitWarning(10, func(int) {})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logged := make(chanLogger, 16)
+			e, err := New(append(fakeGcloud(), append(opts, WithLeakDetection(), WithLogger(logged))...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proc := e.proc
+			defer proc.kill()
+			e = nil
+
+			deadline := time.After(5 * time.Second)
+			for {
+				runtime.GC()
+				select {
+				case msg := <-logged:
+					if !strings.Contains(msg, "without Close") {
+						continue
+					}
+					select {
+					case <-proc.exited():
+					case <-time.After(time.Second):
+						t.Error("the leaked emulator process wasn't killed")
+					}
+					return
+				case <-deadline:
+					t.Fatal("the leaked emulator wasn't detected")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package emulator
+
+import (
+	"context"
+	"time"
+	"weak"
+)
+
+// entityLimitInterval is how often the entity count is checked against the
+// limit set with WithEntityLimitWarning.
+var entityLimitInterval = 5 * time.Second
+
+// CountAll returns the number of entities of all kinds in all namespaces.
+func (e *Emulator) CountAll(ctx context.Context) (int, error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	namespaces, err := listNamespaces(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, ns := range namespaces {
+		kinds, err := listKinds(ctx, c, ns)
+		if err != nil {
+			return total, err
+		}
+		for _, kind := range kinds {
+			n, err := e.Count(ctx, kind, ns)
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// watchEntityLimit periodically counts the entities, calling the function set
+// with WithEntityLimitWarning when the count exceeds the limit, once until it
+// goes back under it. It runs until unwatchEntityLimit is called. The
+// goroutine only holds a weak reference to the Emulator, so that it doesn't
+// keep a leaked Emulator from being garbage collected (see WithLeakDetection);
+// it stops once it's gone.
+func (e *Emulator) watchEntityLimit() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	e.stopLimitWatch = func() {
+		cancel()
+		<-done
+	}
+	t := e.clock.NewTicker(entityLimitInterval)
+	w := weak.Make(e)
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		exceeded := false
+		for {
+			select {
+			case <-t.C():
+			case <-ctx.Done():
+				return
+			}
+			e := w.Value()
+			if e == nil {
+				return
+			}
+			n, err := e.CountAll(ctx)
+			if err != nil {
+				continue
+			}
+			if n > e.entityLimit && !exceeded {
+				e.onEntityLimit(n)
+			}
+			exceeded = n > e.entityLimit
+		}
+	}()
+}
+
+// unwatchEntityLimit stops the goroutine started by watchEntityLimit, if any.
+func (e *Emulator) unwatchEntityLimit() {
+	if e.stopLimitWatch != nil {
+		e.stopLimitWatch()
+		e.stopLimitWatch = nil
+	}
+}
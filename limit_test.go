@@ -0,0 +1,63 @@
+package emulator
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEntityLimitWarning(t *testing.T) {
+	const limit = 3
+	warnings := make(chan int, 10)
+	clk := newFakeClock()
+	f := startFakeServer(t, fakeConfig{})
+	e := applyOptions(t, withClock(clk), WithEntityLimitWarning(limit, func(n int) { warnings <- n }))
+	e.Host, e.addr, e.ProjectID = f.url(), f.addr, "test"
+	e.watchEntityLimit()
+	t.Cleanup(func() {
+		e.unwatchEntityLimit()
+		_ = e.closeSharedClient()
+	})
+	clk.waitTicker(t)
+
+	// tick advances the clock by the interval a few times, leaving time for
+	// the counts, and returns the warnings issued meanwhile
+	tick := func() []int {
+		var got []int
+		for range 5 {
+			clk.Advance(entityLimitInterval)
+			time.Sleep(20 * time.Millisecond)
+		}
+		for {
+			select {
+			case n := <-warnings:
+				got = append(got, n)
+			default:
+				return got
+			}
+		}
+	}
+	keys := putEntities(t, e, "Kind", "", limit)
+	if got := tick(); len(got) != 0 {
+		t.Errorf("warnings = %v at the limit, want none", got)
+	}
+	keys = append(keys, putEntities(t, e, "Other", "ns", 1)...)
+	if got := tick(); len(got) != 1 || got[0] != limit+1 {
+		t.Errorf("warnings = %v over the limit, want one with the count %d", got, limit+1)
+	}
+	if got := tick(); len(got) != 0 {
+		t.Errorf("warnings = %v still over the limit, want no repeated warning", got)
+	}
+	c, err := e.sharedClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	putEntities(t, e, "Kind", "", limit+2)
+	if got := tick(); len(got) != 1 || got[0] != limit+2 {
+		t.Errorf("warnings = %v over the limit again, want one with the count %d", got, limit+2)
+	}
+}
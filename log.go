@@ -0,0 +1,15 @@
+package emulator
+
+// Logger is the interface of the logger set with WithLogger. It is satisfied
+// by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// logf logs the message, prefixed with the name of the emulator, if a logger
+// is configured.
+func (e *Emulator) logf(format string, v ...any) {
+	if e.logger != nil {
+		e.logger.Printf("[%s] "+format, append([]any{e.name}, v...)...)
+	}
+}
@@ -0,0 +1,211 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics records the durations of the emulator operations, e.g. to export
+// them to a monitoring system.
+type Metrics interface {
+	// ObserveStartup is called after the emulator process was started (or
+	// failed to start).
+	ObserveStartup(d time.Duration, err error)
+	// ObserveReset is called after each reset of the emulator.
+	ObserveReset(d time.Duration, err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveStartup(time.Duration, error) {}
+func (nopMetrics) ObserveReset(time.Duration, error)   {}
+
+// NamedMetrics is implemented by the Metrics telling apart the emulators they
+// are set on: the durations of the operations of an emulator are recorded by
+// the Metrics returned by ForEmulator with its name, see WithName.
+type NamedMetrics interface {
+	Metrics
+	ForEmulator(name string) Metrics
+}
+
+// metricsOf returns the Metrics recording the operations of the emulator.
+func (e *Emulator) metricsOf() Metrics {
+	if m, ok := e.metrics.(NamedMetrics); ok {
+		return m.ForEmulator(e.name)
+	}
+	return e.metrics
+}
+
+// startupBuckets and resetBuckets are the upper bounds, in seconds, of the
+// buckets of the startup and reset duration histograms.
+var (
+	startupBuckets = []float64{0.5, 1, 2, 5, 10, 20, 30, 60}
+	resetBuckets   = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+// PrometheusMetrics is a Metrics exposing the startups and resets of the
+// emulators it's set on (see WithMetrics), labeled with the names of the
+// emulators, and the number of active emulators, in the Prometheus text
+// format, without depending on the Prometheus client library.
+//
+//	m := emulator.NewPrometheusMetrics()
+//	http.Handle("/metrics", m.MetricsHandler())
+//	e, err := emulator.New(emulator.WithMetrics(m))
+type PrometheusMetrics struct {
+	mu     sync.Mutex
+	series map[string]*promSeries // by emulator name
+}
+
+// promSeries are the metrics of an emulator.
+type promSeries struct {
+	startups histogram
+	resets   histogram
+}
+
+// NewPrometheusMetrics returns a new PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{series: map[string]*promSeries{}}
+}
+
+// ObserveStartup implements Metrics, recording the startup without an
+// emulator name.
+func (m *PrometheusMetrics) ObserveStartup(d time.Duration, err error) {
+	m.observe("", func(s *promSeries) { s.startups.observe(d, err) })
+}
+
+// ObserveReset implements Metrics, recording the reset without an emulator
+// name.
+func (m *PrometheusMetrics) ObserveReset(d time.Duration, err error) {
+	m.observe("", func(s *promSeries) { s.resets.observe(d, err) })
+}
+
+// ForEmulator implements NamedMetrics.
+func (m *PrometheusMetrics) ForEmulator(name string) Metrics {
+	return namedPromMetrics{m: m, name: name}
+}
+
+func (m *PrometheusMetrics) observe(name string, fn func(*promSeries)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[name]
+	if !ok {
+		s = &promSeries{
+			startups: newHistogram(startupBuckets),
+			resets:   newHistogram(resetBuckets),
+		}
+		m.series[name] = s
+	}
+	fn(s)
+}
+
+// namedPromMetrics records the operations of a named emulator.
+type namedPromMetrics struct {
+	m    *PrometheusMetrics
+	name string
+}
+
+func (n namedPromMetrics) ObserveStartup(d time.Duration, err error) {
+	n.m.observe(n.name, func(s *promSeries) { s.startups.observe(d, err) })
+}
+
+func (n namedPromMetrics) ObserveReset(d time.Duration, err error) {
+	n.m.observe(n.name, func(s *promSeries) { s.resets.observe(d, err) })
+}
+
+// MetricsHandler returns the handler serving the metrics in the Prometheus
+// text exposition format.
+func (m *PrometheusMetrics) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := slices.Sorted(maps.Keys(m.series))
+	writeHistograms(w, "datastore_emulator_startup", "startups of the emulator", names, func(name string) *histogram {
+		return &m.series[name].startups
+	})
+	writeHistograms(w, "datastore_emulator_reset", "resets of the emulator", names, func(name string) *histogram {
+		return &m.series[name].resets
+	})
+	fmt.Fprintf(w, "# HELP datastore_emulator_active_instances Number of active emulators.\n")
+	fmt.Fprintf(w, "# TYPE datastore_emulator_active_instances gauge\n")
+	fmt.Fprintf(w, "datastore_emulator_active_instances %d\n", ActiveCount())
+}
+
+// histogram counts the observed operations, their failures and their
+// durations in cumulative buckets.
+type histogram struct {
+	bounds   []float64
+	counts   []uint64 // per bucket, not cumulative
+	count    uint64
+	failures uint64
+	sum      float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration, err error) {
+	s := d.Seconds()
+	for i, b := range h.bounds {
+		if s <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += s
+	if err != nil {
+		h.failures++
+	}
+}
+
+// writeHistograms writes the total and failure counters and the duration
+// histogram of the operation with the name prefix, with a series per emulator
+// name.
+func writeHistograms(w io.Writer, name, help string, names []string, histogramOf func(name string) *histogram) {
+	fmt.Fprintf(w, "# HELP %s_total Number of %s.\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s_total counter\n", name)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s_total{%s} %d\n", name, emulatorLabel(n), histogramOf(n).count)
+	}
+	fmt.Fprintf(w, "# HELP %s_failures_total Number of failed %s.\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s_failures_total counter\n", name)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s_failures_total{%s} %d\n", name, emulatorLabel(n), histogramOf(n).failures)
+	}
+	fmt.Fprintf(w, "# HELP %s_duration_seconds Duration of the %s.\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s_duration_seconds histogram\n", name)
+	for _, n := range names {
+		h, label := histogramOf(n), emulatorLabel(n)
+		var cumulative uint64
+		for i, b := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_duration_seconds_bucket{%s,le=\"%s\"} %d\n", name, label, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(w, "%s_duration_seconds_sum{%s} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_duration_seconds_count{%s} %d\n", name, label, h.count)
+	}
+}
+
+// labelEscaper escapes the label values of the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// emulatorLabel returns the label of the series of the named emulator.
+func emulatorLabel(name string) string {
+	return `emulator="` + labelEscaper.Replace(name) + `"`
+}
@@ -0,0 +1,126 @@
+package emulator
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the observations.
+type recordingMetrics struct {
+	mu       sync.Mutex
+	startups []error
+	resets   []error
+}
+
+func (m *recordingMetrics) ObserveStartup(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.startups = append(m.startups, err)
+}
+
+func (m *recordingMetrics) ObserveReset(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resets = append(m.resets, err)
+}
+
+// namedRecordingMetrics records the observations of each named emulator.
+type namedRecordingMetrics struct {
+	recordingMetrics
+	mu    sync.Mutex
+	names []string
+}
+
+func (m *namedRecordingMetrics) ForEmulator(name string) Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names = append(m.names, name)
+	return &m.recordingMetrics
+}
+
+func TestMetrics(t *testing.T) {
+	m := &recordingMetrics{}
+	e := newFakeEmulator(t, nil, WithMetrics(m))
+	if len(m.startups) != 1 || m.startups[0] != nil {
+		t.Errorf("startups = %v, want a successful one", m.startups)
+	}
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.resets) != 1 || m.resets[0] != nil {
+		t.Errorf("resets = %v, want a successful one", m.resets)
+	}
+
+	failed := &recordingMetrics{}
+	if _, err := New(append(fakeGcloud("FAKE_FAIL=exit"), WithMetrics(failed))...); err == nil {
+		t.Fatal("New() error = nil")
+	}
+	if len(failed.startups) != 1 || failed.startups[0] == nil {
+		t.Errorf("startups = %v, want a failed one", failed.startups)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	e := newFakeEmulator(t, nil, WithMetrics(m), WithName("app"))
+	for range 2 {
+		if err := e.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New(append(fakeGcloud("FAKE_FAIL=exit"), WithMetrics(m), WithName(`we"ird`))...); err == nil {
+		t.Fatal("New() error = nil")
+	}
+	// an observation without an emulator name
+	m.ObserveReset(time.Millisecond, nil)
+
+	srv := httptest.NewServer(m.MetricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	for _, want := range []string{
+		"# TYPE datastore_emulator_startup_total counter",
+		`datastore_emulator_startup_total{emulator="app"} 1`,
+		`datastore_emulator_startup_failures_total{emulator="app"} 0`,
+		`datastore_emulator_startup_failures_total{emulator="we\"ird"} 1`,
+		`datastore_emulator_reset_total{emulator="app"} 2`,
+		`datastore_emulator_reset_total{emulator=""} 1`,
+		"# TYPE datastore_emulator_reset_duration_seconds histogram",
+		`datastore_emulator_reset_duration_seconds_bucket{emulator="",le="0.005"} 1`,
+		`datastore_emulator_reset_duration_seconds_bucket{emulator="app",le="+Inf"} 2`,
+		`datastore_emulator_reset_duration_seconds_count{emulator="app"} 2`,
+		"# TYPE datastore_emulator_active_instances gauge",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("the metrics have no line %s:\n%s", want, body)
+		}
+	}
+	// every sample line is "name{labels} value"
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		if _, err := strconv.ParseFloat(value, 64); !ok || err != nil || !strings.HasPrefix(name, "datastore_emulator_") {
+			t.Errorf("malformed sample %q", line)
+		}
+	}
+}
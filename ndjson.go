@@ -0,0 +1,287 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// The JSON dump written by ExportJSON holds one entity per line. It's not
+// compatible with the GCP export format, it's meant to be read (and diffed) by
+// humans and tests, so the keys are spelled out and each value is tagged with
+// its type, which also allows restoring the entities exactly.
+
+// jsonEntity is a line of the JSON dump.
+type jsonEntity struct {
+	Key        *jsonKey       `json:"key"`
+	Properties []jsonProperty `json:"properties"`
+}
+
+type jsonKey struct {
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name,omitempty"`
+	ID        int64    `json:"id,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Parent    *jsonKey `json:"parent,omitempty"`
+}
+
+type jsonProperty struct {
+	Name    string `json:"name"`
+	NoIndex bool   `json:"noIndex,omitempty"`
+	jsonValue
+}
+
+// jsonValue is a property value tagged with its type, one of null, string,
+// int, float, bool, time, bytes, key, geo, array and entity.
+type jsonValue struct {
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type jsonNestedEntity struct {
+	Key        *jsonKey       `json:"key,omitempty"`
+	Properties []jsonProperty `json:"properties"`
+}
+
+// ExportJSON writes the entities of the given kinds, or of all kinds if none
+// are given, in all namespaces to w as newline-delimited JSON, one entity per
+// line. The dump can be loaded back with ImportJSON.
+func (e *Emulator) ExportJSON(ctx context.Context, w io.Writer, kinds ...string) error {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	namespaces, err := listNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, ns := range namespaces {
+		nsKinds := kinds
+		if len(nsKinds) == 0 {
+			if nsKinds, err = listKinds(ctx, c, ns); err != nil {
+				return err
+			}
+		}
+		for _, kind := range nsKinds {
+			var entities []datastore.PropertyList
+			keys, err := c.GetAll(ctx, datastore.NewQuery(kind).Namespace(ns), &entities)
+			if err != nil {
+				return fmt.Errorf("export %s: %w", kind, err)
+			}
+			for i, key := range keys {
+				if err := enc.Encode(jsonEntity{Key: encodeKey(key), Properties: encodeProperties(entities[i])}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func encodeKey(k *datastore.Key) *jsonKey {
+	if k == nil {
+		return nil
+	}
+	return &jsonKey{Kind: k.Kind, Name: k.Name, ID: k.ID, Namespace: k.Namespace, Parent: encodeKey(k.Parent)}
+}
+
+func encodeProperties(pl []datastore.Property) []jsonProperty {
+	props := make([]jsonProperty, len(pl))
+	for i, p := range pl {
+		props[i] = jsonProperty{Name: p.Name, NoIndex: p.NoIndex, jsonValue: encodeValue(p.Value)}
+	}
+	return props
+}
+
+func encodeValue(v any) jsonValue {
+	switch v := v.(type) {
+	case nil:
+		return jsonValue{Type: "null"}
+	case string:
+		return jsonValue{Type: "string", Value: v}
+	case int64:
+		// as a string, so that large integers survive the float64 of JSON
+		return jsonValue{Type: "int", Value: fmt.Sprint(v)}
+	case float64:
+		return jsonValue{Type: "float", Value: v}
+	case bool:
+		return jsonValue{Type: "bool", Value: v}
+	case time.Time:
+		return jsonValue{Type: "time", Value: v.UTC().Format(time.RFC3339Nano)}
+	case []byte:
+		return jsonValue{Type: "bytes", Value: v}
+	case *datastore.Key:
+		return jsonValue{Type: "key", Value: encodeKey(v)}
+	case datastore.GeoPoint:
+		return jsonValue{Type: "geo", Value: v}
+	case []any:
+		values := make([]jsonValue, len(v))
+		for i, item := range v {
+			values[i] = encodeValue(item)
+		}
+		return jsonValue{Type: "array", Value: values}
+	case *datastore.Entity:
+		return jsonValue{Type: "entity", Value: jsonNestedEntity{Key: encodeKey(v.Key), Properties: encodeProperties(v.Properties)}}
+	}
+	return jsonValue{Type: fmt.Sprintf("unsupported %T", v)}
+}
+
+// rawEntity and rawProperty mirror jsonEntity and jsonProperty, deferring the
+// decoding of the values until their type is known.
+type rawEntity struct {
+	Key        *jsonKey      `json:"key"`
+	Properties []rawProperty `json:"properties"`
+}
+
+type rawProperty struct {
+	Name    string          `json:"name"`
+	NoIndex bool            `json:"noIndex"`
+	Type    string          `json:"type"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// ImportJSON puts the entities from the newline-delimited JSON written by
+// ExportJSON into the emulator, in batches.
+func (e *Emulator) ImportJSON(ctx context.Context, r io.Reader) error {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	var keys []*datastore.Key
+	var entities []datastore.PropertyList
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if _, err := c.PutMulti(ctx, keys, entities); err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		keys, entities = keys[:0], entities[:0]
+		return nil
+	}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var re rawEntity
+		if err := dec.Decode(&re); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("import: entity %d: %w", line, err)
+		}
+		if re.Key == nil {
+			return fmt.Errorf("import: entity %d: missing key", line)
+		}
+		pl, err := decodeProperties(re.Properties)
+		if err != nil {
+			return fmt.Errorf("import: entity %d: %w", line, err)
+		}
+		keys = append(keys, decodeKey(re.Key))
+		entities = append(entities, pl)
+		if len(keys) == maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+func decodeKey(k *jsonKey) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	return &datastore.Key{Kind: k.Kind, Name: k.Name, ID: k.ID, Namespace: k.Namespace, Parent: decodeKey(k.Parent)}
+}
+
+func decodeProperties(props []rawProperty) (datastore.PropertyList, error) {
+	pl := make(datastore.PropertyList, len(props))
+	for i, p := range props {
+		v, err := decodeValue(p.Type, p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", p.Name, err)
+		}
+		pl[i] = datastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex}
+	}
+	return pl, nil
+}
+
+// decodeValue decodes a value tagged with its type by encodeValue.
+func decodeValue(typ string, data json.RawMessage) (any, error) {
+	var err error
+	switch typ {
+	case "null":
+		return nil, nil
+	case "string":
+		var v string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int":
+		var v int64
+		err = json.Unmarshal(data, &v)
+		if err != nil {
+			var s string
+			if err = json.Unmarshal(data, &s); err == nil {
+				v, err = strconv.ParseInt(s, 10, 64)
+			}
+		}
+		return v, err
+	case "float":
+		var v float64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bool":
+		var v bool
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "key":
+		var v *jsonKey
+		err = json.Unmarshal(data, &v)
+		return decodeKey(v), err
+	case "geo":
+		var v datastore.GeoPoint
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "array":
+		var items []struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		values := make([]any, len(items))
+		for i, item := range items {
+			if values[i], err = decodeValue(item.Type, item.Value); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case "entity":
+		var v struct {
+			Key        *jsonKey      `json:"key"`
+			Properties []rawProperty `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		pl, err := decodeProperties(v.Properties)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Key: decodeKey(v.Key), Properties: pl}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q", typ)
+}
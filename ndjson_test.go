@@ -0,0 +1,140 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// putJSONEntities puts entities with a value of each supported type into the
+// emulator, under a parent in a namespace.
+func putJSONEntities(tb testing.TB, e *Emulator) {
+	tb.Helper()
+	ctx := context.Background()
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	parent := datastore.NameKey("Parent", "p", nil)
+	parent.Namespace = "ns"
+	child := datastore.IDKey("Child", 1<<60, parent)
+	child.Namespace = "ns"
+	entity := datastore.PropertyList{
+		{Name: "null"},
+		{Name: "string", Value: "s"},
+		{Name: "int", Value: int64(1<<62 + 1)},
+		{Name: "float", Value: 1.5},
+		{Name: "bool", Value: true},
+		{Name: "time", Value: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)},
+		{Name: "bytes", Value: []byte{0, 1, 2}, NoIndex: true},
+		{Name: "key", Value: parent},
+		{Name: "geo", Value: datastore.GeoPoint{Lat: 1, Lng: 2}},
+		{Name: "array", Value: []any{"a", int64(1)}},
+		{Name: "entity", Value: &datastore.Entity{Properties: []datastore.Property{{Name: "n", Value: int64(1)}}}},
+	}
+	keys := []*datastore.Key{parent, child, datastore.NameKey("Other", "o", nil)}
+	if _, err := c.PutMulti(ctx, keys, []datastore.PropertyList{{}, entity, {{Name: "n", Value: int64(1)}}}); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	putJSONEntities(t, e)
+	var buf bytes.Buffer
+	if err := e.ExportJSON(context.Background(), &buf, "Child"); err != nil {
+		t.Fatalf("ExportJSON() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("ExportJSON(Child) wrote %d lines, want 1:\n%s", len(lines), buf.String())
+	}
+	var got jsonEntity
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if k := got.Key; k.Kind != "Child" || k.ID != 1<<60 || k.Namespace != "ns" || k.Parent == nil || k.Parent.Name != "p" {
+		t.Errorf("key = %+v, want the child key with its parent", k)
+	}
+	types := map[string]string{}
+	for _, p := range got.Properties {
+		types[p.Name] = p.Type
+	}
+	for _, name := range []string{"null", "string", "int", "float", "bool", "time", "bytes", "key", "geo", "array", "entity"} {
+		if types[name] != name {
+			t.Errorf("property %q has type %q, want %q", name, types[name], name)
+		}
+	}
+	if !strings.Contains(lines[0], `"value":"4611686018427387905"`) {
+		t.Errorf("the int wasn't written as a string: %s", lines[0])
+	}
+
+	buf.Reset()
+	if err := e.ExportJSON(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Errorf("ExportJSON() of all kinds wrote %d lines, want 3", n)
+	}
+}
+
+// sortedDump returns the JSON dump with the properties of each entity sorted
+// by name, as the order of the properties isn't preserved by the emulator.
+func sortedDump(tb testing.TB, dump []byte) string {
+	tb.Helper()
+	var out strings.Builder
+	dec := json.NewDecoder(bytes.NewReader(dump))
+	for dec.More() {
+		var re rawEntity
+		if err := dec.Decode(&re); err != nil {
+			tb.Fatal(err)
+		}
+		slices.SortFunc(re.Properties, func(a, b rawProperty) int { return strings.Compare(a.Name, b.Name) })
+		line, err := json.Marshal(re)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+func TestImportJSON(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	putJSONEntities(t, e)
+	var before bytes.Buffer
+	if err := e.ExportJSON(ctx, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ImportJSON(ctx, bytes.NewReader(before.Bytes())); err != nil {
+		t.Fatalf("ImportJSON() error = %v", err)
+	}
+	var after bytes.Buffer
+	if err := e.ExportJSON(ctx, &after); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedDump(t, after.Bytes()), sortedDump(t, before.Bytes()); got != want {
+		t.Errorf("the dump after the round trip =\n%s\nwant\n%s", got, want)
+	}
+
+	for _, tt := range []struct{ dump, want string }{
+		{dump: `{"properties":[]}`, want: "entity 1: missing key"},
+		{dump: `{"key":{"kind":"K","name":"a"},"properties":[]}` + "\n{", want: "entity 2"},
+		{dump: `{"key":{"kind":"K","name":"a"},"properties":[{"name":"x","type":"nope"}]}`, want: `property "x": unsupported type "nope"`},
+	} {
+		if err := e.ImportJSON(ctx, strings.NewReader(tt.dump)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ImportJSON(%q) error = %v, want %q", tt.dump, err, tt.want)
+		}
+	}
+}
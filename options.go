@@ -0,0 +1,1007 @@
+package emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// Option configures the Emulator.
+type Option func(*Emulator) error
+
+// WithCleanEnv makes the emulator subprocess start from an empty environment
+// instead of inheriting the environment of the current process. Only the
+// variables set with WithGcloudEnv (and the ones keeping gcloud off the
+// network) will be passed to the subprocess.
+func WithCleanEnv() Option {
+	return func(e *Emulator) error {
+		e.cleanEnv = true
+		return nil
+	}
+}
+
+// WithGcloudEnv sets an environment variable on the emulator subprocess. It
+// takes precedence over a variable of the same name inherited from the
+// current process.
+func WithGcloudEnv(key, value string) Option {
+	return func(e *Emulator) error {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid environment variable name: %q", key)
+		}
+		e.gcloudEnv = append(e.gcloudEnv, key+"="+value)
+		return nil
+	}
+}
+
+// WithCloudSDKConfig makes the emulator subprocess use dir, created if
+// missing, as the gcloud configuration directory (CLOUDSDK_CONFIG), which
+// keeps concurrent emulators from contending for the config and lock files
+// of a shared one.
+func WithCloudSDKConfig(dir string) Option {
+	return func(e *Emulator) error {
+		if dir == "" {
+			return errors.New("empty Cloud SDK config dir")
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(abs, 0o755); err != nil {
+			return fmt.Errorf("create Cloud SDK config dir: %w", err)
+		}
+		e.gcloudEnv = append(e.gcloudEnv, "CLOUDSDK_CONFIG="+abs)
+		return nil
+	}
+}
+
+// WithRandomPort makes the emulator listen on a random free port instead of
+// the default one.
+func WithRandomPort() Option {
+	return func(e *Emulator) error {
+		e.randomPort = true
+		return nil
+	}
+}
+
+// WithStartRetries makes Start retry up to n times when the emulator fails to
+// bind to its port, which may happen when a recently freed port is still in
+// TIME_WAIT. A new port is picked on each attempt if WithRandomPort is used.
+// Other errors are not retried.
+func WithStartRetries(n int) Option {
+	return func(e *Emulator) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of start retries: %d", n)
+		}
+		e.startRetries = n
+		return nil
+	}
+}
+
+// WithShutdownRetries makes Close retry the shutdown request up to n times
+// when it fails with a connection error or a server error, e.g. because the
+// emulator is momentarily busy, before falling back to killing the emulator
+// process. The retries are bounded by the close grace period.
+func WithShutdownRetries(n int) Option {
+	return func(e *Emulator) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of shutdown retries: %d", n)
+		}
+		e.shutdownRetries = n
+		return nil
+	}
+}
+
+// WithProject sets the project ID of the emulator.
+func WithProject(project string) Option {
+	return func(e *Emulator) error {
+		if project == "" {
+			return errors.New("project must not be empty")
+		}
+		e.project = project
+		return nil
+	}
+}
+
+// WithDatasetID sets the dataset ID exported in DATASTORE_DATASET, which is
+// also managed then, separately from the project ID exported in
+// DATASTORE_PROJECT_ID, for the legacy clients reading the two differently.
+// By default the dataset ID is the project ID.
+func WithDatasetID(datasetID string) Option {
+	return func(e *Emulator) error {
+		if datasetID == "" {
+			return errors.New("dataset ID must not be empty")
+		}
+		e.datasetID = datasetID
+		return nil
+	}
+}
+
+// defaultProjectEnv are the environment variables read by WithProjectFromEnv
+// unless told otherwise.
+var defaultProjectEnv = []string{"GOOGLE_CLOUD_PROJECT", "DATASTORE_PROJECT_ID"}
+
+// validProjectID matches the project IDs accepted by WithProjectFromEnv.
+var validProjectID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.:_-]*$`)
+
+// WithProjectFromEnv sets the project ID of the emulator to the value of the
+// first of the environment variables which is set, GOOGLE_CLOUD_PROJECT and
+// DATASTORE_PROJECT_ID if none are given. The project is left unchanged
+// (DefaultProject unless set otherwise) if none of the variables is set.
+func WithProjectFromEnv(varNames ...string) Option {
+	if len(varNames) == 0 {
+		varNames = defaultProjectEnv
+	}
+	return func(e *Emulator) error {
+		for _, name := range varNames {
+			v := os.Getenv(name)
+			if v == "" {
+				continue
+			}
+			if !validProjectID.MatchString(v) {
+				return fmt.Errorf("invalid project ID %q in %s", v, name)
+			}
+			e.project = v
+			return nil
+		}
+		return nil
+	}
+}
+
+// WithHostPort sets the host-port the emulator listens on.
+func WithHostPort(hostPort string) Option {
+	return func(e *Emulator) error {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("invalid host-port %q: %w", hostPort, err)
+		}
+		e.hostPort = hostPort
+		return nil
+	}
+}
+
+// WithConsistency sets the fraction of the eventually consistent operations
+// which succeed immediately. The default is 1.0, which prevents random test
+// failures caused by eventual consistency.
+func WithConsistency(consistency float64) Option {
+	return func(e *Emulator) error {
+		if consistency < 0 || consistency > 1 {
+			return fmt.Errorf("consistency must be between 0 and 1, got %v", consistency)
+		}
+		e.consistency = consistency
+		return nil
+	}
+}
+
+// WithDataDir makes the emulator store its data on disk in dir instead of in
+// memory.
+func WithDataDir(dir string) Option {
+	return func(e *Emulator) error {
+		if dir == "" {
+			return errors.New("data dir must not be empty")
+		}
+		e.dataDir = dir
+		return nil
+	}
+}
+
+// WithTimeout sets how long Start waits for the emulator to become healthy.
+func WithTimeout(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d <= 0 {
+			return fmt.Errorf("timeout must be positive, got %v", d)
+		}
+		e.timeout = d
+		return nil
+	}
+}
+
+// FromEnv returns the options configured with the following environment
+// variables, skipping the ones which are not set:
+//
+//	DATASTORE_EMULATOR_PROJECT      project ID (WithProject)
+//	DATASTORE_EMULATOR_HOSTPORT     host-port (WithHostPort)
+//	DATASTORE_EMULATOR_CONSISTENCY  consistency, e.g. 0.9 (WithConsistency)
+//	DATASTORE_EMULATOR_TIMEOUT      startup timeout, e.g. 1m (WithTimeout)
+//
+// Invalid values are reported by New.
+func FromEnv() []Option {
+	var opts []Option
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_PROJECT"); ok {
+		opts = append(opts, WithProject(v))
+	}
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_HOSTPORT"); ok {
+		opts = append(opts, WithHostPort(v))
+	}
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_CONSISTENCY"); ok {
+		c, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			opts = append(opts, errOption(fmt.Errorf("DATASTORE_EMULATOR_CONSISTENCY: %w", err)))
+		} else {
+			opts = append(opts, WithConsistency(c))
+		}
+	}
+	if v, ok := os.LookupEnv("DATASTORE_EMULATOR_TIMEOUT"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			opts = append(opts, errOption(fmt.Errorf("DATASTORE_EMULATOR_TIMEOUT: %w", err)))
+		} else {
+			opts = append(opts, WithTimeout(d))
+		}
+	}
+	return opts
+}
+
+// errOption returns an option which fails with err.
+func errOption(err error) Option {
+	return func(*Emulator) error {
+		return err
+	}
+}
+
+// WithDryRun makes Start build the command without running it, so that the
+// resulting command line can be inspected with CommandArgs. The environment
+// variables are not set either.
+func WithDryRun() Option {
+	return func(e *Emulator) error {
+		e.dryRun = true
+		return nil
+	}
+}
+
+// WithStartupProgress sets a function called with the result of every health
+// check performed while waiting for the emulator to start.
+func WithStartupProgress(fn func(attempt int, err error)) Option {
+	return func(e *Emulator) error {
+		e.startupProgress = fn
+		return nil
+	}
+}
+
+// WithKeepAlive makes Close leave the emulator process running, so that it can
+// be reused by a later Start, which finds it on the configured host-port (or
+// through DATASTORE_HOST and DATASTORE_PROJECT_ID). Close still cleans up the
+// environment variables. Use ForceClose to terminate the process.
+func WithKeepAlive() Option {
+	return func(e *Emulator) error {
+		e.keepAlive = true
+		return nil
+	}
+}
+
+// WithOutput makes the output of the emulator process be written to w.
+func WithOutput(w io.Writer) Option {
+	return func(e *Emulator) error {
+		e.output = w
+		return nil
+	}
+}
+
+// WithOutputPrefix makes each line of the output set with WithOutput be
+// prefixed with prefix, e.g. "[emulator:8088] ", which helps telling apart
+// the output of several emulators. By default the lines are prefixed with the
+// name of the emulator in brackets (see WithName), an empty prefix disables
+// the prefixing.
+func WithOutputPrefix(prefix string) Option {
+	return func(e *Emulator) error {
+		e.outputPrefix, e.outputPrefixSet = prefix, true
+		return nil
+	}
+}
+
+// WithDeleteBatchSize sets the number of entities deleted in a single batch by
+// the methods clearing the datastore through the client. It must be between
+// 1 and 500 (the default).
+func WithDeleteBatchSize(n int) Option {
+	return func(e *Emulator) error {
+		if n < 1 || n > maxBatchSize {
+			return fmt.Errorf("delete batch size must be between 1 and %d, got %d", maxBatchSize, n)
+		}
+		e.deleteBatchSize = n
+		return nil
+	}
+}
+
+// HealthCheck configures how the health of the emulator is checked.
+type HealthCheck struct {
+	// Path is the path of the health endpoint, the root path by default.
+	Path string
+	// Method is the HTTP method of the health check, GET by default. HEAD
+	// avoids transferring the response body; if the emulator doesn't support
+	// it the check falls back to GET.
+	Method string
+}
+
+// WithHealthCheck configures the health check of the emulator.
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(e *Emulator) error {
+		switch hc.Method {
+		case "", http.MethodGet, http.MethodHead:
+		default:
+			return fmt.Errorf("unsupported health check method: %s", hc.Method)
+		}
+		e.healthCheck = hc
+		return nil
+	}
+}
+
+// WithDefaultNamespace sets the namespace applied to the keys built with the
+// key helpers of the Emulator (NameKey, IDKey and IncompleteKey). The raw
+// datastore client is not affected.
+func WithDefaultNamespace(ns string) Option {
+	return func(e *Emulator) error {
+		e.namespace = ns
+		return nil
+	}
+}
+
+// ResetAllProjects makes Reset use the reset endpoint of the emulator, which
+// wipes the data of all the projects, instead of deleting the entities of the
+// Emulator project only.
+func ResetAllProjects() Option {
+	return func(e *Emulator) error {
+		e.resetAllProjects = true
+		return nil
+	}
+}
+
+// WithMetrics sets the recorder of the durations of the emulator startup and
+// resets.
+func WithMetrics(m Metrics) Option {
+	return func(e *Emulator) error {
+		if m == nil {
+			return errors.New("metrics must not be nil")
+		}
+		e.metrics = m
+		return nil
+	}
+}
+
+// WithReclaimPort makes Start shut down a healthy Datastore emulator already
+// listening on the host-port, e.g. one left over by a crashed test run, and
+// start a new one in its place. Use with care, as it kills a process which may
+// be used by someone else.
+func WithReclaimPort() Option {
+	return func(e *Emulator) error {
+		e.reclaimPort = true
+		return nil
+	}
+}
+
+// WithMaxLogBuffer sets how many of the most recent bytes of the emulator
+// output are retained for the StartupError. The default is 4 KiB.
+func WithMaxLogBuffer(bytes int) Option {
+	return func(e *Emulator) error {
+		if bytes <= 0 {
+			return fmt.Errorf("log buffer size must be positive, got %d", bytes)
+		}
+		e.maxLogBuffer = bytes
+		return nil
+	}
+}
+
+// WithGRPCDialer sets a custom dialer used by the gRPC connections to the
+// emulator, e.g. to route them through a unix socket. It applies to
+// GRPCDialOptions, ClientOptions and Client.
+func WithGRPCDialer(dialer func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(e *Emulator) error {
+		e.grpcDialer = dialer
+		return nil
+	}
+}
+
+// WithGRPCConnPool sets the number of gRPC connections of the clients built
+// with ClientOptions and Client, which speeds up bulk operations on large
+// datasets. The library default is used if not set.
+func WithGRPCConnPool(n int) Option {
+	return func(e *Emulator) error {
+		if n < 1 {
+			return fmt.Errorf("gRPC connection pool size must be positive, got %d", n)
+		}
+		e.grpcConnPool = n
+		return nil
+	}
+}
+
+// WithMaxRecvMsgSize sets the maximum size in bytes of the gRPC messages the
+// clients built with ClientOptions and Client can receive, e.g. to get
+// entities with large property values. The gRPC default of 4 MiB is used if
+// not set.
+func WithMaxRecvMsgSize(bytes int) Option {
+	return func(e *Emulator) error {
+		if bytes < 1 {
+			return fmt.Errorf("max receive message size must be positive, got %d", bytes)
+		}
+		e.maxRecvMsgSize = bytes
+		return nil
+	}
+}
+
+// WithMaxSendMsgSize sets the maximum size in bytes of the gRPC messages the
+// clients built with ClientOptions and Client can send, e.g. to put entities
+// with large property values.
+func WithMaxSendMsgSize(bytes int) Option {
+	return func(e *Emulator) error {
+		if bytes < 1 {
+			return fmt.Errorf("max send message size must be positive, got %d", bytes)
+		}
+		e.maxSendMsgSize = bytes
+		return nil
+	}
+}
+
+// WithCommand sets the function building the command which starts the
+// emulator, given the gcloud arguments (e.g. "emulators", "datastore",
+// "start", ...). It gives full control over how the process is launched. The
+// environment of the command is set like for the default command, unless the
+// function sets it. If the function sets Stdout or Stderr, the output is
+// written there in addition to the writer set with WithOutput. The function
+// is also used to detect the emulator command group, see WithCommandPrefix.
+func WithCommand(fn func(args []string) *exec.Cmd) Option {
+	return func(e *Emulator) error {
+		e.commandFunc = fn
+		return nil
+	}
+}
+
+// WithRequireIndexes makes the emulator require the composite indexes to be
+// declared in the index.yaml file at path, so that the queries needing an
+// undeclared index fail like they do in production.
+func WithRequireIndexes(path string) Option {
+	return func(e *Emulator) error {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("index file: %w", err)
+		}
+		e.indexFile = path
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the Emulator, e.g. log.Default().
+func WithLogger(l Logger) Option {
+	return func(e *Emulator) error {
+		e.logger = l
+		return nil
+	}
+}
+
+// WithGRPCHealthCheck makes the Emulator check the health of the emulator with
+// the gRPC health service instead of HTTP, for emulator deployments which only
+// expose the gRPC endpoint. As the HTTP reset endpoint is not available either,
+// Reset always deletes the entities through the client.
+func WithGRPCHealthCheck() Option {
+	return func(e *Emulator) error {
+		e.grpcHealthCheck = true
+		return nil
+	}
+}
+
+// WithVerbosity sets the verbosity of gcloud, one of "debug", "info",
+// "warning", "error", "critical" and "none".
+func WithVerbosity(level string) Option {
+	return func(e *Emulator) error {
+		switch level {
+		case "debug", "info", "warning", "error", "critical", "none":
+		default:
+			return fmt.Errorf("invalid verbosity: %q", level)
+		}
+		e.verbosity = level
+		return nil
+	}
+}
+
+// WithDebugOutput sets the writer receiving the gcloud logs (the stderr of the
+// process) when the verbosity is "debug", keeping them apart from the output
+// set with WithOutput.
+func WithDebugOutput(w io.Writer) Option {
+	return func(e *Emulator) error {
+		e.debugOutput = w
+		return nil
+	}
+}
+
+// WithLeakDetection makes the Emulator log a warning and kill the emulator
+// process if the Emulator is garbage collected without being closed. It is
+// implemented with a finalizer, so it is best-effort: the warning may never
+// be logged if the garbage collector doesn't run before the process exits. The
+// Emulator must not be embedded by value in another struct.
+func WithLeakDetection() Option {
+	return func(e *Emulator) error {
+		e.leakDetection = true
+		return nil
+	}
+}
+
+// WithCloseGrace sets how long Close waits for the emulator process to exit
+// after requesting its shutdown before killing it. The default is 5 seconds.
+func WithCloseGrace(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d < 0 {
+			return fmt.Errorf("close grace must not be negative, got %v", d)
+		}
+		e.closeGrace = d
+		return nil
+	}
+}
+
+// WithInitialDelay sets the period after launching the emulator during which
+// the failed health checks are expected and not logged, as the emulator takes
+// a while to bind its port. The default is 5 seconds. The startup timeout
+// still applies.
+func WithInitialDelay(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d < 0 {
+			return fmt.Errorf("initial delay must not be negative, got %v", d)
+		}
+		e.initialDelay = d
+		return nil
+	}
+}
+
+// WithBackend selects what Start launches, see Backend.
+func WithBackend(b Backend) Option {
+	return func(e *Emulator) error {
+		switch b {
+		case BackendGcloud, BackendFake:
+		default:
+			return fmt.Errorf("unknown backend: %d", b)
+		}
+		e.backend = b
+		return nil
+	}
+}
+
+// WithCommandPrefix sets the gcloud arguments selecting the emulator command
+// group, e.g. "beta", "emulators", "datastore", instead of detecting the one
+// supported by the installed gcloud.
+func WithCommandPrefix(args ...string) Option {
+	return func(e *Emulator) error {
+		if len(args) == 0 {
+			return errors.New("empty command prefix")
+		}
+		e.cmdPrefix = append([]string(nil), args...)
+		return nil
+	}
+}
+
+// WithName sets the name identifying the emulator in the log lines, the
+// output lines (see WithOutputPrefix) and the metrics (see NamedMetrics),
+// which helps telling apart multiple emulators. By default a random short id
+// is used.
+func WithName(name string) Option {
+	return func(e *Emulator) error {
+		if name == "" {
+			return errors.New("empty name")
+		}
+		e.name = name
+		return nil
+	}
+}
+
+// WithScheme sets the scheme of the URLs of the emulator, "http" (the
+// default) or "https" for an emulator fronted by a TLS terminating proxy, in
+// which case the clients connect with TLS too.
+func WithScheme(scheme string) Option {
+	return func(e *Emulator) error {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme: %q", scheme)
+		}
+		e.scheme = scheme
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS config of the connections to the emulator with
+// the https scheme, e.g. to trust the self-signed certificate of a test proxy.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(e *Emulator) error {
+		e.tlsConfig = cfg.Clone()
+		if t, ok := e.httpc.Transport.(*http.Transport); ok {
+			t = t.Clone()
+			t.TLSClientConfig = cfg.Clone()
+			e.httpc.Transport = t
+		}
+		return nil
+	}
+}
+
+// WithBindHostPort is like WithHostPort: it sets the host-port the emulator
+// binds, which is also the one the package uses to check its health. Use it
+// together with WithAdvertiseHostPort.
+func WithBindHostPort(hostPort string) Option {
+	return WithHostPort(hostPort)
+}
+
+// WithAdvertiseHostPort sets the host-port advertised to the clients (in Host,
+// the environment variables and the client options) when it differs from the
+// one the emulator binds, e.g. because of container port mapping.
+func WithAdvertiseHostPort(hostPort string) Option {
+	return func(e *Emulator) error {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("invalid host-port %q: %w", hostPort, err)
+		}
+		e.advertiseHostPort = hostPort
+		return nil
+	}
+}
+
+// WithAdminTimeout sets how long Export and Import wait for their operation
+// to complete when their context has no deadline; the deadline of the context
+// takes precedence. There is no limit by default; exporting or importing large
+// datasets may take minutes.
+func WithAdminTimeout(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d <= 0 {
+			return fmt.Errorf("admin timeout must be positive, got %v", d)
+		}
+		e.adminTimeout = d
+		return nil
+	}
+}
+
+// WithAdminPollInterval sets how often Export and Import poll the status of
+// their operation. The default is the health check polling rate.
+func WithAdminPollInterval(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d <= 0 {
+			return fmt.Errorf("admin poll interval must be positive, got %v", d)
+		}
+		e.adminPollInterval = d
+		return nil
+	}
+}
+
+// WithGcloudConfig makes Start adopt the emulator advertised by the env.yaml
+// file of gcloud (see DiscoverFromGcloudConfig) if it's healthy and the
+// environment variables don't point at another one, e.g. an emulator started
+// with `gcloud beta emulators datastore start` in another terminal. A missing
+// file is not an error: a new emulator is started instead.
+func WithGcloudConfig() Option {
+	return func(e *Emulator) error {
+		e.gcloudConfig = true
+		return nil
+	}
+}
+
+// WithErrorPattern sets the regular expression matching the lines of the
+// emulator stderr sent to the Errors channel. By default it matches the lines
+// logged with the SEVERE, ERROR or WARNING levels and the exceptions.
+func WithErrorPattern(pattern string) Option {
+	return func(e *Emulator) error {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid error pattern: %w", err)
+		}
+		e.errw.setPattern(re)
+		return nil
+	}
+}
+
+// WithPreflight sets a function checking the toolchain before the emulator
+// process is started, e.g. that a wrapped gcloud has the emulator component
+// installed. Start fails with its error, without starting the emulator. It
+// isn't called when an already running emulator is reused.
+func WithPreflight(fn func(ctx context.Context) error) Option {
+	return func(e *Emulator) error {
+		e.preflight = fn
+		return nil
+	}
+}
+
+// WithRequestBackoff makes the reset requests to the emulator retry on
+// connection failures and server errors until their context is done, waiting
+// a random delay up to base doubled with each attempt, capped at maxDelay.
+// Health checks are not retried, they're polled.
+func WithRequestBackoff(base, maxDelay time.Duration) Option {
+	return func(e *Emulator) error {
+		if base <= 0 || maxDelay < base {
+			return fmt.Errorf("invalid request backoff: base %v, max %v", base, maxDelay)
+		}
+		e.backoffBase, e.backoffMax = base, maxDelay
+		return nil
+	}
+}
+
+// WithPersistEnvOnClose makes Close leave the environment variables pointing
+// at the emulator set, instead of restoring their values from before Start,
+// e.g. for tools pointed at a detached emulator which outlives the Emulator.
+func WithPersistEnvOnClose() Option {
+	return func(e *Emulator) error {
+		e.persistEnv = true
+		return nil
+	}
+}
+
+// WithOnReset sets a function called after each successful reset, by any of
+// the Reset and ResetKinds variants, e.g. to re-seed static fixtures. The
+// reset fails with its error.
+func WithOnReset(fn func(ctx context.Context) error) Option {
+	return func(e *Emulator) error {
+		e.onReset = fn
+		return nil
+	}
+}
+
+// WithUnixSocket makes the emulator reachable through a unix socket at path,
+// for environments restricting TCP ports. The emulator doesn't support unix
+// sockets itself, so it still listens on its loopback host-port, and the
+// package forwards the connections to the socket to it. The clients built
+// with ClientOptions dial the socket; the environment variables still point
+// at the host-port. The socket file is removed on Close.
+func WithUnixSocket(path string) Option {
+	return func(e *Emulator) error {
+		if path == "" {
+			return errors.New("empty unix socket path")
+		}
+		e.unixSocket = path
+		e.grpcDialer = unixDialer(path)
+		return nil
+	}
+}
+
+// WithFailureOutput sets the writer the output of the emulator is dumped to
+// when it fails to start, os.Stderr by default, which keeps the successful
+// runs quiet while making the failed ones debuggable. Use io.Discard to turn
+// it off. Nothing is dumped with WithOutput, which shows the output already.
+func WithFailureOutput(w io.Writer) Option {
+	return func(e *Emulator) error {
+		if w == nil {
+			return errors.New("nil failure output")
+		}
+		e.failureOutput = w
+		return nil
+	}
+}
+
+// WithHostPortCandidates sets the host-ports the emulator tries to listen on,
+// in order, moving on to the next one when a host-port is in use. It's more
+// predictable than WithRandomPort when only specific ports are allowed.
+func WithHostPortCandidates(hostPorts ...string) Option {
+	return func(e *Emulator) error {
+		if len(hostPorts) == 0 {
+			return errors.New("no host-port candidates")
+		}
+		for _, hp := range hostPorts {
+			if _, _, err := net.SplitHostPort(hp); err != nil {
+				return fmt.Errorf("invalid host-port %q: %w", hp, err)
+			}
+		}
+		e.candidates = append([]string(nil), hostPorts...)
+		return nil
+	}
+}
+
+// WithManagedEnvVars sets the environment variables Start points at the
+// emulator, and Close restores to their previous values, instead of the
+// default DATASTORE_EMULATOR_HOST and DATASTORE_PROJECT_ID. Besides those,
+// DATASTORE_EMULATOR_HOST_PATH, DATASTORE_HOST, DATASTORE_DATASET and
+// GOOGLE_CLOUD_PROJECT are supported, i.e. the variables set by
+// `gcloud beta emulators datastore env-init` and the project of the clients.
+func WithManagedEnvVars(names ...string) Option {
+	return func(e *Emulator) error {
+		for _, name := range names {
+			if _, ok := envValues[name]; !ok {
+				return fmt.Errorf("unsupported environment variable: %s", name)
+			}
+		}
+		e.managedEnvVars = append([]string{}, names...)
+		return nil
+	}
+}
+
+// WithOnStateChange sets a function called on each transition of the
+// lifecycle state of the Emulator (see State), in order. It must not start or
+// close the Emulator.
+func WithOnStateChange(fn func(old, new State)) Option {
+	return func(e *Emulator) error {
+		e.onStateChange = fn
+		return nil
+	}
+}
+
+// WithClientOptions sets the options of the datastore client shared by the
+// helper methods (e.g. DeleteAll, Count or Seed), applied after the ones
+// returned by ClientOptions.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(e *Emulator) error {
+		e.clientOpts = append(e.clientOpts, opts...)
+		return nil
+	}
+}
+
+// WithNoReuse makes Start fail with ErrInstanceAlreadyRunning instead of
+// adopting a healthy emulator advertised by the environment, or found on the
+// configured host-port, which surfaces the emulators leaked by previous runs.
+func WithNoReuse() Option {
+	return func(e *Emulator) error {
+		e.noReuse = true
+		return nil
+	}
+}
+
+// WithReaper makes the kernel kill the emulator subprocess if the test binary
+// dies without closing it, e.g. when it's killed with SIGKILL, by setting its
+// parent death signal. It's Linux-only, a no-op elsewhere. The signal is
+// delivered when the OS thread which started the subprocess exits, which the
+// Go runtime may do before the process does, and only to gcloud itself, not
+// to the emulator it launches, so it's a best-effort safety net, not a
+// substitute for Close.
+func WithReaper() Option {
+	return func(e *Emulator) error {
+		e.reaper = true
+		return nil
+	}
+}
+
+// WithReadyProbe sets how the startup of the emulator is confirmed, see
+// ReadyProbe.
+func WithReadyProbe(p ReadyProbe) Option {
+	return func(e *Emulator) error {
+		switch p {
+		case ProbeHTTP, ProbeDatastore:
+		default:
+			return fmt.Errorf("unknown ready probe: %d", p)
+		}
+		e.readyProbe = p
+		return nil
+	}
+}
+
+// WithSelfTestKind sets the kind of the canary entity written by SelfTest.
+func WithSelfTestKind(kind string) Option {
+	return func(e *Emulator) error {
+		if kind == "" || strings.HasPrefix(kind, "__") {
+			return fmt.Errorf("invalid self test kind: %q", kind)
+		}
+		e.selfTestKind = kind
+		return nil
+	}
+}
+
+// WithSelfTestNamespace sets the namespace of the canary entity written by
+// SelfTest, "" being the default one.
+func WithSelfTestNamespace(ns string) Option {
+	return func(e *Emulator) error {
+		e.selfTestNamespace = ns
+		return nil
+	}
+}
+
+// WithTransport sets the transport of the HTTP client used for the requests
+// to the emulator (health checks, resets, admin requests), e.g. to tune its
+// connection reuse. By default it's a clone of http.DefaultTransport keeping
+// more idle connections to the emulator. The transport is cloned, so that
+// the TLS config set with WithTLSConfig, if any, is applied to the clone only.
+func WithTransport(t *http.Transport) Option {
+	return func(e *Emulator) error {
+		if t == nil {
+			return errors.New("nil transport")
+		}
+		t = t.Clone()
+		if e.tlsConfig != nil {
+			t.TLSClientConfig = e.tlsConfig.Clone()
+		}
+		e.httpc.Transport = t
+		return nil
+	}
+}
+
+// WithGcloudAccount makes gcloud start the emulator as the account, for the
+// environments where gcloud requires an active account even though the
+// emulator needs no authentication.
+func WithGcloudAccount(email string) Option {
+	return func(e *Emulator) error {
+		if strings.TrimSpace(email) == "" {
+			return errors.New("empty gcloud account")
+		}
+		e.account = email
+		return nil
+	}
+}
+
+// WithImpersonateServiceAccount makes gcloud start the emulator impersonating
+// the service account, like WithGcloudAccount.
+func WithImpersonateServiceAccount(email string) Option {
+	return func(e *Emulator) error {
+		if strings.TrimSpace(email) == "" {
+			return errors.New("empty service account to impersonate")
+		}
+		e.impersonate = email
+		return nil
+	}
+}
+
+// WithEntityLimitWarning makes the Emulator count the entities in the emulator
+// periodically and call fn when there are more than n, e.g. to catch the tests
+// which don't clean up after themselves. It's advisory only: nothing prevents
+// the writes. The function is called again only after the count went back
+// under the limit.
+func WithEntityLimitWarning(n int, fn func(count int)) Option {
+	return func(e *Emulator) error {
+		if n < 0 || fn == nil {
+			return fmt.Errorf("invalid entity limit warning: limit %d", n)
+		}
+		e.entityLimit, e.onEntityLimit = n, fn
+		return nil
+	}
+}
+
+// WithBasePath sets the path prefix of all the endpoints of the emulator
+// (health check, reset, shutdown, admin API), for an emulator exposed under a
+// path by an ingress, e.g. "/datastore-emulator". Leading and trailing slashes
+// are normalized.
+func WithBasePath(prefix string) Option {
+	return func(e *Emulator) error {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix = "/" + prefix
+		}
+		e.basePath = prefix
+		return nil
+	}
+}
+
+// WithRequestLog puts a transparent proxy between the clients and the
+// emulator recording the requests made to it, e.g. to assert that the code
+// under test made exactly one Lookup, see RequestLog. The proxy is advertised
+// in Host and the environment variables instead of the emulator and it is
+// torn down on Close. It supports neither the https scheme nor the unix
+// socket set with WithUnixSocket, which bypasses it.
+func WithRequestLog() Option {
+	return func(e *Emulator) error {
+		e.requestLog = true
+		return nil
+	}
+}
+
+// WithEnforceProject makes Start fail with ErrProjectMismatch when the reused
+// emulator is advertised (by DATASTORE_PROJECT_ID or the gcloud config) with
+// a different project than the configured one, instead of silently using the
+// advertised project, so that the tests don't write to the wrong project of a
+// shared emulator.
+func WithEnforceProject() Option {
+	return func(e *Emulator) error {
+		e.enforceProject = true
+		return nil
+	}
+}
+
+// WithStabilizationWindow makes Start require the health checks to succeed
+// consecutively for at least d before confirming the startup, as a loaded
+// emulator may flicker between healthy and unhealthy while warming up. Any
+// failed health check restarts the window. It's 0 by default, i.e. the first
+// successful health check confirms the startup.
+func WithStabilizationWindow(d time.Duration) Option {
+	return func(e *Emulator) error {
+		if d < 0 {
+			return fmt.Errorf("stabilization window must not be negative, got %v", d)
+		}
+		e.stableWindow = d
+		return nil
+	}
+}
+
+// WithPrewarm makes Start warm up the emulator, once its startup is
+// confirmed, by running a few throwaway writes, reads and queries (like
+// SelfTest does), as the first datastore requests after the startup are
+// noticeably slower, which skews the latency-sensitive tests. The time it
+// takes is reported by PrewarmDuration. The prewarm talks to the emulator on
+// its bind address, so it works with WithUnixSocket and it isn't recorded by
+// WithRequestLog. A reused emulator is not prewarmed.
+func WithPrewarm() Option {
+	return func(e *Emulator) error {
+		e.prewarm = true
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+package emulator
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyOptions returns an initialized Emulator configured with the options,
+// without starting it.
+func applyOptions(tb testing.TB, opts ...Option) *Emulator {
+	tb.Helper()
+	e := &Emulator{}
+	e.init()
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return e
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Run("unset", func(t *testing.T) {
+		if opts := FromEnv(); len(opts) != 0 {
+			t.Errorf("FromEnv() returned %d options, want none", len(opts))
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		t.Setenv("DATASTORE_EMULATOR_PROJECT", "env-project")
+		t.Setenv("DATASTORE_EMULATOR_HOSTPORT", "localhost:9999")
+		t.Setenv("DATASTORE_EMULATOR_CONSISTENCY", "0.25")
+		t.Setenv("DATASTORE_EMULATOR_TIMEOUT", "1m")
+		e := applyOptions(t, FromEnv()...)
+		if e.project != "env-project" || e.hostPort != "localhost:9999" || e.consistency != 0.25 || e.timeout != time.Minute {
+			t.Errorf("project, hostPort, consistency, timeout = %q, %q, %v, %v", e.project, e.hostPort, e.consistency, e.timeout)
+		}
+	})
+
+	for _, name := range []string{"DATASTORE_EMULATOR_CONSISTENCY", "DATASTORE_EMULATOR_TIMEOUT"} {
+		t.Run("invalid "+name, func(t *testing.T) {
+			t.Setenv(name, "bad")
+			_, err := New(FromEnv()...)
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("New() error = %v, want one naming %s", err, name)
+			}
+		})
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	e := applyOptions(t)
+	if e.project != DefaultProject || e.hostPort != DefaultHost {
+		t.Errorf("project, hostPort = %q, %q, want %q, %q", e.project, e.hostPort, DefaultProject, DefaultHost)
+	}
+	if args := e.StartArgs(); !slices.Contains(args, "--project="+DefaultProject) || !slices.Contains(args, "--host-port="+DefaultHost) {
+		t.Errorf("StartArgs() = %q, want the defaults", args)
+	}
+	e = applyOptions(t, WithProject("other"), WithHostPort("localhost:9999"))
+	if e.project != "other" || e.hostPort != "localhost:9999" {
+		t.Errorf("project, hostPort = %q, %q, want the ones set with options", e.project, e.hostPort)
+	}
+}
+
+func TestWithProjectFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		vars    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "none set", want: DefaultProject},
+		{name: "default precedence", env: map[string]string{"GOOGLE_CLOUD_PROJECT": "gcp", "DATASTORE_PROJECT_ID": "ds"}, want: "gcp"},
+		{name: "default fallback", env: map[string]string{"DATASTORE_PROJECT_ID": "ds"}, want: "ds"},
+		{name: "given precedence", env: map[string]string{"GCP_PROJECT": "first", "CI_PROJECT": "second"}, vars: []string{"GCP_PROJECT", "CI_PROJECT"}, want: "first"},
+		{name: "given fallback", env: map[string]string{"GCP_PROJECT": "", "CI_PROJECT": "second"}, vars: []string{"GCP_PROJECT", "CI_PROJECT"}, want: "second"},
+		{name: "given only", env: map[string]string{"GOOGLE_CLOUD_PROJECT": "gcp"}, vars: []string{"GCP_PROJECT"}, want: DefaultProject},
+		{name: "invalid", env: map[string]string{"GOOGLE_CLOUD_PROJECT": "Not A Project"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			e := &Emulator{}
+			e.init()
+			err := WithProjectFromEnv(tt.vars...)(e)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WithProjectFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && e.project != tt.want {
+				t.Errorf("project = %q, want %q", e.project, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartArgs(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		opts    []Option
+		want    []string
+		notWant []string
+	}{
+		{want: []string{"start", "--consistency=1", "--no-store-on-disk"}, notWant: []string{"--require-indexes"}},
+		{opts: []Option{WithConsistency(0.25)}, want: []string{"--consistency=0.25"}, notWant: []string{"--consistency=1"}},
+		{opts: []Option{WithDataDir(dir)}, want: []string{"--data-dir=" + dir}, notWant: []string{"--no-store-on-disk"}},
+		{opts: []Option{WithProject("p"), WithHostPort("localhost:1234")}, want: []string{"--project=p", "--host-port=localhost:1234"}},
+		{opts: []Option{WithVerbosity("info")}, want: []string{"--verbosity=info"}},
+		{opts: []Option{WithGcloudAccount("a@example.com"), WithImpersonateServiceAccount("sa@example.com")}, want: []string{"--account=a@example.com", "--impersonate-service-account=sa@example.com"}},
+	}
+	for _, tt := range tests {
+		args := applyOptions(t, tt.opts...).StartArgs()
+		for _, want := range tt.want {
+			if !slices.Contains(args, want) {
+				t.Errorf("StartArgs() = %q, want %s", args, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if slices.Contains(args, notWant) {
+				t.Errorf("StartArgs() = %q, want no %s", args, notWant)
+			}
+		}
+	}
+
+	e := newFakeEmulator(t, nil)
+	args := e.StartArgs()
+	if want := "--host-port=" + e.addr; !slices.Contains(args, want) {
+		t.Errorf("StartArgs() after Start = %q, want the random host-port %s", args, want)
+	}
+	args[0] = "changed"
+	if e.StartArgs()[0] != "start" {
+		t.Error("StartArgs() returned the arguments used by Start, not a copy")
+	}
+}
+
+func TestGcloudAccount(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "args")
+	newFakeEmulator(t, []string{"FAKE_ARGS_FILE=" + file}, WithGcloudAccount("ci@example.com"), WithImpersonateServiceAccount("sa@example.iam.gserviceaccount.com"))
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(string(data), "\n")
+	for _, want := range []string{"--account=ci@example.com", "--impersonate-service-account=sa@example.iam.gserviceaccount.com"} {
+		if !slices.Contains(args, want) {
+			t.Errorf("gcloud args = %q, want %s", args, want)
+		}
+	}
+
+	for _, opt := range []Option{WithGcloudAccount(""), WithImpersonateServiceAccount(" ")} {
+		if err := opt(&Emulator{}); err == nil {
+			t.Error("an empty account was accepted")
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	if got := (&Emulator{}).Consistency(); got != 1 {
+		t.Errorf("Consistency() by default = %v, want 1", got)
+	}
+	if got := applyOptions(t, WithConsistency(0)).Consistency(); got != 0 {
+		t.Errorf("Consistency() with WithConsistency(0) = %v, want 0", got)
+	}
+	e := newFakeEmulator(t, nil, WithConsistency(0.3))
+	if got := e.Consistency(); got != 0.3 {
+		t.Errorf("Consistency() of the started emulator = %v, want 0.3", got)
+	}
+	for _, c := range []float64{-0.1, 1.1} {
+		if err := WithConsistency(c)(&Emulator{}); err == nil {
+			t.Errorf("WithConsistency(%v) error = nil", c)
+		}
+	}
+}
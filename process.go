@@ -0,0 +1,66 @@
+package emulator
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// process is a running emulator subprocess.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// startProcess starts the command in its own process group and returns the
+// process watching it. The onExit function, if not nil, is called after the
+// process exits and its output has been copied. The output of the processes
+// it spawned isn't waited for long after it exits, as they may outlive it.
+func startProcess(cmd *exec.Cmd, onExit func()) (*process, error) {
+	setProcessGroup(cmd)
+	cmd.WaitDelay = pollingRate
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		if onExit != nil {
+			onExit()
+		}
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// exited returns a channel which is closed once the process exits.
+func (p *process) exited() <-chan struct{} {
+	return p.done
+}
+
+// wait waits for the process to exit, killing it if it doesn't exit within
+// the timeout.
+func (p *process) wait(timeout time.Duration) error {
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(timeout):
+		return p.kill()
+	}
+}
+
+// kill kills the process group and waits for the process to exit.
+func (p *process) kill() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	if err := killProcessGroup(p.cmd.Process); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	<-p.done
+	return nil
+}
@@ -0,0 +1,83 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withForkingGcloud makes the fake gcloud run behind a shell forking a child
+// which holds its output pipes, as the JVM launched by gcloud does. The pid of
+// the child is written to the returned file.
+func withForkingGcloud(tb testing.TB) (Option, string) {
+	tb.Helper()
+	file := filepath.Join(tb.TempDir(), "child")
+	script := fmt.Sprintf(`sleep 15 & echo $! > '%s'; exec "$0" "$@"`, file)
+	return WithCommand(func(args []string) *exec.Cmd {
+		return exec.Command("sh", append([]string{"-c", script, os.Args[0]}, args...)...)
+	}), file
+}
+
+// childAlive reports whether the process whose pid is in the file is running,
+// a zombie waiting to be reaped by init counting as dead.
+func childAlive(tb testing.TB, file string) bool {
+	tb.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, state, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(state, "Z")
+}
+
+func TestCloseKillsProcessGroup(t *testing.T) {
+	for name, knob := range map[string]string{
+		"grace exceeded":       "FAKE_SHUTDOWN_DELAY=1m",
+		"shutdown unsupported": "FAKE_SHUTDOWN=404",
+	} {
+		t.Run(name, func(t *testing.T) {
+			forking, child := withForkingGcloud(t)
+			e := newFakeEmulator(t, []string{knob}, forking, WithCloseGrace(200*time.Millisecond))
+			began := time.Now()
+			_ = e.Close()
+			if d := time.Since(began); d > 5*time.Second {
+				t.Errorf("Close() returned after %v, want the output of the child not waited for", d)
+			}
+			for deadline := time.Now().Add(time.Second); childAlive(t, child); time.Sleep(pollingRate) {
+				if time.Now().After(deadline) {
+					t.Fatal("the child of the emulator process is still running after Close")
+				}
+			}
+		})
+	}
+}
+
+func TestFailedStartupKillsProcessGroup(t *testing.T) {
+	forking, child := withForkingGcloud(t)
+	began := time.Now()
+	_, err := New(append(fakeGcloud("FAKE_FAIL=network"), forking, WithTimeout(500*time.Millisecond))...)
+	if err == nil {
+		t.Fatal("New() error = nil, want a startup timeout")
+	}
+	if d := time.Since(began); d > 5*time.Second {
+		t.Errorf("New() returned after %v, want the output of the child not waited for", d)
+	}
+	for deadline := time.Now().Add(time.Second); childAlive(t, child); time.Sleep(pollingRate) {
+		if time.Now().After(deadline) {
+			t.Fatal("the child of the emulator process is still running after the failed startup")
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package emulator
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op: the process groups are Unix-only.
+func setProcessGroup(*exec.Cmd) {}
+
+// killProcessGroup kills the process, the processes it spawned are left
+// running.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package emulator
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the subprocess the leader of a new process group, so
+// that the processes it spawns, such as the JVM launched by gcloud, can be
+// killed along with it. A new session set by the command is kept, as it's a
+// new group too.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+}
+
+// killProcessGroup kills the process group led by the process, or only the
+// process if it doesn't lead one, as the command joined an existing group.
+func killProcessGroup(p *os.Process) error {
+	err := syscall.Kill(-p.Pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return p.Kill()
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// unixProxy forwards the connections accepted on a unix socket to the TCP
+// address of the emulator.
+type unixProxy struct {
+	l    net.Listener
+	path string
+	addr string
+	wg   sync.WaitGroup // of the goroutines serving the socket
+	mu   sync.Mutex
+	// conns are both ends of the forwarded connections, nil once the proxy
+	// is closed.
+	conns map[net.Conn]struct{}
+}
+
+// startUnixProxy listens on the unix socket at path, replacing a stale socket
+// file, and forwards its connections to addr.
+func startUnixProxy(path, addr string) (*unixProxy, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	p := &unixProxy{l: l, path: path, addr: addr, conns: map[net.Conn]struct{}{}}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *unixProxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		p.wg.Add(1)
+		go p.forward(conn)
+	}
+}
+
+// forward copies the data between the connection and a new connection to the
+// emulator until either side closes, then closes both.
+func (p *unixProxy) forward(conn net.Conn) {
+	defer p.wg.Done()
+	upstream, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if !p.track(conn, upstream) {
+		return
+	}
+	defer p.untrack(conn, upstream)
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	// ends the other copy
+	conn.Close()
+	upstream.Close()
+	<-done
+}
+
+// track registers the ends of a forwarded connection, closing them instead if
+// the proxy is closed.
+func (p *unixProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		for _, c := range conns {
+			c.Close()
+		}
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+// untrack unregisters the ends of a forwarded connection.
+func (p *unixProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// close stops accepting connections, closes both ends of the forwarded ones,
+// waits for the goroutines forwarding them to exit and removes the socket
+// file.
+func (p *unixProxy) close() error {
+	err := p.l.Close()
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+	p.mu.Unlock()
+	p.wg.Wait()
+	if rerr := os.Remove(p.path); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+		err = errors.Join(err, rerr)
+	}
+	return err
+}
+
+// unixDialer returns a gRPC dialer connecting to the unix socket at path.
+func unixDialer(path string) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
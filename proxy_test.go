@@ -0,0 +1,103 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ds.sock")
+	e := newFakeEmulator(t, nil, WithUnixSocket(path))
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("the socket wasn't created: %v", err)
+	}
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := e.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &entity{N: 1}); err != nil {
+		t.Fatalf("Put() over the socket error = %v", err)
+	}
+
+	// the clients only reach the emulator through the socket
+	if err := e.unixProxy.close(); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	short, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if err := c2.Get(short, key, &entity{}); err == nil {
+		t.Error("Get() without the socket error = nil, want the client to dial the socket")
+	}
+	if e.unixProxy, err = startUnixProxy(path, e.addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the socket file wasn't removed on Close: %v", err)
+	}
+}
+
+func TestUnixProxyClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	path := filepath.Join(t.TempDir(), "ds.sock")
+	p, err := startUnixProxy(path, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var upstream net.Conn
+	select {
+	case upstream = <-accepted:
+		defer upstream.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't forwarded")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- p.close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("close() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close() didn't return with a forwarded connection open")
+	}
+	for name, conn := range map[string]net.Conn{"client": client, "upstream": upstream} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("Read() of the %s end after close() error = %v, want io.EOF", name, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package emulator
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Query is like datastore.NewQuery, but it scopes the query to the default
+// namespace of the Emulator set with WithDefaultNamespace, if any.
+func (e *Emulator) Query(kind string) *datastore.Query {
+	q := datastore.NewQuery(kind)
+	if e.namespace != "" {
+		q = q.Namespace(e.namespace)
+	}
+	return q
+}
+
+// GetAll runs the query against the emulator and decodes the results into a
+// slice of T, which must be a struct (or a pointer to one) or a
+// datastore.PropertyList. An empty slice is returned if there are no results.
+func GetAll[T any](ctx context.Context, e *Emulator, q *datastore.Query) ([]T, error) {
+	_, dst, err := GetAllWithKeys[T](ctx, e, q)
+	return dst, err
+}
+
+// GetAllWithKeys is like GetAll, but it also returns the keys of the results.
+func GetAllWithKeys[T any](ctx context.Context, e *Emulator, q *datastore.Query) ([]*datastore.Key, []T, error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	dst := []T{}
+	keys, err := c.GetAll(ctx, q, &dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, dst, nil
+}
+
+// EventualQuery returns a derivative of q requesting eventually consistent
+// results, to exercise stale-read paths with GetAll. Whether the results are
+// actually stale depends on the emulator: it only has an effect on ancestor
+// queries, and none at all if the emulator runs with a consistency of 1.0.
+func EventualQuery(q *datastore.Query) *datastore.Query {
+	return q.EventualConsistency()
+}
+
+// Count returns the number of entities of the kind in the namespace, "" being
+// the default one.
+func (e *Emulator) Count(ctx context.Context, kind, namespace string) (int, error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return c.Count(ctx, datastore.NewQuery(kind).Namespace(namespace))
+}
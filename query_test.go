@@ -0,0 +1,70 @@
+package emulator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestGetAll(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	type entity struct{ N int }
+	got, err := GetAll[entity](ctx, e, datastore.NewQuery("Kind"))
+	if err != nil || got == nil || len(got) != 0 {
+		t.Errorf("GetAll() without results = %v, %v, want an empty slice", got, err)
+	}
+
+	keys := putEntities(t, e, "Kind", "", 3)
+	gotKeys, got, err := GetAllWithKeys[entity](ctx, e, datastore.NewQuery("Kind").Order("__key__"))
+	if err != nil {
+		t.Fatalf("GetAllWithKeys() error = %v", err)
+	}
+	if len(got) != len(keys) || len(gotKeys) != len(keys) {
+		t.Fatalf("GetAllWithKeys() = %v, %v, want %d results", gotKeys, got, len(keys))
+	}
+	for i, k := range gotKeys {
+		if !k.Equal(keys[i]) {
+			t.Errorf("GetAllWithKeys() key %d = %v, want %v", i, k, keys[i])
+		}
+	}
+}
+
+func TestEventualQuery(t *testing.T) {
+	eventual := func(q *datastore.Query) bool {
+		return reflect.ValueOf(q).Elem().FieldByName("eventual").Bool()
+	}
+	q := datastore.NewQuery("Kind")
+	got := EventualQuery(q)
+	if !eventual(got) {
+		t.Error("EventualQuery() returned a strongly consistent query")
+	}
+	if eventual(q) {
+		t.Error("EventualQuery() modified the query")
+	}
+
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	putEntities(t, e, "Kind", "", 2)
+	type entity struct{ N int }
+	if res, err := GetAll[entity](context.Background(), e, got); err != nil || len(res) != 2 {
+		t.Errorf("GetAll() of the eventual query = %v, %v, want 2 results", res, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{}, WithDefaultNamespace("tenant"))
+	ctx := context.Background()
+	putEntities(t, e, "Kind", "tenant", 2)
+	putEntities(t, e, "Kind", "", 3)
+	type entity struct{ N int }
+	if got, err := GetAll[entity](ctx, e, e.Query("Kind")); err != nil || len(got) != 2 {
+		t.Errorf("GetAll(Query()) = %d results, %v, want the 2 of the default namespace", len(got), err)
+	}
+
+	plain := applyOptions(t)
+	if q := plain.Query("Kind"); !reflect.DeepEqual(q, datastore.NewQuery("Kind")) {
+		t.Errorf("Query() without a default namespace = %+v, want datastore.NewQuery", q)
+	}
+}
@@ -0,0 +1,14 @@
+package emulator
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setReaper makes the kernel kill the subprocess when its parent dies.
+func setReaper(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
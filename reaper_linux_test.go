@@ -0,0 +1,39 @@
+package emulator
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestReaper(t *testing.T) {
+	for _, reaper := range []bool{false, true} {
+		var cmd *exec.Cmd
+		opts := append(fakeGcloud(), WithCommand(func(args []string) *exec.Cmd {
+			cmd = exec.Command(os.Args[0], args...)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			return cmd
+		}))
+		if reaper {
+			opts = append(opts, WithReaper())
+		}
+		newTestEmulator(t, opts...)
+		want := syscall.Signal(0)
+		if reaper {
+			want = syscall.SIGKILL
+		}
+		if got := cmd.SysProcAttr.Pdeathsig; got != want {
+			t.Errorf("WithReaper %v: Pdeathsig = %v, want %v", reaper, got, want)
+		}
+		if !cmd.SysProcAttr.Setpgid {
+			t.Errorf("WithReaper %v: the SysProcAttr set by the command was overwritten", reaper)
+		}
+	}
+
+	cmd := exec.Command("true")
+	setReaper(cmd)
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Pdeathsig != syscall.SIGKILL {
+		t.Errorf("setReaper() SysProcAttr = %+v, want Pdeathsig SIGKILL", cmd.SysProcAttr)
+	}
+}
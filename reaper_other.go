@@ -0,0 +1,8 @@
+//go:build !linux
+
+package emulator
+
+import "os/exec"
+
+// setReaper is a no-op: the parent death signal is Linux-only.
+func setReaper(*exec.Cmd) {}
@@ -0,0 +1,153 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestRecord is a request made to the emulator through the request log
+// proxy, see WithRequestLog.
+type RequestRecord struct {
+	// Method is the name of the gRPC method, e.g. "Lookup", or the HTTP
+	// method and path of the other requests, e.g. "POST /reset".
+	Method string
+	// Path is the path of the request, e.g.
+	// "/google.datastore.v1.Datastore/Lookup".
+	Path string
+	// Time is when the request was received.
+	Time time.Time
+}
+
+// requestRecorder is an HTTP proxy forwarding the requests (including the
+// gRPC ones, over unencrypted HTTP/2) to the emulator and recording them.
+type requestRecorder struct {
+	srv   *http.Server
+	addr  string
+	proxy *httputil.ReverseProxy
+	h2c   *http.Transport
+
+	mu      sync.Mutex
+	records []RequestRecord
+}
+
+// startRequestRecorder starts the proxy on a free loopback port, forwarding
+// the gRPC requests to the upstream host-port over unencrypted HTTP/2 and the
+// other requests with the transport.
+func startRequestRecorder(upstream string, transport http.RoundTripper) (*requestRecorder, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "http", Host: upstream}
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	r := &requestRecorder{
+		addr: l.Addr().String(),
+		h2c:  h2c,
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+			},
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if isGRPC(req) {
+					return h2c.RoundTrip(req)
+				}
+				return transport.RoundTrip(req)
+			}),
+			FlushInterval: -1,
+		},
+	}
+	r.srv = &http.Server{Handler: r, Protocols: new(http.Protocols)}
+	r.srv.Protocols.SetHTTP1(true)
+	r.srv.Protocols.SetUnencryptedHTTP2(true)
+	go r.srv.Serve(l)
+	return r, nil
+}
+
+func (r *requestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rec := RequestRecord{Path: req.URL.Path, Time: time.Now()}
+	if isGRPC(req) {
+		rec.Method = path.Base(req.URL.Path)
+	} else {
+		rec.Method = req.Method + " " + req.URL.Path
+	}
+	r.mu.Lock()
+	r.records = append(r.records, rec)
+	r.mu.Unlock()
+	r.proxy.ServeHTTP(w, req)
+}
+
+// log returns a copy of the recorded requests.
+func (r *requestRecorder) log() []RequestRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RequestRecord(nil), r.records...)
+}
+
+// close stops the proxy and closes its connections to the emulator.
+func (r *requestRecorder) close() error {
+	err := r.srv.Close()
+	r.h2c.CloseIdleConnections()
+	return err
+}
+
+// isGRPC reports whether the request is a gRPC call.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// startRequestLog starts the request log proxy in front of the emulator and
+// advertises it instead of the emulator. The package itself keeps talking to
+// the emulator directly, so its own requests (like the health checks and the
+// ones of the helper client, see helperClientOptions) are not recorded.
+func (e *Emulator) startRequestLog() error {
+	if e.scheme == "https" {
+		return errors.New("request log: the https scheme is not supported")
+	}
+	if e.addr == "" {
+		// reused instance
+		e.addr = e.GRPCEndpoint()
+	}
+	r, err := startRequestRecorder(e.addr, e.httpc.Transport)
+	if err != nil {
+		return fmt.Errorf("request log: %w", err)
+	}
+	e.recorder = r
+	e.Host = e.scheme + "://" + r.addr
+	e.setEnv(e.managedEnv(r.addr))
+	return nil
+}
+
+// RequestLog returns the requests made to the emulator through the proxy set
+// up with WithRequestLog, in the order they were received, or nil without the
+// option.
+func (e *Emulator) RequestLog() []RequestRecord {
+	if e.recorder == nil {
+		return nil
+	}
+	return e.recorder.log()
+}
+
+// RequestCounts returns the number of requests recorded by the request log
+// proxy by method, see RequestRecord.Method.
+func (e *Emulator) RequestCounts() map[string]int {
+	counts := map[string]int{}
+	for _, r := range e.RequestLog() {
+		counts[r.Method]++
+	}
+	return counts
+}
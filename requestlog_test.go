@@ -0,0 +1,65 @@
+package emulator
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRequestLog(t *testing.T) {
+	if log := (&Emulator{}).RequestLog(); log != nil {
+		t.Errorf("RequestLog() without the option = %v, want nil", log)
+	}
+	e, f := newAdoptingEmulator(t, fakeConfig{}, WithRequestLog())
+	if e.Host == f.url() {
+		t.Fatal("the emulator is advertised instead of the proxy")
+	}
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := e.NameKey("Kind", "a", nil)
+	if _, err := c.Put(ctx, key, &entity{N: 1}); err != nil {
+		t.Fatalf("Put() through the proxy error = %v", err)
+	}
+	for range 2 {
+		var got entity
+		if err := c.Get(ctx, key, &got); err != nil || got.N != 1 {
+			t.Fatalf("Get() through the proxy = %+v, %v", got, err)
+		}
+	}
+	// the requests of the package itself are not recorded
+	if _, err := e.Count(ctx, "Kind", ""); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(e.Host+"/reset", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	counts := e.RequestCounts()
+	for method, want := range map[string]int{"Commit": 1, "Lookup": 2, "RunQuery": 0, "POST /reset": 1} {
+		if counts[method] != want {
+			t.Errorf("RequestCounts()[%q] = %d, want %d (all: %v)", method, counts[method], want, counts)
+		}
+	}
+	if n := f.rpcCount("Lookup"); n != 2 {
+		t.Errorf("the emulator received %d Lookup calls, want the 2 forwarded by the proxy", n)
+	}
+	if log := e.RequestLog(); len(log) == 0 || log[0].Path != "/google.datastore.v1.Datastore/Commit" || log[0].Time.IsZero() {
+		t.Errorf("RequestLog() = %+v, want the Commit first", log)
+	}
+
+	host := e.Host
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get(host); err == nil {
+		resp.Body.Close()
+		t.Error("the proxy is still serving after Close")
+	}
+}
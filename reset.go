@@ -0,0 +1,233 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// maxBatchSize is the maximum number of entities in a single datastore batch
+// operation.
+const maxBatchSize = 500
+
+// ResetKinds deletes all the entities of the given kinds in all namespaces
+// using the datastore client. Unlike Reset it also works when the emulator
+// stores its data on disk.
+func (e *Emulator) ResetKinds(ctx context.Context, kinds ...string) error {
+	if err := e.checkEmulator(ctx); err != nil {
+		return err
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	namespaces, err := listNamespaces(ctx, c)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		for _, kind := range kinds {
+			if _, err := e.deleteQuery(ctx, c, datastore.NewQuery(kind).Namespace(ns)); err != nil {
+				return err
+			}
+		}
+	}
+	return e.afterReset(ctx, nil)
+}
+
+// ResetMatching deletes the entities of the kind matching all the filters,
+// e.g. a datastore.PropertyFilter on a tenant property, in all namespaces and
+// returns the number of deleted entities.
+func (e *Emulator) ResetMatching(ctx context.Context, kind string, filters ...datastore.EntityFilter) (int, error) {
+	if err := e.checkEmulator(ctx); err != nil {
+		return 0, err
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	namespaces, err := listNamespaces(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, ns := range namespaces {
+		q := datastore.NewQuery(kind).Namespace(ns)
+		for _, f := range filters {
+			q = q.FilterEntity(f)
+		}
+		n, err := e.deleteQuery(ctx, c, q)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, e.afterReset(ctx, nil)
+}
+
+// DeleteAll deletes all the entities of all kinds in all namespaces using the
+// datastore client.
+func (e *Emulator) DeleteAll(ctx context.Context) error {
+	if err := e.checkEmulator(ctx); err != nil {
+		return err
+	}
+	_, err := e.deleteKinds(ctx, func(string) bool { return true })
+	return err
+}
+
+// ResetExcept deletes all the entities in all namespaces except the ones of
+// the given kinds, e.g. reference data which is expensive to seed, and returns
+// the number of deleted entities.
+func (e *Emulator) ResetExcept(ctx context.Context, keepKinds ...string) (int, error) {
+	if err := e.checkEmulator(ctx); err != nil {
+		return 0, err
+	}
+	keep := make(map[string]bool, len(keepKinds))
+	for _, kind := range keepKinds {
+		keep[kind] = true
+	}
+	deleted, err := e.deleteKinds(ctx, func(kind string) bool { return !keep[kind] })
+	return deleted, e.afterReset(ctx, err)
+}
+
+// DeleteMulti deletes the entities with the given keys in batches of the
+// configured size (see WithDeleteBatchSize) and returns the number of deleted
+// entities. The error of a failed batch includes its offset. Like the resets,
+// it fails with ErrNotEmulator unless IsEmulator confirms the endpoint.
+func (e *Emulator) DeleteMulti(ctx context.Context, keys []*datastore.Key) (int, error) {
+	if err := e.checkEmulator(ctx); err != nil {
+		return 0, err
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return e.deleteKeys(ctx, c, keys)
+}
+
+// afterReset calls the function set with WithOnReset after a successful
+// reset, err being the result of the reset.
+func (e *Emulator) afterReset(ctx context.Context, err error) error {
+	if err != nil || e.onReset == nil {
+		return err
+	}
+	if err := e.onReset(ctx); err != nil {
+		return fmt.Errorf("on reset: %w", err)
+	}
+	return nil
+}
+
+// deleteKinds deletes the entities of the kinds matching the predicate in all
+// namespaces and returns the number of deleted entities.
+func (e *Emulator) deleteKinds(ctx context.Context, match func(kind string) bool) (int, error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	namespaces, err := listNamespaces(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, ns := range namespaces {
+		kinds, err := listKinds(ctx, c, ns)
+		if err != nil {
+			return deleted, err
+		}
+		for _, kind := range kinds {
+			if !match(kind) {
+				continue
+			}
+			n, err := e.deleteQuery(ctx, c, datastore.NewQuery(kind).Namespace(ns))
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// deleteQuery deletes all the entities matching the query in batches and
+// returns the number of deleted entities.
+func (e *Emulator) deleteQuery(ctx context.Context, c *datastore.Client, q *datastore.Query) (int, error) {
+	keys, err := c.GetAll(ctx, q.KeysOnly(), nil)
+	if err != nil {
+		return 0, err
+	}
+	return e.deleteKeys(ctx, c, keys)
+}
+
+// deleteKeys deletes the keys in batches of the configured size and returns
+// the number of deleted entities.
+func (e *Emulator) deleteKeys(ctx context.Context, c *datastore.Client, keys []*datastore.Key) (int, error) {
+	size := e.deleteBatchSize
+	if size == 0 {
+		size = maxBatchSize
+	}
+	deleted := 0
+	for len(keys) > 0 {
+		n := min(size, len(keys))
+		if err := c.DeleteMulti(ctx, keys[:n]); err != nil {
+			return deleted, fmt.Errorf("delete batch at offset %d: %w", deleted, err)
+		}
+		deleted += n
+		keys = keys[n:]
+	}
+	return deleted, nil
+}
+
+// IsEmpty reports whether there are no entities in the namespace, "" being
+// the default one. It's a quick check that a test didn't leak any entities.
+func (e *Emulator) IsEmpty(ctx context.Context, namespace string) (bool, error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	kinds, err := listKinds(ctx, c, namespace)
+	if err != nil {
+		return false, err
+	}
+	for _, kind := range kinds {
+		q := datastore.NewQuery(kind).Namespace(namespace).KeysOnly().Limit(1)
+		keys, err := c.GetAll(ctx, q, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// listNamespaces returns all the namespaces in the datastore, including the
+// default one.
+func listNamespaces(ctx context.Context, c *datastore.Client) ([]string, error) {
+	keys, err := c.GetAll(ctx, datastore.NewQuery("__namespace__").KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(keys))
+	for _, k := range keys {
+		namespaces = append(namespaces, k.Name)
+	}
+	return namespaces, nil
+}
+
+// listKinds returns all the kinds in the namespace, except the reserved ones.
+func listKinds(ctx context.Context, c *datastore.Client, namespace string) ([]string, error) {
+	keys, err := c.GetAll(ctx, datastore.NewQuery("__kind__").Namespace(namespace).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k.Name, "__") {
+			kinds = append(kinds, k.Name)
+		}
+	}
+	return kinds, nil
+}
@@ -0,0 +1,354 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestResetContextCanceled(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{resetDelay: time.Minute}, ResetAllProjects())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	began := time.Now()
+	err := e.ResetContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ResetContext() error = %v, want context.Canceled", err)
+	}
+	if d := time.Since(began); d > 5*time.Second {
+		t.Errorf("ResetContext() returned after %v", d)
+	}
+}
+
+// putEntities puts n entities of the kind in the namespace of the emulator
+// project, named from 1 to n.
+func putEntities(tb testing.TB, e *Emulator, kind, namespace string, n int) []*datastore.Key {
+	tb.Helper()
+	ctx := context.Background()
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	type entity struct{ N int }
+	var keys []*datastore.Key
+	for i := 1; i <= n; i++ {
+		key := datastore.NameKey(kind, strconv.Itoa(i), nil)
+		key.Namespace = namespace
+		keys = append(keys, key)
+	}
+	for batch := range slices.Chunk(keys, maxBatchSize) {
+		entities := make([]entity, len(batch))
+		if _, err := c.PutMulti(ctx, batch, entities); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestDeleteBatchSize(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{}, WithDeleteBatchSize(250))
+	ctx := context.Background()
+	putEntities(t, e, "Kind", "", 1001)
+	commits := f.rpcCount("Commit")
+	if err := e.DeleteAll(ctx); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if n := f.rpcCount("Commit") - commits; n != 5 {
+		t.Errorf("DeleteAll() deleted 1001 entities in %d batches, want 5", n)
+	}
+	if empty, err := e.IsEmpty(ctx, ""); err != nil || !empty {
+		t.Errorf("IsEmpty() = %v, %v after DeleteAll", empty, err)
+	}
+
+	for _, n := range []int{0, maxBatchSize + 1} {
+		if err := WithDeleteBatchSize(n)(&Emulator{}); err == nil {
+			t.Errorf("WithDeleteBatchSize(%d) error = nil", n)
+		}
+	}
+}
+
+func TestResetScope(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T, opts ...Option) (*Emulator, *Emulator, *fakeServer) {
+		e, f := newAdoptingEmulator(t, fakeConfig{}, opts...)
+		advertise(t, f.url(), "other")
+		other := newTestEmulator(t, WithRandomPort())
+		putEntities(t, e, "Kind", "", 3)
+		putEntities(t, e, "Kind", "ns", 3)
+		putEntities(t, other, "Kind", "", 3)
+		return e, other, f
+	}
+
+	t.Run("project", func(t *testing.T) {
+		e, other, f := setup(t)
+		if err := e.Reset(); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		for _, ns := range []string{"", "ns"} {
+			if empty, err := e.IsEmpty(ctx, ns); err != nil || !empty {
+				t.Errorf("IsEmpty(%q) = %v, %v after Reset", ns, empty, err)
+			}
+		}
+		if n, err := other.Count(ctx, "Kind", ""); err != nil || n != 3 {
+			t.Errorf("Count() of the other project = %d, %v, want its data intact", n, err)
+		}
+		if _, resets, _ := f.stats(); resets != 0 {
+			t.Errorf("Reset() used the reset endpoint %d times", resets)
+		}
+	})
+
+	t.Run("all projects", func(t *testing.T) {
+		e, other, f := setup(t, ResetAllProjects())
+		if err := e.Reset(); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		if _, resets, _ := f.stats(); resets != 1 {
+			t.Errorf("Reset() used the reset endpoint %d times, want 1", resets)
+		}
+		if n, err := other.Count(ctx, "Kind", ""); err != nil || n != 0 {
+			t.Errorf("Count() of the other project = %d, %v, want its data wiped", n, err)
+		}
+	})
+}
+
+func TestResetFallback(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{noReset: true}, ResetAllProjects())
+	ctx := context.Background()
+	for range 2 {
+		putEntities(t, e, "Kind", "ns", 3)
+		if err := e.Reset(); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		if empty, err := e.IsEmpty(ctx, "ns"); err != nil || !empty {
+			t.Errorf("IsEmpty() = %v, %v after Reset", empty, err)
+		}
+	}
+	if _, resets, _ := f.stats(); resets != 1 {
+		t.Errorf("the reset endpoint was requested %d times, want the fallback remembered", resets)
+	}
+}
+
+func TestResetExcept(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	putEntities(t, e, "Keep", "", 2)
+	putEntities(t, e, "Keep", "ns", 2)
+	putEntities(t, e, "Wipe", "", 3)
+	putEntities(t, e, "Wipe", "ns", maxBatchSize+1)
+	n, err := e.ResetExcept(ctx, "Keep")
+	if err != nil {
+		t.Fatalf("ResetExcept() error = %v", err)
+	}
+	if want := maxBatchSize + 4; n != want {
+		t.Errorf("ResetExcept() = %d, want %d", n, want)
+	}
+	for _, ns := range []string{"", "ns"} {
+		if n, err := e.Count(ctx, "Keep", ns); err != nil || n != 2 {
+			t.Errorf("Count(Keep, %q) = %d, %v, want the kept kind intact", ns, n, err)
+		}
+		if n, err := e.Count(ctx, "Wipe", ns); err != nil || n != 0 {
+			t.Errorf("Count(Wipe, %q) = %d, %v, want the kind cleared", ns, n, err)
+		}
+	}
+}
+
+func TestResetAsync(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	e, f := newAdoptingEmulator(t, fakeConfig{resetDelay: delay}, ResetAllProjects())
+	putEntities(t, e, "Kind", "", 3)
+	began := time.Now()
+	var results []<-chan error
+	for range 3 {
+		results = append(results, e.ResetAsync())
+	}
+	for _, errc := range results {
+		if err := <-errc; err != nil {
+			t.Errorf("ResetAsync() error = %v", err)
+		}
+	}
+	if d := time.Since(began); d < 3*delay {
+		t.Errorf("3 concurrent resets took %v, want them serialized", d)
+	}
+	if _, resets, _ := f.stats(); resets != 3 {
+		t.Errorf("the reset endpoint was requested %d times, want 3", resets)
+	}
+	if n, err := e.Count(context.Background(), "Kind", ""); err != nil || n != 0 {
+		t.Errorf("Count() after ResetAsync = %d, %v, want 0", n, err)
+	}
+}
+
+func TestResetMatching(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entity struct{ Tenant string }
+	var keys []*datastore.Key
+	var entities []entity
+	for _, ns := range []string{"", "ns"} {
+		for i, tenant := range []string{"t1", "t1", "t2"} {
+			key := datastore.IDKey("Kind", int64(i+1), nil)
+			key.Namespace = ns
+			keys = append(keys, key)
+			entities = append(entities, entity{Tenant: tenant})
+		}
+	}
+	if _, err := c.PutMulti(ctx, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	n, err := e.ResetMatching(ctx, "Kind", datastore.PropertyFilter{FieldName: "Tenant", Operator: "=", Value: "t1"})
+	if err != nil || n != 4 {
+		t.Errorf("ResetMatching() = %d, %v, want 4", n, err)
+	}
+	for _, ns := range []string{"", "ns"} {
+		got, err := GetAll[entity](ctx, e, datastore.NewQuery("Kind").Namespace(ns))
+		if err != nil || len(got) != 1 || got[0].Tenant != "t2" {
+			t.Errorf("the entities left in namespace %q = %v, %v, want the t2 one", ns, got, err)
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	for _, ns := range []string{"", "ns"} {
+		if empty, err := e.IsEmpty(ctx, ns); err != nil || !empty {
+			t.Errorf("IsEmpty(%q) of a new emulator = %v, %v, want true", ns, empty, err)
+		}
+	}
+	putEntities(t, e, "Kind", "ns", 1)
+	if empty, err := e.IsEmpty(ctx, "ns"); err != nil || empty {
+		t.Errorf("IsEmpty(ns) after a put = %v, %v, want false", empty, err)
+	}
+	if empty, err := e.IsEmpty(ctx, ""); err != nil || !empty {
+		t.Errorf("IsEmpty(\"\") after a put in another namespace = %v, %v, want true", empty, err)
+	}
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := e.IsEmpty(ctx, "ns"); err != nil || !empty {
+		t.Errorf("IsEmpty(ns) after Reset = %v, %v, want true", empty, err)
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	keys := putEntities(t, e, "Kind", "", 1200)
+	commits := f.rpcCount("Commit")
+	n, err := e.DeleteMulti(ctx, keys)
+	if err != nil || n != 1200 {
+		t.Fatalf("DeleteMulti() = %d, %v, want 1200", n, err)
+	}
+	if n := f.rpcCount("Commit") - commits; n != 3 {
+		t.Errorf("DeleteMulti() deleted 1200 entities in %d batches, want 3", n)
+	}
+	if empty, err := e.IsEmpty(ctx, ""); err != nil || !empty {
+		t.Errorf("IsEmpty() = %v, %v after DeleteMulti", empty, err)
+	}
+
+	keys = putEntities(t, e, "Kind", "", 1200)
+	keys[700] = datastore.IncompleteKey("Kind", nil)
+	n, err = e.DeleteMulti(ctx, keys)
+	if err == nil || n != maxBatchSize || !strings.Contains(err.Error(), "offset 500") {
+		t.Errorf("DeleteMulti() with an invalid key in the second batch = %d, %v, want the first batch deleted and the offset reported", n, err)
+	}
+}
+
+func TestOnReset(t *testing.T) {
+	calls := 0
+	var fail error
+	var e *Emulator
+	e, _ = newAdoptingEmulator(t, fakeConfig{}, WithOnReset(func(ctx context.Context) error {
+		calls++
+		putEntities(t, e, "Fixture", "", 1) // re-seed
+		return fail
+	}))
+	ctx := context.Background()
+	resets := map[string]func() error{
+		"Reset":        e.Reset,
+		"ResetContext": func() error { return e.ResetContext(ctx) },
+		"ResetKinds":   func() error { return e.ResetKinds(ctx, "Kind") },
+		"ResetMatching": func() error {
+			_, err := e.ResetMatching(ctx, "Kind")
+			return err
+		},
+		"ResetExcept": func() error {
+			_, err := e.ResetExcept(ctx)
+			return err
+		},
+	}
+	for name, reset := range resets {
+		calls, fail = 0, nil
+		putEntities(t, e, "Kind", "", 2)
+		if err := reset(); err != nil {
+			t.Errorf("%s() error = %v", name, err)
+		}
+		if calls != 1 {
+			t.Errorf("%s() called the callback %d times, want 1", name, calls)
+		}
+		if n, err := e.Count(ctx, "Fixture", ""); err != nil || n != 1 {
+			t.Errorf("Count() of the fixtures after %s() = %d, %v, want them re-seeded", name, n, err)
+		}
+
+		fail = errors.New("seed failed")
+		if err := reset(); !errors.Is(err, fail) {
+			t.Errorf("%s() error = %v, want the callback error", name, err)
+		}
+	}
+}
+
+func TestCloseGraceful(t *testing.T) {
+	// resetStarted starts a ResetAsync and waits for its request to arrive.
+	resetStarted := func(t *testing.T, e *Emulator, f *fakeServer) <-chan error {
+		errc := e.ResetAsync()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			if _, resets, _ := f.stats(); resets > 0 {
+				return errc
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the reset didn't start")
+			}
+		}
+	}
+
+	t.Run("waits", func(t *testing.T) {
+		e, f := newAdoptingEmulator(t, fakeConfig{resetDelay: 200 * time.Millisecond}, ResetAllProjects())
+		errc := resetStarted(t, e, f)
+		if err := e.CloseGraceful(context.Background()); err != nil {
+			t.Errorf("CloseGraceful() error = %v", err)
+		}
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("ResetAsync() error = %v, want the reset completed", err)
+			}
+		default:
+			t.Error("CloseGraceful() returned before the reset in progress finished")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		e, f := newAdoptingEmulator(t, fakeConfig{resetDelay: time.Minute}, ResetAllProjects())
+		errc := resetStarted(t, e, f)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		began := time.Now()
+		if err := e.CloseGraceful(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CloseGraceful() error = %v, want context.DeadlineExceeded", err)
+		}
+		if d := time.Since(began); d > 5*time.Second {
+			t.Errorf("CloseGraceful() returned after %v, want the emulator force closed at the deadline", d)
+		}
+		f.close() // ends the pending reset
+		<-errc
+	})
+}
@@ -0,0 +1,133 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is an entity to be seeded. The key is built from the name or, if
+// the name is empty, from the ID; if both are empty the key is incomplete and
+// the ID is allocated by the emulator. The default namespace of the Emulator
+// is used if the namespace is empty.
+type Fixture struct {
+	Kind       string         `json:"kind" yaml:"kind"`
+	Namespace  string         `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Name       string         `json:"name,omitempty" yaml:"name,omitempty"`
+	ID         int64          `json:"id,omitempty" yaml:"id,omitempty"`
+	Properties map[string]any `json:"properties" yaml:"properties"`
+}
+
+// Seed puts the fixtures from the given JSON or YAML files (told apart by
+// their extension), each holding an array of fixtures, into the emulator.
+func (e *Emulator) Seed(ctx context.Context, paths ...string) error {
+	var fixtures []Fixture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("seed: %w", err)
+		}
+		ff, err := decodeFixtureFile(path, data)
+		if err != nil {
+			return fmt.Errorf("seed: %s: %w", path, err)
+		}
+		fixtures = append(fixtures, ff...)
+	}
+	return e.SeedFixtures(ctx, fixtures...)
+}
+
+// SeedFS is like Seed, but it reads the files matching the glob pattern (see
+// fs.Glob) from fsys, e.g. an embed.FS compiling the fixtures into the test
+// binary.
+func (e *Emulator) SeedFS(ctx context.Context, fsys fs.FS, glob string) error {
+	paths, err := fs.Glob(fsys, glob)
+	if err != nil {
+		return fmt.Errorf("seed: %w", err)
+	}
+	var fixtures []Fixture
+	for _, path := range paths {
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return fmt.Errorf("seed: %w", err)
+		}
+		ff, err := decodeFixtureFile(path, data)
+		if err != nil {
+			return fmt.Errorf("seed: %s: %w", path, err)
+		}
+		fixtures = append(fixtures, ff...)
+	}
+	return e.SeedFixtures(ctx, fixtures...)
+}
+
+// SeedFixtures puts the fixtures into the emulator.
+func (e *Emulator) SeedFixtures(ctx context.Context, fixtures ...Fixture) error {
+	keys := make([]*datastore.Key, len(fixtures))
+	entities := make([]datastore.PropertyList, len(fixtures))
+	for i, f := range fixtures {
+		pl, err := PropertyList(f.Properties)
+		if err != nil {
+			return fmt.Errorf("seed: %s: %w", f.Kind, err)
+		}
+		keys[i], entities[i] = e.fixtureKey(f), pl
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return fmt.Errorf("seed: %w", err)
+	}
+	for len(keys) > 0 {
+		n := min(maxBatchSize, len(keys))
+		if _, err := c.PutMulti(ctx, keys[:n], entities[:n]); err != nil {
+			return fmt.Errorf("seed: %w", err)
+		}
+		keys, entities = keys[n:], entities[n:]
+	}
+	return nil
+}
+
+func (e *Emulator) fixtureKey(f Fixture) *datastore.Key {
+	b := e.Keys()
+	if f.Namespace != "" {
+		b.Namespace = f.Namespace
+	}
+	switch {
+	case f.Name != "":
+		return b.Name(f.Kind, f.Name, nil)
+	case f.ID != 0:
+		return b.ID(f.Kind, f.ID, nil)
+	}
+	return b.Incomplete(f.Kind, nil)
+}
+
+// decodeFixtureFile decodes the fixtures in the file at path, as YAML if it
+// has the .yaml or .yml extension, as JSON otherwise.
+func decodeFixtureFile(path string, data []byte) ([]Fixture, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var fixtures []Fixture
+		if err := yaml.Unmarshal(data, &fixtures); err != nil {
+			return nil, err
+		}
+		return fixtures, nil
+	}
+	return decodeFixtures(data)
+}
+
+// decodeFixtures decodes a JSON array of fixtures, keeping the numbers as
+// json.Number so that integers are not turned into floats.
+func decodeFixtures(data []byte) ([]Fixture, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var fixtures []Fixture
+	if err := d.Decode(&fixtures); err != nil {
+		return nil, err
+	}
+	return fixtures, nil
+}
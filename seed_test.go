@@ -0,0 +1,48 @@
+package emulator
+
+import (
+	"context"
+	"embed"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+//go:embed testdata/fixtures
+var fixturesFS embed.FS
+
+func TestSeedFS(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	if err := e.SeedFS(ctx, fixturesFS, "testdata/fixtures/*"); err != nil {
+		t.Fatalf("SeedFS() error = %v", err)
+	}
+	for _, tt := range []struct {
+		kind, namespace string
+		want            int
+	}{{"Country", "", 2}, {"Order", "shop", 1}} {
+		if n, err := e.Count(ctx, tt.kind, tt.namespace); err != nil || n != tt.want {
+			t.Errorf("Count(%s) = %d, %v, want %d", tt.kind, n, err, tt.want)
+		}
+	}
+	type country struct {
+		Name       string
+		Population int64
+	}
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got country
+	if err := c.Get(ctx, e.NameKey("Country", "pl", nil), &got); err != nil || got.Name != "Poland" || got.Population != 38000000 {
+		t.Errorf("Get(pl) = %+v, %v, want the JSON fixture with an integer population", got, err)
+	}
+
+	broken := fstest.MapFS{"broken.yaml": {Data: []byte("- kind: [")}}
+	if err := e.SeedFS(ctx, broken, "*.yaml"); err == nil || !strings.Contains(err.Error(), "broken.yaml") {
+		t.Errorf("SeedFS() of a broken file error = %v, want the file named", err)
+	}
+	if err := e.SeedFS(ctx, broken, "["); err == nil {
+		t.Error("SeedFS() with a malformed pattern error = nil")
+	}
+}
@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// the kind and namespace of the canary entity unless set otherwise, which are
+// unlikely to collide with the data of the tests
+var (
+	defaultSelfTestKind      = "EmulatorSelfTest"
+	defaultSelfTestNamespace = "datastore-emulator-go"
+)
+
+type canary struct {
+	Value string
+}
+
+// SelfTest checks that the emulator actually works by writing a canary entity,
+// reading it back and deleting it. Unlike the health check it catches the
+// cases where the emulator is up but the datastore API misbehaves. The canary
+// is deleted even if the check fails; its kind and namespace can be set with
+// WithSelfTestKind and WithSelfTestNamespace.
+func (e *Emulator) SelfTest(ctx context.Context) (err error) {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+	key := datastore.NameKey(e.selfTestKind, "canary", nil)
+	key.Namespace = e.selfTestNamespace
+	want := canary{Value: strconv.FormatInt(time.Now().UnixNano(), 10)}
+	if _, err := c.Put(ctx, key, &want); err != nil {
+		return fmt.Errorf("self test: put: %w", err)
+	}
+	defer func() {
+		if derr := c.Delete(ctx, key); derr != nil {
+			err = errors.Join(err, fmt.Errorf("self test: delete: %w", derr))
+		}
+	}()
+	var got canary
+	if err := c.Get(ctx, key, &got); err != nil {
+		return fmt.Errorf("self test: get: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("self test: got %q, want %q", got.Value, want.Value)
+	}
+	return nil
+}
+
+// prewarmRounds is the number of self tests run by the prewarm.
+const prewarmRounds = 3
+
+// runPrewarm warms up the emulator with a few self tests and queries, as the
+// first datastore requests after the startup are noticeably slower.
+func (e *Emulator) runPrewarm(ctx context.Context) error {
+	began := time.Now()
+	defer func() { e.prewarmDuration = time.Since(began) }()
+	for range prewarmRounds {
+		if err := e.SelfTest(ctx); err != nil {
+			return fmt.Errorf("prewarm: %w", err)
+		}
+		if err := e.datastoreProbe(); err != nil {
+			return fmt.Errorf("prewarm: %w", err)
+		}
+	}
+	return nil
+}
+
+// PrewarmDuration returns how long the prewarm set with WithPrewarm took
+// during the last startup, which is not included in the startup duration
+// reported to the Metrics, or 0 if there was no prewarm.
+func (e *Emulator) PrewarmDuration() time.Duration {
+	return e.prewarmDuration
+}
+
+// ReadyProbe selects how the startup of the emulator is confirmed.
+type ReadyProbe int
+
+const (
+	// ProbeHTTP confirms the startup with the health check (the default).
+	ProbeHTTP ReadyProbe = iota
+	// ProbeDatastore additionally waits for a datastore RPC to succeed, as
+	// the health check may pass before the datastore service is fully
+	// initialized, failing the first query of the tests.
+	ProbeDatastore
+)
+
+// datastoreProbe runs a trivial datastore query, a keys-only query of a kind
+// which doesn't exist.
+func (e *Emulator) datastoreProbe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pollingRate)
+	defer cancel()
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	q := datastore.NewQuery(e.selfTestKind).Namespace(e.selfTestNamespace).KeysOnly().Limit(1)
+	if _, err := c.GetAll(ctx, q, nil); err != nil {
+		return fmt.Errorf("datastore probe: %w", err)
+	}
+	return nil
+}
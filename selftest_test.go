@@ -0,0 +1,144 @@
+package emulator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		e, f := newAdoptingEmulator(t, fakeConfig{}, WithSelfTestKind("Canary"), WithSelfTestNamespace("canaries"))
+		ctx := context.Background()
+		if err := e.SelfTest(ctx); err != nil {
+			t.Fatalf("SelfTest() error = %v", err)
+		}
+		want := keyString(&datastorepb.Key{
+			PartitionId: &datastorepb.PartitionId{NamespaceId: "canaries"},
+			Path:        []*datastorepb.Key_PathElement{{Kind: "Canary", IdType: &datastorepb.Key_PathElement_Name{Name: "canary"}}},
+		})
+		if got := f.written(e.ProjectID); len(got) != 1 || got[0] != want {
+			t.Errorf("SelfTest() wrote %q, want only the canary", got)
+		}
+		if empty, err := e.IsEmpty(ctx, "canaries"); err != nil || !empty {
+			t.Errorf("IsEmpty() = %v, %v, want the canary deleted", empty, err)
+		}
+	})
+
+	t.Run("failed check", func(t *testing.T) {
+		failLookup := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if path.Base(method) == "Lookup" {
+				return status.Error(codes.Internal, "lookup failed")
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		e, f := newAdoptingEmulator(t, fakeConfig{}, WithClientOptions(option.WithGRPCDialOption(grpc.WithUnaryInterceptor(failLookup))))
+		ctx := context.Background()
+		if err := e.SelfTest(ctx); err == nil || !strings.Contains(err.Error(), "self test: get") {
+			t.Fatalf("SelfTest() error = %v, want the get failure", err)
+		}
+		if n := f.rpcCount("Commit"); n != 2 {
+			t.Errorf("the emulator received %d Commit calls, want the put and the delete", n)
+		}
+		if empty, err := e.IsEmpty(ctx, e.selfTestNamespace); err != nil || !empty {
+			t.Errorf("IsEmpty() = %v, %v, want the canary deleted despite the failure", empty, err)
+		}
+	})
+
+	t.Run("broken datastore API", func(t *testing.T) {
+		// the health check passes, but there is no datastore API
+		srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		defer srv.Close()
+		advertise(t, srv.URL, DefaultProject)
+		e := newTestEmulator(t, WithRandomPort())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := e.SelfTest(ctx); err == nil || !strings.Contains(err.Error(), "self test: put") {
+			t.Errorf("SelfTest() error = %v, want the put failure", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, opt := range []Option{WithSelfTestKind(""), WithSelfTestKind("__reserved__")} {
+			if err := opt(&Emulator{}); err == nil {
+				t.Error("invalid self test kind accepted")
+			}
+		}
+	})
+}
+
+func TestReadyProbe(t *testing.T) {
+	confirm := func(t *testing.T, host string, opts ...Option) (*Emulator, *StartupError) {
+		e := applyOptions(t, opts...)
+		e.Host, e.addr, e.ProjectID = "http://"+host, host, "test"
+		e.proc = &process{done: make(chan struct{})}
+		t.Cleanup(func() { _ = e.closeSharedClient() })
+		return e, e.confirmStartup(context.Background())
+	}
+
+	for _, probe := range []ReadyProbe{ProbeHTTP, ProbeDatastore} {
+		f := startFakeServer(t, fakeConfig{})
+		if _, err := confirm(t, f.addr, WithReadyProbe(probe), WithTimeout(5*time.Second)); err != nil {
+			t.Fatalf("confirmStartup() with probe %d = %v", probe, err)
+		}
+		want := 0
+		if probe == ProbeDatastore {
+			want = 1
+		}
+		if n := f.rpcCount("RunQuery"); n != want {
+			t.Errorf("probe %d: the emulator received %d RunQuery calls, want %d", probe, n, want)
+		}
+	}
+
+	t.Run("no datastore API", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		defer srv.Close()
+		_, err := confirm(t, strings.TrimPrefix(srv.URL, "http://"), WithReadyProbe(ProbeDatastore), WithTimeout(5*pollingRate))
+		if err == nil || err.LastProbe == nil || !strings.Contains(err.LastProbe.Error(), "datastore probe") {
+			t.Errorf("confirmStartup() = %v, want the failed datastore probe despite the healthy health check", err)
+		}
+	})
+
+	if err := WithReadyProbe(ReadyProbe(-1))(&Emulator{}); err == nil {
+		t.Error("an unknown ready probe was accepted")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	f := startFakeServer(t, fakeConfig{})
+	e := applyOptions(t)
+	e.Host, e.addr, e.ProjectID = f.url(), f.addr, "test"
+	t.Cleanup(func() { _ = e.closeSharedClient() })
+	if err := e.runPrewarm(context.Background()); err != nil {
+		t.Fatalf("runPrewarm() error = %v", err)
+	}
+	// each round puts, gets and deletes the canary, and queries
+	for method, want := range map[string]int{"Commit": 2 * prewarmRounds, "Lookup": prewarmRounds, "RunQuery": prewarmRounds} {
+		if n := f.rpcCount(method); n != want {
+			t.Errorf("the prewarm issued %d %s calls, want %d", n, method, want)
+		}
+	}
+	if e.PrewarmDuration() <= 0 {
+		t.Errorf("PrewarmDuration() = %v, want the time of the prewarm", e.PrewarmDuration())
+	}
+	if n, err := e.Count(context.Background(), e.selfTestKind, e.selfTestNamespace); err != nil || n != 0 {
+		t.Errorf("Count() of the canaries = %d, %v, want none left behind", n, err)
+	}
+
+	if d := newFakeEmulator(t, nil, WithPrewarm()).PrewarmDuration(); d <= 0 {
+		t.Errorf("PrewarmDuration() after Start with WithPrewarm = %v, want the time of the prewarm", d)
+	}
+	if d := newFakeEmulator(t, nil).PrewarmDuration(); d != 0 {
+		t.Errorf("PrewarmDuration() without WithPrewarm = %v, want 0", d)
+	}
+}
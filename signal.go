@@ -0,0 +1,33 @@
+package emulator
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// TrapSignals makes the emulators get closed (see CloseAll) when the process
+// receives SIGINT or SIGTERM, e.g. when a CI job is canceled, which otherwise
+// leaves them orphaned. The signal is then raised again, so that the process
+// terminates as it would have without the trap. The returned context is done
+// when a signal is received; the cancel function uninstalls the trap.
+func TrapSignals(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case sig := <-sigs:
+			_ = CloseAll()
+			cancel()
+			signal.Stop(sigs)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				_ = p.Signal(sig)
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
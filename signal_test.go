@@ -0,0 +1,69 @@
+//go:build unix
+
+package emulator
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTrapSignals(t *testing.T) {
+	// a handler of our own keeps the raised signals from killing the tests
+	received := make(chan os.Signal, 4)
+	signal.Notify(received, syscall.SIGTERM)
+	defer signal.Stop(received)
+	raise := func() {
+		t.Helper()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSignal := func() {
+		t.Helper()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the signal wasn't delivered")
+		}
+	}
+
+	t.Run("signal", func(t *testing.T) {
+		e := newFakeEmulator(t, nil)
+		ctx, cancel := TrapSignals(context.Background())
+		defer cancel()
+		raise()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("the context isn't done after the signal")
+		}
+		if got := e.State(); got != StateClosed {
+			t.Errorf("State() after the signal = %v, want %v", got, StateClosed)
+		}
+		// the signal and its re-raise
+		waitSignal()
+		waitSignal()
+	})
+
+	t.Run("uninstalled", func(t *testing.T) {
+		e := newFakeEmulator(t, nil)
+		ctx, cancel := TrapSignals(context.Background())
+		cancel()
+		<-ctx.Done()
+		time.Sleep(pollingRate) // for the trap to stop
+		raise()
+		waitSignal()
+		select {
+		case <-received:
+			t.Error("the uninstalled trap raised the signal again")
+		case <-time.After(3 * pollingRate):
+		}
+		if got := e.State(); got != StateReady {
+			t.Errorf("State() after the signal = %v, want the uninstalled trap to leave it %v", got, StateReady)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package emulator
+
+// State is a stage of the lifecycle of an Emulator.
+type State int32
+
+const (
+	// StateNew is the state of an Emulator which wasn't started yet.
+	StateNew State = iota
+	// StateStarting is the state of an Emulator while it's starting (or
+	// restarting) the emulator.
+	StateStarting
+	// StateReady is the state of an Emulator whose startup succeeded.
+	StateReady
+	// StateClosing is the state of an Emulator while it's being closed.
+	StateClosing
+	// StateClosed is the state of a closed Emulator.
+	StateClosed
+	// StateFailed is the state of an Emulator whose startup failed.
+	StateFailed
+)
+
+var stateNames = [...]string{"new", "starting", "ready", "closing", "closed", "failed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// State returns the current lifecycle state of the Emulator.
+func (e *Emulator) State() State {
+	return State(e.state.Load())
+}
+
+// setState transitions the Emulator to the state, calling the function set
+// with WithOnStateChange if the state changed. The transitions are serialized,
+// so the function observes them in order.
+func (e *Emulator) setState(s State) {
+	e.stateMu.Lock()
+	defer e.stateMu.Unlock()
+	old := State(e.state.Swap(int32(s)))
+	if old != s && e.onStateChange != nil {
+		e.onStateChange(old, s)
+	}
+}
+
+// setStateAfter transitions the Emulator to the state if err is nil, or to
+// StateFailed otherwise.
+func (e *Emulator) setStateAfter(err error, s State) {
+	if err != nil {
+		s = StateFailed
+	}
+	e.setState(s)
+}
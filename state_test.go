@@ -0,0 +1,57 @@
+package emulator
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []State
+	)
+	record := WithOnStateChange(func(old, new State) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) == 0 || seen[len(seen)-1] != old {
+			t.Errorf("transition %v -> %v, want it from the last state %v", old, new, seen)
+		}
+		seen = append(seen, new)
+	})
+	e := applyOptions(t, append(fakeGcloud(), record)...)
+	seen = []State{e.State()}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = e.ForceClose() })
+	if got := e.State(); got != StateReady {
+		t.Errorf("State() after Start = %v, want %v", got, StateReady)
+	}
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []State{StateNew, StateStarting, StateReady, StateStarting, StateReady, StateClosing, StateClosed}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(seen, want) {
+		t.Errorf("states = %v, want %v", seen, want)
+	}
+
+	f := applyOptions(t, fakeGcloud("FAKE_FAIL=exit")...)
+	if err := f.Start(); err == nil {
+		t.Fatal("Start() error = nil, want the startup failure")
+	}
+	if got := f.State(); got != StateFailed {
+		t.Errorf("State() after a failed Start = %v, want %v", got, StateFailed)
+	}
+	if got := State(-1).String(); got != "unknown" {
+		t.Errorf("State(-1).String() = %q, want unknown", got)
+	}
+}
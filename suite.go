@@ -0,0 +1,116 @@
+package emulator
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Suite encapsulates the usual lifecycle of an integration test suite: an
+// emulator started once and seeded with base fixtures, reset to that baseline
+// before each test, and closed at the end, by TestMain.
+//
+//	var suite = &emulator.Suite{Fixtures: fixtures, ProtectedKinds: []string{"Country"}}
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		if err := suite.Close(); err != nil {
+//			log.Print(err)
+//		}
+//		os.Exit(code)
+//	}
+//
+//	func TestOrders(t *testing.T) {
+//		suite.Setup(t)
+//		t.Run("create", func(t *testing.T) {
+//			suite.BeforeEach(t)
+//			// ...
+//		})
+//	}
+type Suite struct {
+	// Options are the options of the emulator.
+	Options []Option
+	// Fixtures are the base fixtures seeded by Setup and restored by
+	// BeforeEach.
+	Fixtures []Fixture
+	// ProtectedKinds are the kinds which are not reset by BeforeEach, e.g.
+	// reference data which is expensive to seed. Their fixtures are only
+	// seeded once.
+	ProtectedKinds []string
+
+	once     sync.Once
+	emulator *Emulator
+	err      error
+}
+
+// Setup starts the emulator and seeds the fixtures, once for all the calls,
+// failing tb if it fails. It can be called by any number of tests; the
+// emulator is not tied to any of them and stays up until Close.
+func (s *Suite) Setup(tb testing.TB) *Emulator {
+	tb.Helper()
+	s.once.Do(func() {
+		s.emulator, s.err = New(s.Options...)
+		if s.err != nil {
+			return
+		}
+		s.err = s.emulator.SeedFixtures(context.Background(), s.Fixtures...)
+	})
+	if s.err != nil {
+		tb.Fatalf("emulator suite setup: %v", s.err)
+	}
+	return s.emulator
+}
+
+// Close closes the emulator started by Setup, if any. It's meant to be called
+// by TestMain once all the tests have run.
+func (s *Suite) Close() error {
+	if s.emulator == nil {
+		return nil
+	}
+	return s.emulator.Close()
+}
+
+// BeforeEach resets the emulator to the seeded baseline: it deletes all the
+// entities except the ones of the protected kinds and re-seeds the fixtures of
+// the other kinds, failing tb if it fails. Setup must have been called.
+func (s *Suite) BeforeEach(tb testing.TB) *Emulator {
+	tb.Helper()
+	if s.emulator == nil {
+		tb.Fatal("emulator suite: BeforeEach called before Setup")
+	}
+	ctx := context.Background()
+	if _, err := s.emulator.ResetExcept(ctx, s.ProtectedKinds...); err != nil {
+		tb.Fatalf("emulator suite reset: %v", err)
+	}
+	var fixtures []Fixture
+	for _, f := range s.Fixtures {
+		if !slices.Contains(s.ProtectedKinds, f.Kind) {
+			fixtures = append(fixtures, f)
+		}
+	}
+	if err := s.emulator.SeedFixtures(ctx, fixtures...); err != nil {
+		tb.Fatalf("emulator suite seed: %v", err)
+	}
+	return s.emulator
+}
+
+// ResetBetween resets the emulator (see Reset), failing tb if it fails. It's
+// meant to be called at the top of each case of a table-driven test sharing
+// the emulator, which isolates the cases without restarting it:
+//
+//	for _, tc := range cases {
+//		t.Run(tc.name, func(t *testing.T) {
+//			e.ResetBetween(t)
+//			// ...
+//		})
+//	}
+//
+// The cases must not run in parallel, as each reset wipes the data of the
+// others.
+func (e *Emulator) ResetBetween(tb testing.TB) {
+	tb.Helper()
+	if err := e.Reset(); err != nil {
+		tb.Fatalf("emulator reset: %v", err)
+	}
+}
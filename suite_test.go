@@ -0,0 +1,72 @@
+package emulator
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSuite(t *testing.T) {
+	s := &Suite{
+		Options: fakeGcloud(),
+		Fixtures: []Fixture{
+			{Kind: "Country", Name: "pl", Properties: map[string]any{"Name": "Poland"}},
+			{Kind: "Order", Name: "first", Properties: map[string]any{"Total": 1}},
+		},
+		ProtectedKinds: []string{"Country"},
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	e := s.Setup(t)
+	if again := s.Setup(t); again != e {
+		t.Error("Setup() started another emulator")
+	}
+	ctx := context.Background()
+	count := func(t *testing.T, kind string, want int) {
+		t.Helper()
+		if n, err := e.Count(ctx, kind, ""); err != nil || n != want {
+			t.Errorf("Count(%s) = %d, %v, want %d", kind, n, err, want)
+		}
+	}
+
+	t.Run("write", func(t *testing.T) {
+		s.BeforeEach(t)
+		count(t, "Order", 1)
+		if err := e.SeedFixtures(ctx, Fixture{Kind: "Order", Name: "second"}, Fixture{Kind: "Country", Name: "de"}); err != nil {
+			t.Fatal(err)
+		}
+		count(t, "Order", 2)
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+		s.BeforeEach(t)
+		count(t, "Order", 1)
+		// the protected kinds are neither reset nor re-seeded
+		count(t, "Country", 2)
+	})
+}
+
+func TestResetBetween(t *testing.T) {
+	e := newFakeEmulator(t, nil)
+	ctx := context.Background()
+	cases := []struct {
+		name string
+		put  int
+	}{
+		{name: "one", put: 1},
+		{name: "three", put: 3},
+		{name: "two", put: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e.ResetBetween(t)
+			putEntities(t, e, "Kind", "", tc.put)
+			// nothing is left over from the previous cases
+			if n, err := e.Count(ctx, "Kind", ""); err != nil || n != tc.put {
+				t.Errorf("Count() = %d, %v, want %d", n, err, tc.put)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// registry holds the named emulators managed by RunMain.
+var registry = struct {
+	sync.Mutex
+	names     []string
+	opts      map[string][]Option
+	emulators map[string]*Emulator
+}{
+	opts:      map[string][]Option{},
+	emulators: map[string]*Emulator{},
+}
+
+// Register registers a named emulator to be started by RunMain. Each emulator
+// listens on a random port and uses its name as the project ID and as the
+// name in the log lines (see WithName), unless the given options say
+// otherwise. Register must be called before RunMain.
+func Register(name string, opts ...Option) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.opts[name]; !ok {
+		registry.names = append(registry.names, name)
+	}
+	registry.opts[name] = append([]Option{WithRandomPort(), WithProject(name), WithName(name)}, opts...)
+}
+
+// Get returns the named emulator started by RunMain or nil if there is no
+// such emulator.
+func Get(name string) *Emulator {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.emulators[name]
+}
+
+// RunMain starts all the registered emulators, runs the tests and closes the
+// emulators. It returns the exit code to be passed to os.Exit. If any of the
+// emulators fails to start, the tests are not run.
+//
+//	func TestMain(m *testing.M) {
+//		emulator.Register("strong")
+//		emulator.Register("eventual", emulator.WithConsistency(0.5))
+//		os.Exit(emulator.RunMain(m))
+//	}
+//
+// Note that the environment variables point at the emulator started last, so
+// the clients should be built with the Client method of each emulator.
+func RunMain(m *testing.M) int {
+	return runMain(m)
+}
+
+// runMain is RunMain running the tests with m.
+func runMain(m interface{ Run() int }) int {
+	defer closeRegistered()
+	registry.Lock()
+	names := append([]string(nil), registry.names...)
+	registry.Unlock()
+	for _, name := range names {
+		registry.Lock()
+		opts := registry.opts[name]
+		registry.Unlock()
+		e, err := New(opts...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "emulator %q failed to start: %v\n", name, err)
+			return 1
+		}
+		registry.Lock()
+		registry.emulators[name] = e
+		registry.Unlock()
+	}
+	return m.Run()
+}
+
+// closeRegistered closes all the emulators started by RunMain, in the reverse
+// order of their startup, so that each one restores the environment variables
+// to their values from before it was started.
+func closeRegistered() {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range slices.Backward(registry.names) {
+		e, ok := registry.emulators[name]
+		if !ok {
+			continue
+		}
+		if err := e.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "emulator %q failed to close: %v\n", name, err)
+		}
+		delete(registry.emulators, name)
+	}
+}
@@ -0,0 +1,79 @@
+package emulator
+
+import (
+	"os"
+	"testing"
+)
+
+// runFunc runs the tests of runMain.
+type runFunc func() int
+
+func (f runFunc) Run() int { return f() }
+
+// clearRegistry empties the registry at the end of the test.
+func clearRegistry(tb testing.TB) {
+	tb.Cleanup(func() {
+		registry.Lock()
+		defer registry.Unlock()
+		registry.names = nil
+		registry.opts = map[string][]Option{}
+		registry.emulators = map[string]*Emulator{}
+	})
+}
+
+func TestRunMain(t *testing.T) {
+	clearRegistry(t)
+	Register("strong", fakeGcloud()...)
+	Register("eventual", append(fakeGcloud(), WithConsistency(0.5))...)
+	var started []*Emulator
+	code := runMain(runFunc(func() int {
+		strong, eventual := Get("strong"), Get("eventual")
+		if strong == nil || eventual == nil {
+			t.Fatalf("Get() = %v, %v, want the started emulators", strong, eventual)
+		}
+		if strong.ProjectID != "strong" || eventual.ProjectID != "eventual" {
+			t.Errorf("ProjectID = %q, %q, want the names", strong.ProjectID, eventual.ProjectID)
+		}
+		if strong.Host == eventual.Host {
+			t.Errorf("both emulators listen on %s", strong.Host)
+		}
+		if eventual.Consistency() != 0.5 {
+			t.Errorf("Consistency() = %v, want 0.5", eventual.Consistency())
+		}
+		started = append(started, strong, eventual)
+		return 3
+	}))
+	if code != 3 {
+		t.Errorf("runMain() = %d, want the code of the tests", code)
+	}
+	for _, e := range started {
+		select {
+		case <-e.proc.exited():
+		default:
+			t.Errorf("emulator %q still running after runMain", e.Name())
+		}
+	}
+	if Get("strong") != nil {
+		t.Error("Get() returned a closed emulator")
+	}
+	if _, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST"); ok {
+		t.Error("DATASTORE_EMULATOR_HOST is still set after runMain")
+	}
+}
+
+func TestRunMainStartFailure(t *testing.T) {
+	clearRegistry(t)
+	Register("good", fakeGcloud()...)
+	Register("bad", fakeGcloud("FAKE_FAIL=exit")...)
+	ran := false
+	code := runMain(runFunc(func() int {
+		ran = true
+		return 0
+	}))
+	if code != 1 || ran {
+		t.Errorf("runMain() = %d, tests run %v, want 1 without running the tests", code, ran)
+	}
+	if Get("good") != nil {
+		t.Error("the emulator started before the failure wasn't closed")
+	}
+}
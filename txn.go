@@ -0,0 +1,95 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// TransactionConflictError is returned by WithinTransaction when the commit
+// of the transaction conflicts with a concurrent one. It matches
+// datastore.ErrConcurrentTransaction.
+type TransactionConflictError struct {
+	// Keys are the keys read and written by the transaction.
+	Keys []*datastore.Key
+	// Err is the error returned by the commit.
+	Err error
+}
+
+func (e *TransactionConflictError) Error() string {
+	return fmt.Sprintf("transaction conflict on %d keys: %v", len(e.Keys), e.Err)
+}
+
+func (e *TransactionConflictError) Unwrap() error {
+	return e.Err
+}
+
+// WithinTransaction reads the entities with the keys in a transaction, passes
+// them to mutate and commits the entities it returns, which packages the
+// read-modify-write pattern of the optimistic concurrency tests. The missing
+// entities are passed as nil, and the nil entities returned by mutate (which
+// must return one entity per key) are deleted. The transaction is attempted
+// once: a conflict with a concurrent transaction is returned as a
+// TransactionConflictError rather than retried, and an error returned by
+// mutate rolls the transaction back.
+func (e *Emulator) WithinTransaction(ctx context.Context, keys []*datastore.Key, mutate func(entities []datastore.PropertyList) ([]datastore.PropertyList, error)) error {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		entities := make([]datastore.PropertyList, len(keys))
+		if err := tx.GetMulti(keys, entities); err != nil && !onlyMissing(err) {
+			return fmt.Errorf("get: %w", err)
+		}
+		mutated, err := mutate(entities)
+		if err != nil {
+			return err
+		}
+		if len(mutated) != len(keys) {
+			return fmt.Errorf("mutate returned %d entities for %d keys", len(mutated), len(keys))
+		}
+		var putKeys, deleteKeys []*datastore.Key
+		var puts []datastore.PropertyList
+		for i, entity := range mutated {
+			if entity == nil {
+				deleteKeys = append(deleteKeys, keys[i])
+				continue
+			}
+			putKeys = append(putKeys, keys[i])
+			puts = append(puts, entity)
+		}
+		if len(putKeys) > 0 {
+			if _, err := tx.PutMulti(putKeys, puts); err != nil {
+				return fmt.Errorf("put: %w", err)
+			}
+		}
+		if len(deleteKeys) > 0 {
+			if err := tx.DeleteMulti(deleteKeys); err != nil {
+				return fmt.Errorf("delete: %w", err)
+			}
+		}
+		return nil
+	}, datastore.MaxAttempts(1))
+	if errors.Is(err, datastore.ErrConcurrentTransaction) {
+		return &TransactionConflictError{Keys: keys, Err: err}
+	}
+	return err
+}
+
+// onlyMissing reports whether err is a datastore.MultiError of
+// datastore.ErrNoSuchEntity errors only.
+func onlyMissing(err error) bool {
+	var merr datastore.MultiError
+	if !errors.As(err, &merr) {
+		return false
+	}
+	for _, err := range merr {
+		if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestWithinTransaction(t *testing.T) {
+	e, f := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	key := e.NameKey("Counter", "c", nil)
+	increment := func(entities []datastore.PropertyList) ([]datastore.PropertyList, error) {
+		n := int64(0)
+		if entities[0] != nil {
+			n = entities[0][0].Value.(int64)
+		}
+		return []datastore.PropertyList{{{Name: "N", Value: n + 1}}}, nil
+	}
+	count := func() int64 {
+		t.Helper()
+		c, err := e.sharedClient(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pl datastore.PropertyList
+		if err := c.Get(ctx, key, &pl); errors.Is(err, datastore.ErrNoSuchEntity) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return pl[0].Value.(int64)
+	}
+
+	for want := int64(1); want <= 2; want++ {
+		if err := e.WithinTransaction(ctx, []*datastore.Key{key}, increment); err != nil {
+			t.Fatalf("WithinTransaction() error = %v", err)
+		}
+		if got := count(); got != want {
+			t.Errorf("counter = %d, want %d", got, want)
+		}
+	}
+
+	t.Run("conflict", func(t *testing.T) {
+		err := e.WithinTransaction(ctx, []*datastore.Key{key}, func(entities []datastore.PropertyList) ([]datastore.PropertyList, error) {
+			// a concurrent write of the entity read by the transaction
+			c, err := e.sharedClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.Put(ctx, key, &datastore.PropertyList{{Name: "N", Value: int64(10)}}); err != nil {
+				return nil, err
+			}
+			return increment(entities)
+		})
+		var conflict *TransactionConflictError
+		if !errors.As(err, &conflict) || !errors.Is(err, datastore.ErrConcurrentTransaction) || len(conflict.Keys) != 1 {
+			t.Fatalf("WithinTransaction() error = %v, want a TransactionConflictError", err)
+		}
+		if got := count(); got != 10 {
+			t.Errorf("counter = %d, want the concurrent write kept", got)
+		}
+	})
+
+	t.Run("mutate error", func(t *testing.T) {
+		errMutate := errors.New("mutate failed")
+		rollbacks := f.rpcCount("Rollback")
+		err := e.WithinTransaction(ctx, []*datastore.Key{key}, func([]datastore.PropertyList) ([]datastore.PropertyList, error) {
+			return nil, errMutate
+		})
+		if !errors.Is(err, errMutate) {
+			t.Errorf("WithinTransaction() error = %v, want the mutate error", err)
+		}
+		if n := f.rpcCount("Rollback"); n != rollbacks+1 {
+			t.Errorf("the emulator received %d Rollback calls, want 1", n-rollbacks)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := e.WithinTransaction(ctx, []*datastore.Key{key}, func([]datastore.PropertyList) ([]datastore.PropertyList, error) {
+			return []datastore.PropertyList{nil}, nil
+		}); err != nil {
+			t.Fatalf("WithinTransaction() error = %v", err)
+		}
+		if got := count(); got != 0 {
+			t.Errorf("counter = %d, want the entity deleted", got)
+		}
+	})
+}
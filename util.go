@@ -0,0 +1,206 @@
+package emulator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ringBuffer is an io.Writer retaining only the most recent bytes written to
+// it. It is safe to write to from the goroutines copying the subprocess output
+// while being read from elsewhere.
+type ringBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (b *ringBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (b *ringBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// prefixWriter is an io.Writer which prefixes each line written to the
+// underlying writer. Partial lines are buffered until they are completed or
+// the writer is flushed.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the buffered partial line, if any, terminating it with a
+// newline.
+func (pw *prefixWriter) Flush() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if len(pw.buf) == 0 {
+		return
+	}
+	_ = pw.writeLine(append(pw.buf, '\n'))
+	pw.buf = nil
+}
+
+func (pw *prefixWriter) writeLine(line []byte) error {
+	_, err := pw.w.Write(append(append([]byte(nil), pw.prefix...), line...))
+	return err
+}
+
+// teeWriter returns a writer writing to both w and other, or just w if other
+// is nil.
+func teeWriter(w, other io.Writer) io.Writer {
+	if other == nil {
+		return w
+	}
+	return io.MultiWriter(w, other)
+}
+
+// AllocateFreePort asks the kernel for a free TCP port on the loopback
+// interface, e.g. to start a companion service next to the emulator. The port
+// is released before returning, so another process may grab it before it is
+// used: callers binding to it should be ready to retry on a bind failure, the
+// way WithStartRetries does for the emulator.
+func AllocateFreePort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// isBindFailure reports whether the emulator output indicates that it failed
+// to bind to its port.
+func isBindFailure(output string) bool {
+	return strings.Contains(output, "Address already in use") ||
+		strings.Contains(output, "BindException")
+}
+
+// networkFailures are the fragments of the gcloud and emulator output which
+// indicate a failed attempt to reach the network.
+var networkFailures = []string{
+	"metadata.google.internal",
+	"Temporary failure in name resolution",
+	"Network is unreachable",
+	"Connection timed out",
+	"ConnectionError",
+	"Failed to establish a new connection",
+	"UnknownHostException",
+}
+
+// isNetworkFailure reports whether the emulator output indicates that it got
+// stuck trying to reach the network.
+func isNetworkFailure(output string) bool {
+	for _, f := range networkFailures {
+		if strings.Contains(output, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// newName returns a random short id naming an emulator.
+func newName() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// errorWriter is an io.Writer sending the lines matching a pattern to a
+// buffered channel, dropping them when the channel is full so that the
+// subprocess is never blocked by a slow reader.
+type errorWriter struct {
+	mu      sync.Mutex
+	pattern *regexp.Regexp
+	c       chan string
+	buf     []byte
+	closed  bool
+}
+
+func newErrorWriter(pattern *regexp.Regexp, size int) *errorWriter {
+	return &errorWriter{pattern: pattern, c: make(chan string, size)}
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if ew.closed {
+		return len(p), nil
+	}
+	ew.buf = append(ew.buf, p...)
+	for {
+		i := bytes.IndexByte(ew.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(ew.buf[:i]), "\r")
+		ew.buf = ew.buf[i+1:]
+		if !ew.pattern.MatchString(line) {
+			continue
+		}
+		select {
+		case ew.c <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// setPattern replaces the pattern matching the lines to send.
+func (ew *errorWriter) setPattern(pattern *regexp.Regexp) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	ew.pattern = pattern
+}
+
+// close closes the channel; the subsequent writes are discarded.
+func (ew *errorWriter) close() {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if !ew.closed {
+		ew.closed = true
+		close(ew.c)
+	}
+}
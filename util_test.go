@@ -0,0 +1,183 @@
+package emulator
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, e.g. as the output of
+// the emulator process.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := newPrefixWriter(&buf, "[p] ")
+	for _, s := range []string{"ab", "c\nde", "f\n\ng"} {
+		if n, err := pw.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got, want := buf.String(), "[p] abc\n[p] def\n[p] \n"; got != want {
+		t.Errorf("output before Flush = %q, want %q", got, want)
+	}
+	pw.Flush()
+	pw.Flush()
+	if got, want := buf.String(), "[p] abc\n[p] def\n[p] \n[p] g\n"; got != want {
+		t.Errorf("output after Flush = %q, want %q", got, want)
+	}
+}
+
+func TestOutputPrefix(t *testing.T) {
+	var out syncBuffer
+	e := newFakeEmulator(t, []string{"FAKE_STDOUT=hello"}, WithOutput(&out), WithOutputPrefix("[x] "))
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "[x] ") {
+			t.Errorf("output line %q isn't prefixed", line)
+		}
+	}
+	if !strings.Contains(out.String(), "[x] hello\n") {
+		t.Errorf("output = %q, want the prefixed stdout", out.String())
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	b := newRingBuffer(8)
+	for _, s := range []string{"abc", "defgh", "ijklmnopqrstuvwxyz", "12"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got, want := b.String(), "uvwxyz12"; got != want {
+		t.Errorf("String() = %q, want the most recent bytes %q", got, want)
+	}
+}
+
+func TestMaxLogBuffer(t *testing.T) {
+	_, err := New(append(fakeGcloud("FAKE_FAIL=exit", "FAKE_STDERR="+strings.Repeat("x", 100)+"tail"), WithMaxLogBuffer(64))...)
+	var se *StartupError
+	if !errors.As(err, &se) {
+		t.Fatalf("New() error = %v, want a StartupError", err)
+	}
+	if len(se.Output) > 64 || !strings.Contains(se.Output, "ERROR: the emulator failed") {
+		t.Errorf("Output = %q, want at most the last 64 bytes", se.Output)
+	}
+	if err := WithMaxLogBuffer(0)(&Emulator{}); err == nil {
+		t.Error("WithMaxLogBuffer(0) error = nil")
+	}
+}
+
+func TestIsNetworkFailure(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{output: "ERROR: gcloud crashed: unable to reach metadata.google.internal", want: true},
+		{output: "java.net.UnknownHostException: oauth2.googleapis.com", want: true},
+		{output: "socket.gaierror: [Errno -3] Temporary failure in name resolution", want: true},
+		{output: "ERROR: the emulator failed"},
+		{output: "java.net.BindException: Address already in use"},
+		{output: ""},
+	}
+	for _, tt := range tests {
+		if got := isNetworkFailure(tt.output); got != tt.want {
+			t.Errorf("isNetworkFailure(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkHang(t *testing.T) {
+	_, err := New(append(fakeGcloud("FAKE_FAIL=network"), WithTimeout(500*time.Millisecond))...)
+	var se *StartupError
+	if !errors.As(err, &se) || !errors.Is(err, ErrNetwork) {
+		t.Errorf("New() error = %v, want a StartupError wrapping ErrNetwork", err)
+	}
+}
+
+func TestErrorWriter(t *testing.T) {
+	ew := newErrorWriter(defaultErrorPattern, 2)
+	for _, s := range []string{"INFO: fine\nWARN", "ING: first\r\n", "SEVERE: second\nERROR: dropped\n", "ERROR: unterminated"} {
+		if n, err := ew.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	ew.close()
+	ew.close()
+	if _, err := ew.Write([]byte("ERROR: after close\n")); err != nil {
+		t.Errorf("Write() after close error = %v", err)
+	}
+	var got []string
+	for line := range ew.c {
+		got = append(got, line)
+	}
+	if want := []string{"WARNING: first", "SEVERE: second"}; !slices.Equal(got, want) {
+		t.Errorf("the sent lines are %q, want %q", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	e := newFakeEmulator(t, []string{"FAKE_STDERR=note: index missing"}, WithErrorPattern(`index`))
+	select {
+	case line := <-e.Errors():
+		if line != "note: index missing" {
+			t.Errorf("Errors() received %q, want the matching stderr line", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Errors() received nothing")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for line := range e.Errors() {
+		t.Errorf("Errors() received %q, want only the matching line", line)
+	}
+	if err := WithErrorPattern("(")(applyOptions(t)); err == nil {
+		t.Error(`WithErrorPattern("(") error = nil`)
+	}
+}
+
+func TestAllocateFreePort(t *testing.T) {
+	first, err := AllocateFreePort()
+	if err != nil {
+		t.Fatalf("AllocateFreePort() error = %v", err)
+	}
+	second, err := AllocateFreePort()
+	if err != nil {
+		t.Fatalf("AllocateFreePort() error = %v", err)
+	}
+	if first == second {
+		t.Errorf("AllocateFreePort() returned %d twice", first)
+	}
+	for _, port := range []int{first, second} {
+		l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("port %d is not usable: %v", port, err)
+			continue
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WaitForEntity blocks until the entity with the key exists or the context is
+// done, polling at the polling rate. It helps when an entity is written by
+// one client and read by another.
+func (e *Emulator) WaitForEntity(ctx context.Context, key *datastore.Key) error {
+	c, err := e.sharedClient(ctx)
+	if err != nil {
+		return err
+	}
+	t := time.NewTicker(pollingRate)
+	defer t.Stop()
+	for {
+		var pl datastore.PropertyList
+		err := c.Get(ctx, key, &pl)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, datastore.ErrNoSuchEntity) && ctx.Err() == nil {
+			return fmt.Errorf("wait for entity %v: %w", key, err)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return fmt.Errorf("entity %v does not exist: %w", key, ctx.Err())
+		}
+	}
+}
+
+// WaitForPort blocks until the TCP port of the emulator accepts connections
+// or the context is done, polling at the polling rate. It is a lighter
+// readiness signal than the HTTP health check, independent of it.
+func (e *Emulator) WaitForPort(ctx context.Context) error {
+	if !e.started() {
+		return ErrNotStarted
+	}
+	addr := e.GRPCEndpoint()
+	t := time.NewTicker(pollingRate)
+	defer t.Stop()
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return fmt.Errorf("port %s is not listening: %w", addr, ctx.Err())
+		}
+	}
+}
+
+// WaitHealthy blocks until the health check of the emulator succeeds or the
+// context is done, polling at the polling rate.
+func (e *Emulator) WaitHealthy(ctx context.Context) error {
+	if !e.started() {
+		return ErrNotStarted
+	}
+	t := e.clock.NewTicker(pollingRate)
+	defer t.Stop()
+	for {
+		err := e.probe()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-t.C():
+		case <-ctx.Done():
+			return fmt.Errorf("emulator %s is not healthy: %w (last error: %v)", e.name, ctx.Err(), err)
+		}
+	}
+}
+
+// WaitAllHealthy waits for all the emulators to become healthy in parallel,
+// see WaitHealthy. It returns the errors of all the emulators which didn't.
+func WaitAllHealthy(ctx context.Context, emulators ...*Emulator) error {
+	errs := make([]error, len(emulators))
+	var wg sync.WaitGroup
+	for i, e := range emulators {
+		wg.Go(func() {
+			errs[i] = e.WaitHealthy(ctx)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// WaitForCount blocks until there are exactly want entities of the kind in the
+// namespace (see Count) or the context is done, polling at the polling rate.
+// It handles the delay between asynchronous writes and their visibility.
+func (e *Emulator) WaitForCount(ctx context.Context, kind, namespace string, want int) error {
+	t := time.NewTicker(pollingRate)
+	defer t.Stop()
+	last := 0 // the last observed count
+	for {
+		got, err := e.Count(ctx, kind, namespace)
+		if err == nil && got == want {
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("wait for count of %s: %w", kind, err)
+		}
+		if err == nil {
+			last = got
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return fmt.Errorf("count of %s is %d, want %d: %w", kind, last, want, ctx.Err())
+		}
+	}
+}
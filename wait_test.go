@@ -0,0 +1,172 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForEntity(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	c, err := e.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	type entity struct{ N int }
+	key := e.NameKey("Kind", "late", nil)
+	time.AfterFunc(3*pollingRate, func() {
+		_, _ = c.Put(ctx, key, &entity{})
+	})
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := e.WaitForEntity(wctx, key); err != nil {
+		t.Errorf("WaitForEntity() error = %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 3*pollingRate)
+	defer cancel()
+	err = e.WaitForEntity(short, e.NameKey("Kind", "missing", nil))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForEntity() of a missing entity error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestWaitForPort(t *testing.T) {
+	ctx := context.Background()
+	if err := (&Emulator{}).WaitForPort(ctx); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("WaitForPort() before Start error = %v, want ErrNotStarted", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	e := &Emulator{Host: "http://" + addr}
+	e.init()
+
+	short, cancel := context.WithTimeout(ctx, 3*pollingRate)
+	defer cancel()
+	if err := e.WaitForPort(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForPort() of a closed port error = %v, want context.DeadlineExceeded", err)
+	}
+
+	opened := make(chan net.Listener, 1)
+	time.AfterFunc(3*pollingRate, func() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			close(opened)
+			return
+		}
+		opened <- l
+	})
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := e.WaitForPort(wctx); err != nil {
+		t.Errorf("WaitForPort() error = %v", err)
+	}
+	if l, ok := <-opened; ok {
+		l.Close()
+	}
+}
+
+func TestWaitAllHealthy(t *testing.T) {
+	var emulators []*Emulator
+	for _, name := range []string{"one", "two"} {
+		emulators = append(emulators, newTestEmulator(t, WithBackend(BackendFake), WithName(name)))
+	}
+	ctx := context.Background()
+	if err := WaitAllHealthy(ctx, emulators...); err != nil {
+		t.Errorf("WaitAllHealthy() error = %v", err)
+	}
+
+	emulators[1].stopFake()
+	short, cancel := context.WithTimeout(ctx, 3*pollingRate)
+	defer cancel()
+	err := WaitAllHealthy(short, emulators...)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "emulator two") || strings.Contains(err.Error(), "emulator one") {
+		t.Errorf("WaitAllHealthy() error = %v, want the unhealthy emulator two", err)
+	}
+}
+
+func TestWaitHealthyClock(t *testing.T) {
+	const failures = 3
+	hits := make(chan int, 10)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(n.Add(1))
+		if i <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		hits <- i
+	}))
+	defer srv.Close()
+	clk := newFakeClock()
+	e := applyOptions(t, withClock(clk))
+	e.Host = srv.URL
+	done := make(chan error, 1)
+	go func() { done <- e.WaitHealthy(context.Background()) }()
+	clk.waitTicker(t)
+	probe := func() int {
+		t.Helper()
+		select {
+		case i := <-hits:
+			return i
+		case <-time.After(5 * time.Second):
+			t.Fatal("no health check was performed")
+			return 0
+		}
+	}
+	if i := probe(); i != 1 {
+		t.Fatalf("health check %d, want the first one right away", i)
+	}
+	select {
+	case i := <-hits:
+		t.Fatalf("health check %d without advancing the clock", i)
+	case <-time.After(3 * pollingRate):
+	}
+	for want := 2; want <= failures+1; want++ {
+		clk.Advance(pollingRate)
+		if i := probe(); i != want {
+			t.Fatalf("health check %d after advancing the clock, want %d", i, want)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitHealthy() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitHealthy didn't return after the successful health check")
+	}
+}
+
+func TestWaitForCount(t *testing.T) {
+	e, _ := newAdoptingEmulator(t, fakeConfig{})
+	ctx := context.Background()
+	time.AfterFunc(3*pollingRate, func() {
+		putEntities(t, e, "Kind", "ns", 3)
+	})
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := e.WaitForCount(wctx, "Kind", "ns", 3); err != nil {
+		t.Errorf("WaitForCount() error = %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 3*pollingRate)
+	defer cancel()
+	err := e.WaitForCount(short, "Kind", "ns", 5)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "is 3, want 5") {
+		t.Errorf("WaitForCount() of a missing count error = %v, want the last count reported", err)
+	}
+}